@@ -0,0 +1,163 @@
+package main
+
+import "sync/atomic"
+
+// Slots of an appendLog are allocated in fixed-size segments so that a
+// growing log never moves published entries
+const logSegmentSize = 256
+
+type logSegment[T any] [logSegmentSize]atomic.Pointer[T]
+
+// logSegments is the segment directory of an appendLog. It is replaced, not
+// modified, when the log grows or drops old segments.
+type logSegments[T any] struct {
+	base int64 // number of the first segment in list
+	list []*logSegment[T]
+}
+
+// appendLog is an append-only sequence that writers and readers use without
+// locks. A writer reserves a slot by incrementing the length, then publishes
+// its entry into the slot; readers skip slots that are reserved but not yet
+// published, so an entry becomes visible as soon as its own append is done
+// regardless of slower writers before it.
+//
+// The oldest entries can be dropped, which releases their segments, so the
+// memory a log holds is bounded by how many entries it retains.
+type appendLog[T any] struct {
+	length   atomic.Int64 // slots ever reserved
+	first    atomic.Int64 // first slot that has not been dropped
+	segments atomic.Pointer[logSegments[T]]
+}
+
+// append adds entry, which must not be modified afterwards
+func (l *appendLog[T]) append(entry *T) {
+	l.publish(l.reserve(), entry)
+}
+
+// reserve allocates the next slot, which the caller must then publish.
+// Slots are numbered from 0 and never reused.
+func (l *appendLog[T]) reserve() int64 {
+	return l.length.Add(1) - 1
+}
+
+// publish stores entry, which must not be modified afterwards, in a slot
+// returned by reserve
+func (l *appendLog[T]) publish(slot int64, entry *T) {
+	l.segment(slot/logSegmentSize, true)[slot%logSegmentSize].Store(entry)
+}
+
+// segment returns the i-th segment, or nil if it has been dropped or does
+// not exist and grow is false. Growing copies the segment directory and
+// installs the copy with a compare-and-swap, retrying if the directory was
+// replaced in the meantime.
+func (l *appendLog[T]) segment(i int64, grow bool) *logSegment[T] {
+	for {
+		dir := l.segments.Load()
+		current := &logSegments[T]{}
+		if dir != nil {
+			current = dir
+		}
+		if i < current.base {
+			return nil
+		}
+		if i-current.base < int64(len(current.list)) {
+			return current.list[i-current.base]
+		}
+		if !grow {
+			return nil
+		}
+
+		grown := &logSegments[T]{base: current.base, list: make([]*logSegment[T], i-current.base+1)}
+		copy(grown.list, current.list)
+		for j := len(current.list); j < len(grown.list); j++ {
+			grown.list[j] = new(logSegment[T])
+		}
+		if l.segments.CompareAndSwap(dir, grown) {
+			return grown.list[i-grown.base]
+		}
+	}
+}
+
+// load returns the entry in slot, or nil if it is unpublished or dropped
+func (l *appendLog[T]) load(slot int64) *T {
+	if seg := l.segment(slot/logSegmentSize, false); seg != nil {
+		return seg[slot%logSegmentSize].Load()
+	}
+	return nil
+}
+
+// last returns up to n of the most recent published entries, oldest first
+func (l *appendLog[T]) last(n int) []*T {
+	var entries []*T
+	first := l.first.Load()
+	for slot := l.length.Load() - 1; slot >= first && len(entries) < n; slot-- {
+		if entry := l.load(slot); entry != nil {
+			entries = append(entries, entry)
+		}
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries
+}
+
+// all returns every published entry, oldest first
+func (l *appendLog[T]) all() []*T {
+	return l.last(int(l.length.Load()))
+}
+
+// published returns the entries up to the first slot that is reserved but
+// not yet published, oldest first. Unlike all, it never returns an entry
+// while one before it is still missing.
+func (l *appendLog[T]) published() []*T {
+	var entries []*T
+	length := l.length.Load()
+	for slot := l.first.Load(); slot < length; slot++ {
+		entry := l.load(slot)
+		if entry == nil {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// expired returns the oldest entries that fall outside a retention of the
+// newest keep entries (no limit if keep is 0) or that match old, stopping
+// at the first entry that is kept or not yet published. Only one caller at
+// a time may use expired and drop.
+func (l *appendLog[T]) expired(keep int, old func(*T) bool) []*T {
+	var entries []*T
+	length := l.length.Load()
+	for slot := l.first.Load(); slot < length; slot++ {
+		entry := l.load(slot)
+		if entry == nil {
+			break
+		}
+		if (keep == 0 || slot >= length-int64(keep)) && !old(entry) {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// drop discards the n oldest entries and releases the segments that only
+// held dropped entries
+func (l *appendLog[T]) drop(n int) {
+	first := l.first.Add(int64(n))
+	base := first / logSegmentSize
+	for {
+		dir := l.segments.Load()
+		if dir == nil || dir.base >= base {
+			return
+		}
+		trimmed := &logSegments[T]{base: base}
+		if skip := base - dir.base; skip < int64(len(dir.list)) {
+			trimmed.list = append(trimmed.list, dir.list[skip:]...)
+		}
+		if l.segments.CompareAndSwap(dir, trimmed) {
+			return
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// mutexLog is the mutex-guarded slice that appendLog replaced, kept as the
+// baseline of BenchmarkAppendLogParallel
+type mutexLog[T any] struct {
+	mu      sync.RWMutex
+	entries []*T
+}
+
+func (l *mutexLog[T]) append(entry *T) {
+	l.mu.Lock()
+	l.entries = append(l.entries, entry)
+	l.mu.Unlock()
+}
+
+func (l *mutexLog[T]) last(n int) []*T {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return append([]*T(nil), l.entries[max(0, len(l.entries)-n):]...)
+}
+
+// BenchmarkAppendLogParallel appends and reads the most recent 20 entries
+// of one log from GOMAXPROCS goroutines, with the given share of appends:
+//
+//	go test -run '^$' -bench AppendLogParallel -cpu 1,4,8
+func BenchmarkAppendLogParallel(b *testing.B) {
+	type log interface {
+		append(*ActivityLog)
+		last(int) []*ActivityLog
+	}
+	for _, writes := range []int{10, 50} {
+		for _, impl := range []struct {
+			name string
+			new  func() log
+		}{
+			{"appendLog", func() log { return new(appendLog[ActivityLog]) }},
+			{"mutex", func() log { return new(mutexLog[ActivityLog]) }},
+		} {
+			b.Run(fmt.Sprintf("%s/writes=%d%%", impl.name, writes), func(b *testing.B) {
+				l := impl.new()
+				for i := 0; i < 1000; i++ {
+					l.append(&ActivityLog{})
+				}
+				var seed atomic.Int64
+				b.RunParallel(func(pb *testing.PB) {
+					rng := rand.New(rand.NewSource(seed.Add(1)))
+					for pb.Next() {
+						if rng.Intn(100) < writes {
+							l.append(&ActivityLog{})
+						} else if len(l.last(20)) != 20 {
+							b.Error("short read")
+						}
+					}
+				})
+			})
+		}
+	}
+}
+
+// TestAppendLogConcurrent appends from several goroutines while others read
+// and checks that no entry is lost or seen out of place
+func TestAppendLogConcurrent(t *testing.T) {
+	const writers, perWriter = 8, 2000
+	var l appendLog[int]
+	var wg, readers sync.WaitGroup
+	done := make(chan struct{})
+
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for _, entry := range l.last(50) {
+				if entry == nil {
+					t.Error("last returned an unpublished slot")
+					return
+				}
+			}
+		}
+	}()
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				v := w*perWriter + i
+				l.append(&v)
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	seen := make(map[int]bool)
+	for _, entry := range l.all() {
+		seen[*entry] = true
+	}
+	if len(seen) != writers*perWriter {
+		t.Errorf("got %d distinct entries, want %d", len(seen), writers*perWriter)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Every request that may change data is audited. Handlers that know what
+// happened write a specific entry with recordAudit; for any other mutating
+// request, or one whose specific entry did not match the outcome (say, a
+// transaction that wrote it was rolled back), auditRequests writes a
+// generic entry named after the route's permission. Either kind carries the
+// actor, the user agent and, if the handler reported one with auditChange,
+// a field-level diff of the resource.
+
+// auditState is what the handler of a mutating request reports for its
+// audit entry
+type auditState struct {
+	before, after interface{}
+	changed       bool
+	recorded      string // status of the entry the handler wrote, if any
+}
+
+// auditIgnoredFields change on every write and are left out of diffs
+var auditIgnoredFields = map[string]bool{"version": true, "updated_at": true}
+
+// auditRequests writes the generic audit entry for mutating requests the
+// handler did not audit itself. It must run outside renderErrors so that it
+// sees the final response status.
+func auditRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+
+		state := &auditState{}
+		c.Set(contextAuditKey, state)
+		c.Next()
+
+		status := c.Writer.Status()
+		outcome := "success"
+		if status >= http.StatusBadRequest {
+			outcome = "failure"
+		}
+		if state.recorded == outcome {
+			return
+		}
+
+		resourceType, action := requestAction(c)
+		// Session and invitation tokens are credentials and stay out of the log
+		var resourceID string
+		if len(c.Params) > 0 && c.Params[0].Key != "token" {
+			resourceID = c.Params[0].Value
+		} else if id, ok := auditFields(state.after)["id"].(string); ok {
+			resourceID = id
+		}
+		details := map[string]interface{}{
+			"method":     c.Request.Method,
+			"route":      c.FullPath(),
+			"status":     status,
+			"request_id": c.GetString(contextRequestIDKey),
+		}
+		if outcome == "failure" && len(c.Errors) > 0 {
+			details["error"] = problemFor(c.Errors.Last().Err).Detail
+		}
+		if changes := state.changes(); outcome == "success" && changes != nil {
+			details["changes"] = changes
+		}
+
+		entry := auditEntry(c, action, resourceType, resourceID, details)
+		entry.Status = outcome
+		if err := store.AuditLogs().Create(entry); err != nil {
+			log.Printf("request %s: audit: %v", details["request_id"], err)
+		}
+	}
+}
+
+// requestAction names a request by the permission its route requires, as
+// "<resource>.<action>", or else by its path, such as "auth.mfa.disable"
+func requestAction(c *gin.Context) (resourceType, action string) {
+	if permission := c.GetString(contextPermissionKey); permission != "" {
+		resourceType, _, _ = strings.Cut(permission, ".")
+		return resourceType, permission
+	}
+
+	var parts []string
+	for _, part := range strings.Split(strings.Trim(c.FullPath(), "/"), "/") {
+		if part != "" && !strings.HasPrefix(part, ":") {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return "", strings.ToLower(c.Request.Method)
+	}
+	return parts[0], strings.Join(parts, ".")
+}
+
+// auditChange reports the state of the request's resource before and after
+// the change; before is nil for a creation and after is nil for a deletion
+func auditChange(c *gin.Context, before, after interface{}) {
+	if state, ok := c.Value(contextAuditKey).(*auditState); ok {
+		state.before, state.after, state.changed = before, after, true
+	}
+}
+
+// recordAudit writes an entry the handler built for its request, setting
+// the actor, the user agent and the reported change, so that auditRequests
+// does not write a generic one
+func recordAudit(c *gin.Context, s Store, entry *AuditLog) error {
+	if caller := currentUser(c); caller != nil {
+		entry.UserID = caller.ID
+	}
+	if entry.UserAgent == "" {
+		entry.UserAgent = c.Request.UserAgent()
+	}
+
+	state, _ := c.Value(contextAuditKey).(*auditState)
+	if changes := state.changes(); changes != nil {
+		if entry.Details == nil {
+			entry.Details = map[string]interface{}{}
+		}
+		entry.Details["changes"] = changes
+	}
+
+	if err := s.AuditLogs().Create(entry); err != nil {
+		return err
+	}
+	if state != nil {
+		state.recorded = entry.Status
+	}
+	return nil
+}
+
+// changes diffs the JSON forms of the reported before and after states,
+// field by field, as {"field": {"from": ..., "to": ...}}, or returns nil if
+// no change was reported
+func (s *auditState) changes() map[string]interface{} {
+	if s == nil || !s.changed {
+		return nil
+	}
+	before, after := auditFields(s.before), auditFields(s.after)
+
+	changes := map[string]interface{}{}
+	for name, from := range before {
+		if to := after[name]; !auditIgnoredFields[name] && !reflect.DeepEqual(from, to) {
+			changes[name] = map[string]interface{}{"from": from, "to": to}
+		}
+	}
+	for name, to := range after {
+		if _, seen := before[name]; !seen && !auditIgnoredFields[name] {
+			changes[name] = map[string]interface{}{"from": nil, "to": to}
+		}
+	}
+	return changes
+}
+
+// auditFields returns the JSON fields of a resource; hidden fields such as
+// password hashes never appear in a diff
+func auditFields(resource interface{}) map[string]interface{} {
+	fields := map[string]interface{}{}
+	if resource == nil || reflect.ValueOf(resource).IsNil() {
+		return fields
+	}
+	data, err := json.Marshal(resource)
+	if err == nil {
+		json.Unmarshal(data, &fields)
+	}
+	return fields
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The audit log is a hash chain: every entry stores the hash of the entry
+// before it and a hash over its own content and that link, so altering,
+// inserting or removing an entry breaks the chain after it. Because anyone
+// able to rewrite the log could also recompute the hashes that follow,
+// the head of the chain is periodically signed in a checkpoint; a rewrite
+// of checkpointed entries then no longer matches the checkpoint.
+//
+// Retention drops the oldest entries. It then signs the hash of the last
+// entry it dropped in an anchor checkpoint, and the first retained entry
+// must link to the newest anchor, or to nothing if there is none, so that
+// entries cannot be removed from the start of the log either.
+
+// Kinds of audit checkpoints
+const (
+	checkpointHead   = "head"   // signs the head of the log
+	checkpointAnchor = "anchor" // signs the last entry dropped by retention
+)
+
+// AuditCheckpoint is a signed statement of the audit log's head, or of the
+// entry before its first retained one
+type AuditCheckpoint struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	EntryID   string    `json:"entry_id"`
+	EntryHash string    `json:"entry_hash"`
+	KeyID     string    `json:"key_id"`
+	Signature string    `json:"signature"` // base64 Ed25519 signature of signedContent
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// chainHash computes the entry's hash: SHA-256, hex encoded, of the JSON
+// form of its content and PrevHash
+func (l *AuditLog) chainHash() string {
+	// Details are compared in the form they have after a JSON round trip,
+	// which is how SQL stores return them
+	var details interface{}
+	if data, err := json.Marshal(l.Details); err == nil {
+		json.Unmarshal(data, &details)
+	}
+
+	content, _ := json.Marshal([]interface{}{
+		l.ID, l.UserID, l.Action, l.ResourceID, l.ResourceType, l.IPAddress, l.UserAgent, l.Status,
+		details, l.CreatedAt.UTC().Format(time.RFC3339Nano), l.PrevHash,
+	})
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// chainTime is the creation time of a new entry or checkpoint, at the
+// precision every store keeps, so that hashes and signatures still match
+// after a round trip through the database
+func chainTime() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+// link sets the entry's creation time, PrevHash and Hash to append it after
+// the entry with hash prevHash
+func (l *AuditLog) link(prevHash string) {
+	l.CreatedAt = chainTime()
+	l.PrevHash = prevHash
+	l.Hash = l.chainHash()
+}
+
+// signedContent is what a checkpoint's signature covers. Anchors are
+// marked, so that a head checkpoint cannot be passed off as one.
+func (cp *AuditCheckpoint) signedContent() []byte {
+	content := cp.EntryID + "\n" + cp.EntryHash + "\n" + cp.CreatedAt.UTC().Format(time.RFC3339Nano)
+	if cp.Kind == checkpointAnchor {
+		content = checkpointAnchor + "\n" + content
+	}
+	return []byte(content)
+}
+
+// checkpointSigner signs audit checkpoints with an Ed25519 key, and
+// verifies them with that key or one of the trusted public keys
+type checkpointSigner struct {
+	key     ed25519.PrivateKey
+	keyID   string
+	trusted map[string]ed25519.PublicKey // key ID → key
+}
+
+// publicKeyID identifies an Ed25519 public key
+func publicKeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// auditSigner signs and verifies audit checkpoints; it is set up in main
+var auditSigner *checkpointSigner
+
+// newCheckpointSigner uses the base64 Ed25519 seed in seed, or a key of its
+// own if seed is empty, and also accepts checkpoints signed by the base64
+// Ed25519 public keys in trusted. Checkpoints signed with a generated key
+// cannot be verified after a restart.
+func newCheckpointSigner(seed string, trusted []string) (*checkpointSigner, error) {
+	var key ed25519.PrivateKey
+	if seed == "" {
+		_, generated, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("AUDIT_SIGNING_KEY is not set; audit checkpoints are signed with a temporary key")
+		key = generated
+	} else {
+		raw, err := base64.StdEncoding.DecodeString(seed)
+		if err != nil || len(raw) != ed25519.SeedSize {
+			return nil, errors.New("AUDIT_SIGNING_KEY must be a base64 Ed25519 seed of 32 bytes")
+		}
+		key = ed25519.NewKeyFromSeed(raw)
+		log.Printf("audit checkpoints are signed with public key %s; list it in AUDIT_TRUSTED_KEYS after rotating the key",
+			base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+	}
+
+	public := key.Public().(ed25519.PublicKey)
+	s := &checkpointSigner{key: key, keyID: publicKeyID(public), trusted: map[string]ed25519.PublicKey{}}
+	s.trusted[s.keyID] = public
+	for _, encoded := range trusted {
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(raw) != ed25519.PublicKeySize {
+			return nil, errors.New("AUDIT_TRUSTED_KEYS must list base64 Ed25519 public keys of 32 bytes")
+		}
+		s.trusted[publicKeyID(raw)] = raw
+	}
+	return s, nil
+}
+
+// checkpoint signs the log's current head, unless the latest checkpoint
+// already covers it. It reports whether a checkpoint was written.
+func (s *checkpointSigner) checkpoint(logs AuditLogRepository) (bool, error) {
+	head, err := logs.Head()
+	if err != nil || head == nil || head.Hash == "" {
+		return false, err
+	}
+	checkpoints, err := logs.Checkpoints()
+	if err != nil {
+		return false, err
+	}
+	for i := len(checkpoints) - 1; i >= 0; i-- {
+		if checkpoints[i].Kind == checkpointHead {
+			if checkpoints[i].EntryID == head.ID {
+				return false, nil
+			}
+			break
+		}
+	}
+	return true, logs.CreateCheckpoint(s.sign(checkpointHead, head))
+}
+
+// anchor signs the hash of dropped, the last entry retention dropped
+func (s *checkpointSigner) anchor(logs AuditLogRepository, dropped *AuditLog) error {
+	return logs.CreateCheckpoint(s.sign(checkpointAnchor, dropped))
+}
+
+// sign returns a checkpoint of the given kind for entry
+func (s *checkpointSigner) sign(kind string, entry *AuditLog) *AuditCheckpoint {
+	cp := &AuditCheckpoint{
+		ID:        generateID("checkpoint"),
+		Kind:      kind,
+		EntryID:   entry.ID,
+		EntryHash: entry.Hash,
+		KeyID:     s.keyID,
+		CreatedAt: chainTime(),
+	}
+	cp.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, cp.signedContent()))
+	return cp
+}
+
+// verify returns why cp's signature does not hold, or "" if it does
+func (s *checkpointSigner) verify(cp *AuditCheckpoint) string {
+	key, trusted := s.trusted[cp.KeyID]
+	if !trusted {
+		return "signed with key " + cp.KeyID + ", which is not trusted"
+	}
+	signature, err := base64.StdEncoding.DecodeString(cp.Signature)
+	if err != nil || !ed25519.Verify(key, cp.signedContent(), signature) {
+		return "signature is invalid"
+	}
+	return ""
+}
+
+// startAuditCheckpoints signs the audit log's head every interval
+func startAuditCheckpoints(s Store, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(interval)
+			if _, err := auditSigner.checkpoint(s.AuditLogs()); err != nil {
+				log.Printf("audit checkpoint: %v", err)
+			}
+		}
+	}()
+}
+
+// chainReport is the outcome of verifying the audit log
+type chainReport struct {
+	Valid              bool                `json:"valid"`
+	Entries            int                 `json:"entries"`
+	Unchained          int                 `json:"unchained"` // entries written before the log was chained
+	Checkpoints        int                 `json:"checkpoints"`
+	FirstBroken        *brokenLink         `json:"first_broken,omitempty"`
+	CheckpointProblems []checkpointProblem `json:"checkpoint_problems,omitempty"`
+}
+
+// brokenLink locates the first entry at which the chain does not hold
+type brokenLink struct {
+	Position int    `json:"position"` // among the retained entries, oldest first
+	EntryID  string `json:"entry_id"`
+	Reason   string `json:"reason"`
+}
+
+type checkpointProblem struct {
+	CheckpointID string `json:"checkpoint_id"`
+	EntryID      string `json:"entry_id"`
+	Reason       string `json:"reason"`
+}
+
+// verifyAuditChain checks every checkpoint's signature, then walks the
+// audit log from its oldest entry, checking each hash and link, and finally
+// checks the head checkpoints against the entries
+func verifyAuditChain(logs AuditLogRepository, signer *checkpointSigner) (*chainReport, error) {
+	report := &chainReport{}
+	problem := func(cp *AuditCheckpoint, reason string) {
+		report.CheckpointProblems = append(report.CheckpointProblems,
+			checkpointProblem{CheckpointID: cp.ID, EntryID: cp.EntryID, Reason: reason})
+	}
+
+	checkpoints, err := logs.Checkpoints()
+	if err != nil {
+		return nil, err
+	}
+	report.Checkpoints = len(checkpoints)
+	var heads []*AuditCheckpoint
+	var anchor *AuditCheckpoint // the newest one
+	for _, cp := range checkpoints {
+		if reason := signer.verify(cp); reason != "" {
+			problem(cp, reason)
+			continue
+		}
+		if cp.Kind == checkpointAnchor {
+			anchor = cp
+		} else {
+			heads = append(heads, cp)
+		}
+	}
+
+	chainStart, err := logs.ChainStart()
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[string]string)
+	var prev *AuditLog
+	var oldest time.Time
+
+	err = logs.Walk(func(entry *AuditLog) error {
+		position := report.Entries
+		report.Entries++
+		if report.Entries == 1 {
+			oldest = entry.CreatedAt
+		}
+		hashes[entry.ID] = entry.Hash
+		if report.FirstBroken != nil {
+			return nil
+		}
+
+		var reason string
+		switch {
+		case entry.Hash == "" && prev == nil && entry.Seq < chainStart:
+			report.Unchained++
+			return nil
+		case entry.Hash == "":
+			reason = "entry has no hash"
+		case entry.Hash != entry.chainHash():
+			reason = "hash does not match the entry's content"
+		case prev == nil && anchor == nil && entry.PrevHash != "":
+			reason = "first entry links to an entry that was dropped without an anchor checkpoint"
+		case prev == nil && anchor != nil && entry.PrevHash != anchor.EntryHash:
+			reason = "prev_hash does not match the hash in anchor checkpoint " + anchor.ID
+		case prev != nil && entry.PrevHash != prev.Hash:
+			reason = "prev_hash does not match the hash of the previous entry " + prev.ID
+		}
+		if reason != "" {
+			report.FirstBroken = &brokenLink{Position: position, EntryID: entry.ID, Reason: reason}
+		}
+		prev = entry
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cp := range heads {
+		switch hash, exists := hashes[cp.EntryID]; {
+		case !exists && cp.CreatedAt.Before(oldest):
+			// The entry has been dropped by retention
+		case !exists:
+			problem(cp, "checkpointed entry is missing")
+		case hash != cp.EntryHash:
+			problem(cp, "checkpointed entry's hash has changed")
+		}
+	}
+	report.Valid = report.FirstBroken == nil && len(report.CheckpointProblems) == 0
+	return report, nil
+}
+
+// verifyAuditLogHandler verifies the audit log's hash chain and checkpoints
+func verifyAuditLogHandler(c *gin.Context) {
+	report, err := verifyAuditChain(store.AuditLogs(), auditSigner)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// runAuditCommand implements "audit verify", which prints the verification
+// report and fails if the audit log does not verify, and "audit export"
+func runAuditCommand(cfg Config, args []string) error {
+	if len(args) == 0 || (args[0] != "verify" && args[0] != "export") {
+		return errors.New(`usage: audit verify | audit export [-format csv|jsonl|cef] [-o file] [-signature file] [filter=value ...]`)
+	}
+	if cfg.StorageDriver == "memory" {
+		return errors.New("the memory store is not shared with the server; use GET /audit-logs/" + args[0])
+	}
+	if args[0] == "export" {
+		return runAuditExport(cfg, args[1:])
+	}
+
+	s, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	signer, err := newCheckpointSigner(cfg.AuditSigningKey, cfg.AuditTrustedKeys)
+	if err != nil {
+		return err
+	}
+
+	report, err := verifyAuditChain(s.AuditLogs(), signer)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	if !report.Valid {
+		return fmt.Errorf("audit log verification failed")
+	}
+	return nil
+}
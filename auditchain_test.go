@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"testing"
+)
+
+func TestVerifyAuditChainRejectsBlankHash(t *testing.T) {
+	s := newMemoryStore()
+	for i := 0; i < 3; i++ {
+		s.AuditLogs().Create(&AuditLog{ID: generateID("audit"), Action: "test"})
+	}
+	// Blank hashes are only accepted on entries written before chaining
+	s.auditLogs.all()[1].Hash = ""
+
+	signer, _ := newCheckpointSigner("", nil)
+	report, err := verifyAuditChain(s.AuditLogs(), signer)
+	if err != nil || report.Valid || report.FirstBroken == nil || report.FirstBroken.Position != 1 {
+		t.Errorf("got %+v, %v", report, err)
+	}
+}
+
+func TestVerifyAuditChainCheckpointKeys(t *testing.T) {
+	s := newMemoryStore()
+	s.AuditLogs().Create(&AuditLog{ID: generateID("audit"), Action: "test"})
+	previous, _ := newCheckpointSigner("", nil)
+	if _, err := previous.checkpoint(s.AuditLogs()); err != nil {
+		t.Fatal(err)
+	}
+
+	current, _ := newCheckpointSigner("", nil)
+	if report, _ := verifyAuditChain(s.AuditLogs(), current); report.Valid || len(report.CheckpointProblems) != 1 {
+		t.Errorf("checkpoint of an unknown key: got %+v", report)
+	}
+
+	publicKey := base64.StdEncoding.EncodeToString(previous.key.Public().(ed25519.PublicKey))
+	trusting, err := newCheckpointSigner("", []string{publicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report, _ := verifyAuditChain(s.AuditLogs(), trusting); !report.Valid {
+		t.Errorf("checkpoint of a trusted key: got %+v", report)
+	}
+}
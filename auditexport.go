@@ -0,0 +1,363 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Audit log exports are written a page at a time, so an export of any size
+// holds at most exportPageSize entries in memory. An export can be signed:
+// the signature is an Ed25519 signature, by the audit checkpoint key, of
+// the hex SHA-256 digest of the exported bytes.
+
+const exportPageSize = 500
+
+// exportContentTypes are the export formats and their media types
+var exportContentTypes = map[string]string{
+	"csv":   "text/csv; charset=utf-8",
+	"jsonl": "application/x-ndjson",
+	"cef":   "text/plain; charset=utf-8",
+}
+
+// Device fields of CEF records
+const (
+	cefVendor  = "go-web-api"
+	cefProduct = "users-management"
+	cefVersion = "1"
+)
+
+// exportParams are the list parameters besides the filters that select
+// what "audit export" exports
+var exportParams = []string{"created_after", "created_before", "q", "sort"}
+
+var auditCSVHeader = []string{
+	"id", "created_at", "user_id", "action", "resource_type", "resource_id",
+	"status", "ip_address", "user_agent", "details", "prev_hash", "hash",
+}
+
+// auditExporter writes audit log entries in one export format
+type auditExporter interface {
+	write(entry *AuditLog) error
+	// flush writes out anything buffered
+	flush() error
+}
+
+func newAuditExporter(format string, w io.Writer) (auditExporter, error) {
+	switch format {
+	case "csv":
+		e := &csvExporter{w: csv.NewWriter(w)}
+		return e, e.w.Write(auditCSVHeader)
+	case "jsonl":
+		return &jsonlExporter{enc: json.NewEncoder(w)}, nil
+	case "cef":
+		return &cefExporter{w: w}, nil
+	}
+	return nil, fmt.Errorf("format must be csv, jsonl or cef")
+}
+
+type csvExporter struct {
+	w *csv.Writer
+}
+
+func (e *csvExporter) write(l *AuditLog) error {
+	var details string
+	if len(l.Details) > 0 {
+		data, _ := json.Marshal(l.Details)
+		details = string(data)
+	}
+	record := []string{
+		l.ID, l.CreatedAt.UTC().Format(time.RFC3339Nano), l.UserID, l.Action, l.ResourceType, l.ResourceID,
+		l.Status, l.IPAddress, l.UserAgent, details, l.PrevHash, l.Hash,
+	}
+	for i, cell := range record {
+		record[i] = csvCell(cell)
+	}
+	return e.w.Write(record)
+}
+
+// csvCell quotes a value that a spreadsheet would otherwise evaluate as a
+// formula. Request fields such as the user agent are attacker controlled.
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+func (e *csvExporter) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type jsonlExporter struct {
+	enc *json.Encoder
+}
+
+func (e *jsonlExporter) write(l *AuditLog) error {
+	return e.enc.Encode(l)
+}
+
+func (e *jsonlExporter) flush() error {
+	return nil
+}
+
+// cefExporter writes ArcSight Common Event Format records, one per line
+type cefExporter struct {
+	w io.Writer
+}
+
+func (e *cefExporter) write(l *AuditLog) error {
+	severity := "3"
+	if l.Status == "failure" {
+		severity = "5"
+	}
+
+	var ext []string
+	add := func(key, value string) {
+		if value != "" {
+			ext = append(ext, key+"="+cefExtensionEscaper.Replace(value))
+		}
+	}
+	add("rt", strconv.FormatInt(l.CreatedAt.UnixMilli(), 10))
+	add("externalId", l.ID)
+	add("suid", l.UserID)
+	add("src", l.IPAddress)
+	add("requestClientApplication", l.UserAgent)
+	add("act", l.Action)
+	add("outcome", l.Status)
+	if l.ResourceType != "" {
+		add("cs1Label", "resourceType")
+		add("cs1", l.ResourceType)
+	}
+	if l.ResourceID != "" {
+		add("cs2Label", "resourceId")
+		add("cs2", l.ResourceID)
+	}
+	if len(l.Details) > 0 {
+		data, _ := json.Marshal(l.Details)
+		add("cs3Label", "details")
+		add("cs3", string(data))
+	}
+	if l.Hash != "" {
+		add("cs4Label", "hash")
+		add("cs4", l.Hash)
+	}
+
+	action := cefHeaderEscaper.Replace(l.Action)
+	_, err := fmt.Fprintf(e.w, "CEF:0|%s|%s|%s|%s|%s|%s|%s\n",
+		cefVendor, cefProduct, cefVersion, action, action, severity, strings.Join(ext, " "))
+	return err
+}
+
+func (e *cefExporter) flush() error {
+	return nil
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+// exportAuditLogs writes the audit log entries q selects to w in format,
+// ignoring q's limit; afterPage, if set, is called after every page
+func exportAuditLogs(logs AuditLogRepository, q listQuery, format string, w io.Writer, afterPage func()) error {
+	exporter, err := newAuditExporter(format, w)
+	if err != nil {
+		return err
+	}
+
+	q.limit = exportPageSize
+	for {
+		entries, next, err := logs.ListPage(q)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := exporter.write(entry); err != nil {
+				return err
+			}
+		}
+		if err := exporter.flush(); err != nil {
+			return err
+		}
+		if afterPage != nil {
+			afterPage()
+		}
+		if next == "" {
+			return nil
+		}
+		if q.cursor, err = decodeCursor(next); err != nil {
+			return err
+		}
+	}
+}
+
+// exportSignature is the detached signature of an export
+type exportSignature struct {
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"key_id"`
+	PublicKey string `json:"public_key"` // base64; check it against a trusted copy
+	SHA256    string `json:"sha256"`     // hex digest of the export
+	Signature string `json:"signature"`  // base64 signature of the SHA256 value
+}
+
+// signExport signs the SHA-256 digest of an export
+func (s *checkpointSigner) signExport(digest []byte) *exportSignature {
+	sum := hex.EncodeToString(digest)
+	return &exportSignature{
+		Algorithm: "ed25519",
+		KeyID:     s.keyID,
+		PublicKey: base64.StdEncoding.EncodeToString(s.key.Public().(ed25519.PublicKey)),
+		SHA256:    sum,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, []byte(sum))),
+	}
+}
+
+// exportAuditLogsHandler streams the audit log entries selected by the
+// audit log filters as ?format=csv, jsonl (the default) or cef. With
+// ?sign=true the export's digest and signature follow in the
+// X-Export-SHA256 and X-Export-Signature trailers; they are missing if the
+// export was cut short.
+func exportAuditLogsHandler(c *gin.Context) {
+	format := c.DefaultQuery("format", "jsonl")
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		respondError(c, badRequest("format must be csv, jsonl or cef"))
+		return
+	}
+	q, err := parseListQuery(c, auditLogListSpec)
+	if err != nil {
+		respondError(c, badRequest(err.Error()))
+		return
+	}
+	sign, err := strconv.ParseBool(c.DefaultQuery("sign", "false"))
+	if err != nil {
+		respondError(c, badRequest("sign must be true or false"))
+		return
+	}
+
+	if err := recordAudit(c, store, auditEntry(c, "audit_logs.exported", "audit_logs", "",
+		map[string]interface{}{"format": format, "query": c.Request.URL.RawQuery, "signed": sign})); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	header := c.Writer.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="audit-%s.%s"`,
+		time.Now().UTC().Format("20060102T150405Z"), format))
+	digest := sha256.New()
+	w := io.Writer(c.Writer)
+	if sign {
+		header.Set("X-Export-Key-ID", auditSigner.keyID)
+		header.Set("Trailer", "X-Export-SHA256, X-Export-Signature")
+		w = io.MultiWriter(c.Writer, digest)
+	}
+	c.Status(http.StatusOK)
+
+	if err := exportAuditLogs(store.AuditLogs(), q, format, w, c.Writer.Flush); err != nil {
+		// The response has started, so the export can only be cut short
+		log.Printf("request %s: audit export: %v", c.GetString(contextRequestIDKey), err)
+		return
+	}
+	if sign {
+		signature := auditSigner.signExport(digest.Sum(nil))
+		header.Set("X-Export-SHA256", signature.SHA256)
+		header.Set("X-Export-Signature", signature.Signature)
+	}
+}
+
+// runAuditExport implements "audit export", which writes the audit log
+// entries selected by filter=value arguments, such as action=user.* or
+// created_after=2024-01-01T00:00:00Z, to stdout or a file
+func runAuditExport(cfg Config, args []string) error {
+	flags := flag.NewFlagSet("audit export", flag.ContinueOnError)
+	format := flags.String("format", "jsonl", "export format: csv, jsonl or cef")
+	output := flags.String("o", "", "write the export to this file instead of stdout")
+	signatureFile := flags.String("signature", "", "write a detached signature of the export to this file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if _, ok := exportContentTypes[*format]; !ok {
+		return errors.New("format must be csv, jsonl or cef")
+	}
+
+	params := url.Values{}
+	for _, arg := range flags.Args() {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("filter %q must have the form name=value", arg)
+		}
+		if !slices.Contains(auditLogListSpec.filters, name) && !slices.Contains(exportParams, name) {
+			return fmt.Errorf("unknown filter %q", name)
+		}
+		params.Add(name, value)
+	}
+	q, err := parseListValues(params, auditLogListSpec)
+	if err != nil {
+		return err
+	}
+
+	var signer *checkpointSigner
+	if *signatureFile != "" {
+		if cfg.AuditSigningKey == "" {
+			return errors.New("signing an export needs AUDIT_SIGNING_KEY")
+		}
+		if signer, err = newCheckpointSigner(cfg.AuditSigningKey, cfg.AuditTrustedKeys); err != nil {
+			return err
+		}
+	}
+
+	s, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	digest := sha256.New()
+	if err := exportAuditLogs(s.AuditLogs(), q, *format, io.MultiWriter(out, digest), nil); err != nil {
+		if *output != "" {
+			os.Remove(*output)
+		}
+		return err
+	}
+	if *output != "" {
+		if err := out.Close(); err != nil {
+			return err
+		}
+	}
+
+	if signer == nil {
+		return nil
+	}
+	data, err := json.MarshalIndent(signer.signExport(digest.Sum(nil)), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(*signatureFile, append(data, '\n'), 0o644)
+}
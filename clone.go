@@ -0,0 +1,154 @@
+package main
+
+import "time"
+
+// The in-memory store never shares its records: writes store a copy of the
+// caller's value and reads return a fresh copy, so handlers and the JSON
+// encoder can use what they get without holding the store's lock. clone
+// copies everything reachable from a record, including nested maps and
+// slices.
+
+func (u *User) clone() *User {
+	c := *u
+	return &c
+}
+
+func (r *Role) clone() *Role {
+	c := *r
+	c.Permissions = cloneStrings(r.Permissions)
+	return &c
+}
+
+func (p *UserProfile) clone() *UserProfile {
+	c := *p
+	return &c
+}
+
+func (t *Team) clone() *Team {
+	c := *t
+	return &c
+}
+
+func (m *TeamMember) clone() *TeamMember {
+	c := *m
+	return &c
+}
+
+func (l *AuditLog) clone() *AuditLog {
+	c := *l
+	c.Details = cloneMap(l.Details)
+	return &c
+}
+
+func (cp *AuditCheckpoint) clone() *AuditCheckpoint {
+	c := *cp
+	return &c
+}
+
+func (r *PasswordReset) clone() *PasswordReset {
+	c := *r
+	return &c
+}
+
+func (s *Session) clone() *Session {
+	c := *s
+	c.RevokedAt = cloneTime(s.RevokedAt)
+	return &c
+}
+
+func (m *MFACredential) clone() *MFACredential {
+	c := *m
+	c.RecoveryCodes = cloneStrings(m.RecoveryCodes)
+	c.ConfirmedAt = cloneTime(m.ConfirmedAt)
+	return &c
+}
+
+func (p *UserPreferences) clone() *UserPreferences {
+	c := *p
+	if p.Notifications != nil {
+		c.Notifications = make(map[string]bool, len(p.Notifications))
+		for key, value := range p.Notifications {
+			c.Notifications[key] = value
+		}
+	}
+	c.Settings = cloneMap(p.Settings)
+	return &c
+}
+
+func (l *ActivityLog) clone() *ActivityLog {
+	c := *l
+	c.Metadata = cloneMap(l.Metadata)
+	return &c
+}
+
+func (i *Invitation) clone() *Invitation {
+	c := *i
+	c.AcceptedAt = cloneTime(i.AcceptedAt)
+	return &c
+}
+
+func (p *Permission) clone() *Permission {
+	c := *p
+	return &c
+}
+
+func (p *UserPermission) clone() *UserPermission {
+	c := *p
+	return &c
+}
+
+// cloneAll copies every record of a slice
+func cloneAll[T interface{ clone() T }](items []T) []T {
+	if items == nil {
+		return nil
+	}
+	copies := make([]T, len(items))
+	for i, item := range items {
+		copies[i] = item.clone()
+	}
+	return copies
+}
+
+func cloneStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string(nil), s...)
+}
+
+func cloneTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	return &c
+}
+
+// cloneMap deep-copies free-form JSON data such as AuditLog.Details
+func cloneMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]interface{}, len(m))
+	for key, value := range m {
+		c[key] = cloneValue(value)
+	}
+	return c
+}
+
+func cloneValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return cloneMap(v)
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, item := range v {
+			c[i] = cloneValue(item)
+		}
+		return c
+	case []string:
+		return cloneStrings(v)
+	default:
+		return v
+	}
+}
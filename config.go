@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds runtime settings read from the environment
+type Config struct {
+	Addr          string // listen address
+	StorageDriver string // memory, sqlite, postgres
+	StorageDSN    string // driver-specific connection string
+	AutoMigrate   bool   // apply pending migrations on startup
+
+	// Initial administrator created on startup if no user has this email
+	BootstrapAdminEmail    string
+	BootstrapAdminPassword string
+
+	// Access tokens are RS256 JWTs; refresh tokens are opaque and rotate
+	// on every use
+	TokenIssuer      string
+	AccessTokenTTL   time.Duration
+	RefreshTokenTTL  time.Duration
+	SigningKeyRotate time.Duration // how often a new signing key is generated
+
+	MFAIssuer string // shown in authenticator apps
+
+	// Apply Unicode NFKC normalization to emails and usernames in addition
+	// to trimming and lowercasing
+	NormalizeNFKC bool
+
+	// Reject updates and deletes of versioned resources that do not send
+	// If-Match with 428
+	RequireIfMatch bool
+
+	// Audit and activity logs are pruned every LogRetentionInterval (never
+	// if zero). Dropped entries are first archived as gzipped JSONL files in
+	// LogArchiveDir, unless it is empty. Without an archive the audit log is
+	// only pruned if AuditLogDiscard allows its entries to be lost.
+	AuditLogRetention    retentionPolicy
+	ActivityLogRetention retentionPolicy
+	LogArchiveDir        string
+	LogRetentionInterval time.Duration
+	AuditLogDiscard      bool
+
+	// Ed25519 seed, base64, that signs audit log checkpoints, and how often
+	// a checkpoint is written. Checkpoints signed by other keys only verify
+	// if their base64 public key is in AuditTrustedKeys, such as those of
+	// earlier signing keys.
+	AuditSigningKey         string
+	AuditCheckpointInterval time.Duration
+	AuditTrustedKeys        []string
+
+	// Development mode; password reset tokens are written to the log
+	DevMode bool
+}
+
+// appConfig is the configuration the server was started with
+var appConfig Config
+
+// loadConfig reads the configuration from environment variables
+func loadConfig() Config {
+	return Config{
+		Addr:          getEnv("ADDR", "localhost:8080"),
+		StorageDriver: getEnv("STORAGE_DRIVER", "memory"),
+		StorageDSN:    getEnv("STORAGE_DSN", ""),
+		AutoMigrate:   getEnvBool("STORAGE_AUTO_MIGRATE", true),
+
+		BootstrapAdminEmail:    getEnv("BOOTSTRAP_ADMIN_EMAIL", ""),
+		BootstrapAdminPassword: getEnv("BOOTSTRAP_ADMIN_PASSWORD", ""),
+
+		TokenIssuer:      getEnv("JWT_ISSUER", "users-api"),
+		AccessTokenTTL:   getEnvDuration("ACCESS_TOKEN_TTL", 15*time.Minute),
+		RefreshTokenTTL:  getEnvDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+		SigningKeyRotate: getEnvDuration("JWT_KEY_ROTATION", 24*time.Hour),
+
+		MFAIssuer: getEnv("MFA_ISSUER", "Users API"),
+
+		NormalizeNFKC:  getEnvBool("IDENTIFIER_NFKC", true),
+		RequireIfMatch: getEnvBool("REQUIRE_IF_MATCH", false),
+
+		AuditLogRetention: retentionPolicy{
+			MaxEntries: getEnvInt("AUDIT_LOG_MAX_ENTRIES", 100000),
+			MaxAge:     getEnvDuration("AUDIT_LOG_MAX_AGE", 365*24*time.Hour),
+		},
+		ActivityLogRetention: retentionPolicy{
+			MaxEntries: getEnvInt("ACTIVITY_LOG_MAX_ENTRIES", 100000),
+			MaxAge:     getEnvDuration("ACTIVITY_LOG_MAX_AGE", 90*24*time.Hour),
+		},
+		LogArchiveDir:        getEnv("LOG_ARCHIVE_DIR", ""),
+		LogRetentionInterval: getEnvDuration("LOG_RETENTION_INTERVAL", time.Minute),
+		AuditLogDiscard:      getEnvBool("AUDIT_LOG_DISCARD", false),
+
+		AuditSigningKey:         getEnv("AUDIT_SIGNING_KEY", ""),
+		AuditCheckpointInterval: getEnvDuration("AUDIT_CHECKPOINT_INTERVAL", time.Hour),
+		AuditTrustedKeys:        getEnvList("AUDIT_TRUSTED_KEYS"),
+
+		DevMode: getEnvBool("DEV_MODE", false),
+	}
+}
+
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getEnvList splits a comma-separated variable, dropping empty items
+func getEnvList(key string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	value, err := strconv.ParseBool(getEnv(key, strconv.FormatBool(fallback)))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func getEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(getEnv(key, strconv.Itoa(fallback)))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(getEnv(key, fallback.String()))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
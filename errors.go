@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Domain errors are returned by repositories and handlers and rendered as
+// problem+json responses by renderErrors. Any other error is reported as an
+// internal server error without its details.
+
+// NotFoundError reports that a resource does not exist
+type NotFoundError struct {
+	Resource string // e.g. "user", "team member"
+}
+
+func (e *NotFoundError) Error() string {
+	return e.Resource + " not found"
+}
+
+// ConflictError reports a write that clashes with the current state, such
+// as a duplicate value or a resource that is still in use
+type ConflictError struct {
+	Detail string
+	Field  string // the conflicting request field, if any
+}
+
+func (e *ConflictError) Error() string {
+	return e.Detail
+}
+
+// ValidationError reports request data that breaks the validation rules
+type ValidationError struct {
+	Detail string
+	Fields []fieldError
+}
+
+func (e *ValidationError) Error() string {
+	if e.Detail == "" {
+		return "validation failed"
+	}
+	return e.Detail
+}
+
+// ForbiddenError reports that the caller may not perform an action
+type ForbiddenError struct {
+	Detail string
+}
+
+func (e *ForbiddenError) Error() string {
+	return e.Detail
+}
+
+// VersionMismatchError reports a write based on a version of a resource
+// that is no longer current
+type VersionMismatchError struct {
+	Resource string
+}
+
+func (e *VersionMismatchError) Error() string {
+	return e.Resource + " was modified since the version the request is based on"
+}
+
+// statusError carries a transport-level failure, such as a malformed body
+// or missing credentials, with the status to answer
+type statusError struct {
+	Status int
+	Detail string
+}
+
+func (e *statusError) Error() string {
+	return e.Detail
+}
+
+func notFound(resource string) error {
+	return &NotFoundError{Resource: resource}
+}
+
+// alreadyTeamMember is the ConflictError of adding a user to a team twice
+func alreadyTeamMember() error {
+	return &ConflictError{Detail: "user is already a member of the team", Field: "user_id"}
+}
+
+// alreadyGranted is the ConflictError of granting a user a permission twice
+func alreadyGranted() error {
+	return &ConflictError{Detail: "user already holds the permission", Field: "permission_id"}
+}
+
+// invitationProcessed is the ConflictError of accepting, expiring or
+// revoking an invitation that is no longer pending
+func invitationProcessed() error {
+	return &ConflictError{Detail: "invitation already processed"}
+}
+
+// profileExists is the ConflictError of creating a second profile for a user
+func profileExists() error {
+	return &ConflictError{Detail: "user already has a profile", Field: "user_id"}
+}
+
+func badRequest(detail string) error {
+	return &statusError{Status: http.StatusBadRequest, Detail: detail}
+}
+
+func unauthorized(detail string) error {
+	return &statusError{Status: http.StatusUnauthorized, Detail: detail}
+}
+
+// problem is an RFC 7807 problem details object
+type problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+	Field     string       `json:"field,omitempty"`  // conflicts
+	Errors    []fieldError `json:"errors,omitempty"` // validation failures
+}
+
+// problemFor maps err to the problem reported to the client
+func problemFor(err error) problem {
+	var (
+		notFoundErr   *NotFoundError
+		conflictErr   *ConflictError
+		validationErr *ValidationError
+		forbiddenErr  *ForbiddenError
+		versionErr    *VersionMismatchError
+		statusErr     *statusError
+	)
+	switch {
+	case errors.As(err, &notFoundErr):
+		return problem{Type: "/problems/not-found", Title: "Resource not found",
+			Status: http.StatusNotFound, Detail: notFoundErr.Error()}
+	case errors.As(err, &conflictErr):
+		return problem{Type: "/problems/conflict", Title: "Conflict with current state",
+			Status: http.StatusConflict, Detail: conflictErr.Detail, Field: conflictErr.Field}
+	case errors.As(err, &validationErr):
+		return problem{Type: "/problems/validation", Title: "Validation failed",
+			Status: http.StatusUnprocessableEntity, Detail: validationErr.Detail, Errors: validationErr.Fields}
+	case errors.As(err, &forbiddenErr):
+		return problem{Type: "/problems/forbidden", Title: "Forbidden",
+			Status: http.StatusForbidden, Detail: forbiddenErr.Detail}
+	case errors.As(err, &versionErr):
+		return problem{Type: "/problems/version-mismatch", Title: "Precondition failed",
+			Status: http.StatusPreconditionFailed, Detail: versionErr.Error()}
+	case errors.As(err, &statusErr):
+		return problem{Type: "about:blank", Title: http.StatusText(statusErr.Status),
+			Status: statusErr.Status, Detail: statusErr.Detail}
+	default:
+		return problem{Type: "about:blank", Title: http.StatusText(http.StatusInternalServerError),
+			Status: http.StatusInternalServerError}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Versioned resources are served with their Version as a strong ETag.
+// Clients send it back in If-Match so that an update or delete applies only
+// to the version they read, and in If-None-Match to revalidate a cached
+// copy. The repositories re-check the version when they write, so a change
+// landing between the check and the write is still detected.
+
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+func setETag(c *gin.Context, version int64) {
+	c.Header("ETag", etag(version))
+}
+
+// notModified sets the resource's ETag and, if If-None-Match matches it,
+// answers 304. It reports whether the response was sent.
+func notModified(c *gin.Context, version int64) bool {
+	setETag(c, version)
+	if etagMatches(c.GetHeader("If-None-Match"), version, true) {
+		c.Status(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// checkIfMatch fails unless the request's If-Match header matches version.
+// Without the header the write goes ahead, unless REQUIRE_IF_MATCH is set.
+func checkIfMatch(c *gin.Context, resource string, version int64) error {
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		if appConfig.RequireIfMatch {
+			return &statusError{Status: http.StatusPreconditionRequired, Detail: "If-Match header required"}
+		}
+		return nil
+	}
+	if !etagMatches(header, version, false) {
+		return &VersionMismatchError{Resource: resource}
+	}
+	return nil
+}
+
+// etagMatches reports whether a list of entity tags, or "*", matches
+// version. Weak tags only match when weak comparison is allowed, as for
+// If-None-Match.
+func etagMatches(header string, version int64, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == "*" || tag == etag(version) {
+			return true
+		}
+	}
+	return false
+}
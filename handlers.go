@@ -3,8 +3,9 @@ package main
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"log"
 	"net/http"
-	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -17,41 +18,86 @@ func generateID(prefix string) string {
 	return prefix + "-" + hex.EncodeToString(bytes)
 }
 
+// auditEntry builds a successful audit log entry for an action the caller
+// performed on a resource
+func auditEntry(c *gin.Context, action, resourceType, resourceID string, details map[string]interface{}) *AuditLog {
+	entry := &AuditLog{
+		ID:           generateID("audit"),
+		Action:       action,
+		ResourceID:   resourceID,
+		ResourceType: resourceType,
+		Status:       "success",
+		IPAddress:    c.ClientIP(),
+		UserAgent:    c.Request.UserAgent(),
+		Details:      details,
+	}
+	if caller := currentUser(c); caller != nil {
+		entry.UserID = caller.ID
+	}
+	return entry
+}
+
 // User Handlers
 func createUserHandler(c *gin.Context) {
-	var user User
-	if err := c.BindJSON(&user); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+	// User.Password is never read from JSON, so accept it separately
+	var request struct {
+		User
+		Password string `json:"password"`
+	}
+	if !bindJSON(c, &request) {
 		return
 	}
 
-	user.ID = generateID("user")
-	user.IsActive = true
+	user := request.User
+	if request.Password != "" {
+		if err := validatePassword(request.Password); err != nil {
+			respondError(c, &ValidationError{Fields: []fieldError{{Field: "password", Rule: "password", Message: err.Error()}}})
+			return
+		}
+		hash, err := hashPassword(request.Password)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		user.Password = hash
+	}
 
-	if err := createUser(&user); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	// Assigning anything but the default role needs role management rights
+	if user.RoleID == "" {
+		user.RoleID = defaultRoleID
+	} else if user.RoleID != defaultRoleID && !callerCan(c, "roles", "manage") {
+		respondError(c, &ForbiddenError{Detail: "Missing permission roles.manage"})
 		return
 	}
 
-	// Create audit log
-	createAuditLog(&AuditLog{
-		ID:           generateID("audit"),
-		UserID:       user.ID,
-		Action:       "user.created",
-		ResourceID:   user.ID,
-		ResourceType: "user",
-		Status:       "success",
-		IPAddress:    c.ClientIP(),
+	user.ID = generateID("user")
+	user.IsActive = true
+
+	err := store.WithinTx(func(tx Store) error {
+		if err := tx.Users().Create(&user); err != nil {
+			return err
+		}
+		auditChange(c, nil, &user)
+
+		return recordAudit(c, tx, auditEntry(c, "user.created", "user", user.ID, nil))
 	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
 
+	setETag(c, user.Version)
 	c.JSON(http.StatusCreated, user)
 }
 
 func getUserHandler(c *gin.Context) {
 	id := c.Param("id")
-	user, err := getUser(id)
+	user, err := store.Users().Get(id)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		respondError(c, err)
+		return
+	}
+	if notModified(c, user.Version) {
 		return
 	}
 
@@ -59,64 +105,319 @@ func getUserHandler(c *gin.Context) {
 }
 
 func getAllUsersHandler(c *gin.Context) {
-	users := getAllUsers()
-	c.JSON(http.StatusOK, users)
+	q, err := parseListQuery(c, userListSpec)
+	if err != nil {
+		respondError(c, badRequest(err.Error()))
+		return
+	}
+
+	users, next, err := store.Users().ListPage(q)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, newPage(users, next))
 }
 
 func updateUserHandler(c *gin.Context) {
 	id := c.Param("id")
 	var user User
-	if err := c.BindJSON(&user); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+	if !bindJSON(c, &user) {
 		return
 	}
 
 	user.ID = id
-	if err := updateUser(id, &user); err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	err := store.WithinTx(func(tx Store) error {
+		// The password is changed through password reset, never here
+		existing, err := tx.Users().Get(id)
+		if err != nil {
+			return err
+		}
+		if err := checkIfMatch(c, "user", existing.Version); err != nil {
+			return err
+		}
+		user.Version = existing.Version
+		user.Password = existing.Password
+		user.CreatedAt = existing.CreatedAt
+
+		// Users editing their own account cannot change their access
+		if !callerCan(c, "users", "update") {
+			user.RoleID = existing.RoleID
+			user.TeamID = existing.TeamID
+			user.IsActive = existing.IsActive
+		}
+
+		if err := tx.Users().Update(id, &user); err != nil {
+			return err
+		}
+		auditChange(c, existing, &user)
+
+		return recordAudit(c, tx, auditEntry(c, "user.updated", "user", id, nil))
+	})
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 
-	createAuditLog(&AuditLog{
-		ID:           generateID("audit"),
-		UserID:       id,
-		Action:       "user.updated",
-		ResourceID:   id,
-		ResourceType: "user",
-		Status:       "success",
-		IPAddress:    c.ClientIP(),
+	setETag(c, user.Version)
+	c.JSON(http.StatusOK, user)
+}
+
+// patchUserHandler applies a merge patch or JSON patch to a user. Users
+// editing their own account cannot change their access.
+func patchUserHandler(c *gin.Context) {
+	id := c.Param("id")
+	existing, err := store.Users().Get(id)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := checkIfMatch(c, "user", existing.Version); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	readOnly := []string{"id", "version", "created_at", "updated_at"}
+	if !callerCan(c, "users", "update") {
+		readOnly = append(readOnly, "role_id", "team_id", "is_active")
+	}
+	var user User
+	if !applyPatch(c, existing, &user, readOnly...) {
+		return
+	}
+	user.Password = existing.Password
+
+	err = store.WithinTx(func(tx Store) error {
+		if err := tx.Users().Update(id, &user); err != nil {
+			return err
+		}
+		auditChange(c, existing, &user)
+		return recordAudit(c, tx, auditEntry(c, "user.updated", "user", id, nil))
 	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
 
+	setETag(c, user.Version)
 	c.JSON(http.StatusOK, user)
 }
 
+// deleteUserHandler deletes a user and the data belonging to them. Users
+// who own teams must hand them over or delete them first.
+func deleteUserHandler(c *gin.Context) {
+	id := c.Param("id")
+	user, err := store.Users().Get(id)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := checkIfMatch(c, "user", user.Version); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	teams, err := store.Teams().List()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	for _, team := range teams {
+		if team.OwnerID == id {
+			respondError(c, &ConflictError{Detail: "User owns team " + team.ID + "; transfer or delete it first"})
+			return
+		}
+	}
+
+	err = store.WithinTx(func(tx Store) error {
+		if err := tx.Users().Delete(id); err != nil {
+			return err
+		}
+		auditChange(c, user, nil)
+		return recordAudit(c, tx, auditEntry(c, "user.deleted", "user", id, nil))
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User deleted"})
+}
+
 // Role Handlers
 func createRoleHandler(c *gin.Context) {
 	var role Role
-	if err := c.BindJSON(&role); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+	if !bindJSON(c, &role) {
 		return
 	}
 
 	role.ID = generateID("role")
-	if err := createRole(&role); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	err := store.WithinTx(func(tx Store) error {
+		if err := tx.Roles().Create(&role); err != nil {
+			return err
+		}
+		auditChange(c, nil, &role)
+		return recordAudit(c, tx, auditEntry(c, "role.created", "role", role.ID, nil))
+	})
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 
+	setETag(c, role.Version)
 	c.JSON(http.StatusCreated, role)
 }
 
+func updateRoleHandler(c *gin.Context) {
+	id := c.Param("id")
+	var role Role
+	if !bindJSON(c, &role) {
+		return
+	}
+
+	existing, err := store.Roles().Get(id)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := checkIfMatch(c, "role", existing.Version); err != nil {
+		respondError(c, err)
+		return
+	}
+	role.ID = id
+	role.Version = existing.Version
+	role.CreatedAt = existing.CreatedAt
+
+	err = store.WithinTx(func(tx Store) error {
+		if err := tx.Roles().Update(id, &role); err != nil {
+			return err
+		}
+		auditChange(c, existing, &role)
+		return recordAudit(c, tx, auditEntry(c, "role.updated", "role", id, nil))
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	setETag(c, role.Version)
+	c.JSON(http.StatusOK, role)
+}
+
+// deleteRoleHandler deletes a role no user is assigned to. The seeded
+// roles cannot be deleted.
+func deleteRoleHandler(c *gin.Context) {
+	id := c.Param("id")
+	if id == adminRoleID || id == defaultRoleID {
+		respondError(c, &ConflictError{Detail: "Built-in roles cannot be deleted"})
+		return
+	}
+	role, err := store.Roles().Get(id)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := checkIfMatch(c, "role", role.Version); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	users, err := store.Users().List()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	for _, user := range users {
+		if user.RoleID == id {
+			respondError(c, &ConflictError{Detail: "Role is assigned to users; reassign them first"})
+			return
+		}
+	}
+
+	err = store.WithinTx(func(tx Store) error {
+		if err := tx.Roles().Delete(id); err != nil {
+			return err
+		}
+		auditChange(c, role, nil)
+		return recordAudit(c, tx, auditEntry(c, "role.deleted", "role", id, nil))
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Role deleted"})
+}
+
+// setRoleMFAHandler sets whether members of a role must use MFA
+func setRoleMFAHandler(c *gin.Context) {
+	var request struct {
+		RequireMFA *bool `json:"require_mfa" binding:"required"`
+	}
+
+	if !bindJSON(c, &request) {
+		return
+	}
+
+	roleID := c.Param("id")
+	err := store.WithinTx(func(tx Store) error {
+		role, err := tx.Roles().Get(roleID)
+		if err != nil {
+			return err
+		}
+		if err := checkIfMatch(c, "role", role.Version); err != nil {
+			return err
+		}
+		if err := tx.Roles().SetRequireMFA(roleID, *request.RequireMFA); err != nil {
+			return err
+		}
+		updated, err := tx.Roles().Get(roleID)
+		if err != nil {
+			return err
+		}
+		auditChange(c, role, updated)
+		return recordAudit(c, tx, auditEntry(c, "role.mfa_requirement_updated", "role", roleID,
+			map[string]interface{}{"require_mfa": *request.RequireMFA}))
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	role, err := store.Roles().Get(roleID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	setETag(c, role.Version)
+	c.JSON(http.StatusOK, role)
+}
+
 func getAllRolesHandler(c *gin.Context) {
-	roles := getAllRoles()
-	c.JSON(http.StatusOK, roles)
+	q, err := parseListQuery(c, roleListSpec)
+	if err != nil {
+		respondError(c, badRequest(err.Error()))
+		return
+	}
+
+	roles, next, err := store.Roles().ListPage(q)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, newPage(roles, next))
 }
 
 func getRoleHandler(c *gin.Context) {
 	id := c.Param("id")
-	role, err := getRole(id)
+	role, err := store.Roles().Get(id)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
+		respondError(c, err)
+		return
+	}
+	if notModified(c, role.Version) {
 		return
 	}
 
@@ -126,25 +427,35 @@ func getRoleHandler(c *gin.Context) {
 // Profile Handlers
 func createProfileHandler(c *gin.Context) {
 	var profile UserProfile
-	if err := c.BindJSON(&profile); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+	if !bindJSON(c, &profile) {
 		return
 	}
 
 	profile.ID = generateID("profile")
-	if err := createProfile(&profile); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	err := store.WithinTx(func(tx Store) error {
+		if err := tx.Profiles().Create(&profile); err != nil {
+			return err
+		}
+		auditChange(c, nil, &profile)
+		return recordAudit(c, tx, auditEntry(c, "profile.created", "profile", profile.UserID, nil))
+	})
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 
+	setETag(c, profile.Version)
 	c.JSON(http.StatusCreated, profile)
 }
 
 func getProfileHandler(c *gin.Context) {
 	userID := c.Param("userId")
-	profile, err := getProfileByUserID(userID)
+	profile, err := store.Profiles().GetByUserID(userID)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Profile not found"})
+		respondError(c, err)
+		return
+	}
+	if notModified(c, profile.Version) {
 		return
 	}
 
@@ -154,54 +465,133 @@ func getProfileHandler(c *gin.Context) {
 func updateProfileHandler(c *gin.Context) {
 	userID := c.Param("userId")
 	var profile UserProfile
-	if err := c.BindJSON(&profile); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+	if !bindJSON(c, &profile) {
 		return
 	}
 
+	existing, err := store.Profiles().GetByUserID(userID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := checkIfMatch(c, "profile", existing.Version); err != nil {
+		respondError(c, err)
+		return
+	}
+	profile.ID = existing.ID
 	profile.UserID = userID
-	if err := updateProfile(profile.ID, &profile); err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Profile not found"})
+	profile.Version = existing.Version
+	err = store.WithinTx(func(tx Store) error {
+		if err := tx.Profiles().Update(profile.ID, &profile); err != nil {
+			return err
+		}
+		auditChange(c, existing, &profile)
+		return recordAudit(c, tx, auditEntry(c, "profile.updated", "profile", userID, nil))
+	})
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 
+	setETag(c, profile.Version)
 	c.JSON(http.StatusOK, profile)
 }
 
+func patchProfileHandler(c *gin.Context) {
+	userID := c.Param("userId")
+	existing, err := store.Profiles().GetByUserID(userID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := checkIfMatch(c, "profile", existing.Version); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	var profile UserProfile
+	if !applyPatch(c, existing, &profile, "id", "user_id", "version", "updated_at") {
+		return
+	}
+	err = store.WithinTx(func(tx Store) error {
+		if err := tx.Profiles().Update(profile.ID, &profile); err != nil {
+			return err
+		}
+		auditChange(c, existing, &profile)
+		return recordAudit(c, tx, auditEntry(c, "profile.updated", "profile", userID, nil))
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	setETag(c, profile.Version)
+	c.JSON(http.StatusOK, profile)
+}
+
+func deleteProfileHandler(c *gin.Context) {
+	userID := c.Param("userId")
+	err := store.WithinTx(func(tx Store) error {
+		profile, err := tx.Profiles().GetByUserID(userID)
+		if err != nil {
+			return err
+		}
+		if err := checkIfMatch(c, "profile", profile.Version); err != nil {
+			return err
+		}
+		if err := tx.Profiles().DeleteByUserID(userID); err != nil {
+			return err
+		}
+		auditChange(c, profile, nil)
+		return recordAudit(c, tx, auditEntry(c, "profile.deleted", "profile", userID, nil))
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Profile deleted"})
+}
+
 // Team Handlers
 func createTeamHandler(c *gin.Context) {
 	var team Team
-	if err := c.BindJSON(&team); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+	if !bindJSON(c, &team) {
 		return
 	}
 
 	team.ID = generateID("team")
 	team.MemberCount = 0
-
-	if err := createTeam(&team); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	if team.OwnerID == "" {
+		team.OwnerID = currentUser(c).ID
 	}
 
-	createAuditLog(&AuditLog{
-		ID:           generateID("audit"),
-		UserID:       team.OwnerID,
-		Action:       "team.created",
-		ResourceID:   team.ID,
-		ResourceType: "team",
-		Status:       "success",
-		IPAddress:    c.ClientIP(),
+	err := store.WithinTx(func(tx Store) error {
+		if err := tx.Teams().Create(&team); err != nil {
+			return err
+		}
+		auditChange(c, nil, &team)
+
+		return recordAudit(c, tx, auditEntry(c, "team.created", "team", team.ID, nil))
 	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
 
+	setETag(c, team.Version)
 	c.JSON(http.StatusCreated, team)
 }
 
 func getTeamHandler(c *gin.Context) {
 	id := c.Param("id")
-	team, err := getTeam(id)
+	team, err := store.Teams().Get(id)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Team not found"})
+		respondError(c, err)
+		return
+	}
+	if notModified(c, team.Version) {
 		return
 	}
 
@@ -209,170 +599,969 @@ func getTeamHandler(c *gin.Context) {
 }
 
 func getAllTeamsHandler(c *gin.Context) {
-	teams := getAllTeams()
-	c.JSON(http.StatusOK, teams)
+	q, err := parseListQuery(c, teamListSpec)
+	if err != nil {
+		respondError(c, badRequest(err.Error()))
+		return
+	}
+
+	teams, next, err := store.Teams().ListPage(q)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, newPage(teams, next))
+}
+
+func updateTeamHandler(c *gin.Context) {
+	id := c.Param("id")
+	var team Team
+	if !bindJSON(c, &team) {
+		return
+	}
+
+	existing, err := store.Teams().Get(id)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := checkIfMatch(c, "team", existing.Version); err != nil {
+		respondError(c, err)
+		return
+	}
+	team.ID = id
+	team.Version = existing.Version
+	team.MemberCount = existing.MemberCount
+	team.CreatedAt = existing.CreatedAt
+	// Owners editing their own team cannot give it away
+	if team.OwnerID == "" || !callerCan(c, "teams", "update") {
+		team.OwnerID = existing.OwnerID
+	}
+
+	err = store.WithinTx(func(tx Store) error {
+		if err := tx.Teams().Update(id, &team); err != nil {
+			return err
+		}
+		auditChange(c, existing, &team)
+		return recordAudit(c, tx, auditEntry(c, "team.updated", "team", id, nil))
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	setETag(c, team.Version)
+	c.JSON(http.StatusOK, team)
+}
+
+// patchTeamHandler applies a merge patch or JSON patch to a team. Owners
+// editing their own team cannot give it away.
+func patchTeamHandler(c *gin.Context) {
+	id := c.Param("id")
+	existing, err := store.Teams().Get(id)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := checkIfMatch(c, "team", existing.Version); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	readOnly := []string{"id", "member_count", "version", "created_at", "updated_at"}
+	if !callerCan(c, "teams", "update") {
+		readOnly = append(readOnly, "owner_id")
+	}
+	var team Team
+	if !applyPatch(c, existing, &team, readOnly...) {
+		return
+	}
+
+	err = store.WithinTx(func(tx Store) error {
+		if err := tx.Teams().Update(id, &team); err != nil {
+			return err
+		}
+		auditChange(c, existing, &team)
+		return recordAudit(c, tx, auditEntry(c, "team.updated", "team", id, nil))
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	setETag(c, team.Version)
+	c.JSON(http.StatusOK, team)
+}
+
+// deleteTeamHandler deletes a team with its memberships; users assigned to
+// it are left without a team and its pending invitations are revoked
+func deleteTeamHandler(c *gin.Context) {
+	id := c.Param("id")
+	err := store.WithinTx(func(tx Store) error {
+		team, err := tx.Teams().Get(id)
+		if err != nil {
+			return err
+		}
+		if err := checkIfMatch(c, "team", team.Version); err != nil {
+			return err
+		}
+		if err := tx.Teams().Delete(id); err != nil {
+			return err
+		}
+		auditChange(c, team, nil)
+		return recordAudit(c, tx, auditEntry(c, "team.deleted", "team", id, nil))
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Team deleted"})
 }
 
 func addTeamMemberHandler(c *gin.Context) {
 	teamID := c.Param("id")
 	var member TeamMember
-	if err := c.BindJSON(&member); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+	if !bindJSON(c, &member) {
+		return
+	}
+
+	member.ID = generateID("member")
+	member.TeamID = teamID
+
+	err := store.WithinTx(func(tx Store) error {
+		if err := tx.Teams().AddMember(&member); err != nil {
+			return err
+		}
+		auditChange(c, nil, &member)
+		return recordAudit(c, tx, auditEntry(c, "team.member_added", "team", teamID,
+			map[string]interface{}{"member_id": member.UserID, "role": member.Role}))
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, member)
+}
+
+func removeTeamMemberHandler(c *gin.Context) {
+	teamID := c.Param("id")
+	userID := c.Param("userId")
+
+	err := store.WithinTx(func(tx Store) error {
+		if err := tx.Teams().RemoveMember(teamID, userID); err != nil {
+			return err
+		}
+		return recordAudit(c, tx, auditEntry(c, "team.member_removed", "team", teamID,
+			map[string]interface{}{"member_id": userID}))
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Team member removed"})
+}
+
+func getTeamMembersHandler(c *gin.Context) {
+	teamID := c.Param("id")
+	members, err := store.Teams().Members(teamID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, members)
+}
+
+// Audit Log Handlers
+// getAuditLogsHandler lists audit entries, filtered by actor (user_id),
+// action (exact or a prefix such as "permission.*"), resource, status, IP
+// address and time range, and searched with ?q= in their details
+func getAuditLogsHandler(c *gin.Context) {
+	q, err := parseListQuery(c, auditLogListSpec)
+	if err != nil {
+		respondError(c, badRequest(err.Error()))
+		return
+	}
+
+	logs, next, err := store.AuditLogs().ListPage(q)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, newPage(logs, next))
+}
+
+// Password Reset Handlers
+func requestPasswordResetHandler(c *gin.Context) {
+	var request struct {
+		Email string `json:"email"`
+	}
+
+	if !bindJSON(c, &request) {
+		return
+	}
+
+	// The token only ever leaves through the mailer, and the response is the
+	// same whatever happens, so that accounts cannot be enumerated
+	if err := sendPasswordReset(request.Email); err != nil {
+		log.Printf("request %s: password reset: %v", c.GetString(contextRequestIDKey), err)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "If the account exists, a password reset email has been sent"})
+}
+
+// sendPasswordReset creates a reset token for the user with email, if
+// there is one, and mails it to them
+func sendPasswordReset(email string) error {
+	user, err := store.Users().GetByEmail(email)
+	if err != nil {
+		var notFoundErr *NotFoundError
+		if errors.As(err, &notFoundErr) {
+			return nil
+		}
+		return err
+	}
+
+	reset := &PasswordReset{
+		ID:        generateID("pwreset"),
+		UserID:    user.ID,
+		Token:     generateID("reset"),
+		ExpiresAt: time.Now().Add(24 * time.Hour),
+		Used:      false,
+	}
+	if err := store.PasswordResets().Create(reset); err != nil {
+		return err
+	}
+	return resetMailer.SendPasswordReset(user.Email, reset.Token)
+}
+
+func resetPasswordHandler(c *gin.Context) {
+	var request struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"new_password"`
+	}
+
+	if !bindJSON(c, &request) {
+		return
+	}
+
+	if err := validatePassword(request.NewPassword); err != nil {
+		respondError(c, &ValidationError{Fields: []fieldError{{Field: "new_password", Rule: "password", Message: err.Error()}}})
+		return
+	}
+	hash, err := hashPassword(request.NewPassword)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	// The token is claimed in the same transaction as the password write, so
+	// that concurrent resets with one token cannot both succeed
+	err = store.WithinTx(func(tx Store) error {
+		reset, err := tx.PasswordResets().GetByToken(request.Token)
+		if err != nil {
+			return err
+		}
+		if time.Now().After(reset.ExpiresAt) {
+			return badRequest("Token expired")
+		}
+		if err := tx.PasswordResets().MarkUsed(request.Token); err != nil {
+			if errors.Is(err, errResetTokenUsed) {
+				return badRequest("Token already used")
+			}
+			return err
+		}
+
+		user, err := tx.Users().Get(reset.UserID)
+		if err != nil {
+			return err
+		}
+		user.Password = hash
+		if err := tx.Users().Update(user.ID, user); err != nil {
+			return err
+		}
+
+		// Whoever knew the old password is logged out everywhere
+		if err := tx.Sessions().RevokeUser(user.ID, time.Now()); err != nil {
+			return err
+		}
+
+		// Nobody is logged in; the holder of the token acts as its user
+		entry := auditEntry(c, "password.reset", "user", reset.UserID, nil)
+		entry.UserID = reset.UserID
+		return recordAudit(c, tx, entry)
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset successful"})
+}
+
+// Auth Handlers
+func loginHandler(c *gin.Context) {
+	var request struct {
+		Email    string `json:"email"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.Password == "" ||
+		(request.Email == "") == (request.Username == "") {
+		respondError(c, badRequest("Provide a password and exactly one of email or username"))
+		return
+	}
+
+	var user *User
+	var err error
+	login := request.Email
+	if request.Email != "" {
+		user, err = store.Users().GetByEmail(request.Email)
+	} else {
+		login = request.Username
+		user, err = store.Users().GetByUsername(request.Username)
+	}
+
+	reason := ""
+	switch {
+	case err != nil:
+		verifyPassword(request.Password, dummyPasswordHash)
+		reason = "unknown user"
+	case user.Password == "":
+		verifyPassword(request.Password, dummyPasswordHash)
+		reason = "no password set"
+	default:
+		if ok, _ := verifyPassword(request.Password, user.Password); !ok {
+			reason = "invalid password"
+		} else if !user.IsActive {
+			reason = "user inactive"
+		}
+	}
+
+	if reason != "" {
+		failure := auditEntry(c, "auth.login", "user", "", map[string]interface{}{
+			"login":  login,
+			"reason": reason,
+		})
+		failure.Status = "failure"
+		if user != nil {
+			failure.UserID = user.ID
+			failure.ResourceID = user.ID
+		}
+		recordAudit(c, store, failure)
+
+		respondError(c, unauthorized("Invalid credentials"))
+		return
+	}
+
+	if _, enrolled, required := mfaStatus(user); enrolled || required {
+		startMFAChallenge(c, user, enrolled)
+		return
+	}
+
+	tokens, err := completeLogin(c, user, nil)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, tokens)
+}
+
+// completeLogin issues a token pair in a new family for user and records
+// the login. If before is given it runs first, in the same transaction.
+func completeLogin(c *gin.Context, user *User, before func(tx Store) error) (*tokenPair, error) {
+	var tokens *tokenPair
+	err := store.WithinTx(func(tx Store) error {
+		if before != nil {
+			if err := before(tx); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		tokens, err = issueTokens(tx, user, generateID("family"), c.ClientIP(), c.Request.UserAgent())
+		if err != nil {
+			return err
+		}
+		return recordLogin(tx, c, user.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// refreshTokenHandler exchanges a refresh token for a new token pair. Each
+// refresh token is single-use: presenting one that was already rotated is
+// treated as theft and revokes every token of its family.
+func refreshTokenHandler(c *gin.Context) {
+	var request struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.RefreshToken == "" {
+		respondError(c, badRequest("Invalid request"))
+		return
+	}
+
+	session, err := store.Sessions().GetByToken(hashRefreshToken(request.RefreshToken))
+	if err != nil || session.Kind != "refresh" {
+		respondError(c, unauthorized("Invalid refresh token"))
+		return
+	}
+
+	now := time.Now()
+	if now.After(session.ExpiresAt) {
+		respondError(c, unauthorized("Refresh token expired"))
+		return
+	}
+
+	user, err := store.Users().Get(session.UserID)
+	if err != nil || !user.IsActive {
+		respondError(c, unauthorized("Invalid refresh token"))
+		return
+	}
+	if _, enrolled, required := mfaStatus(user); required && !enrolled {
+		respondError(c, unauthorized("MFA enrollment required; log in again"))
+		return
+	}
+
+	var tokens *tokenPair
+	err = store.WithinTx(func(tx Store) error {
+		if err := tx.Sessions().Revoke(session.Token, now); err != nil {
+			return err
+		}
+
+		var err error
+		tokens, err = issueTokens(tx, user, session.FamilyID, c.ClientIP(), c.Request.UserAgent())
+		return err
+	})
+	if errors.Is(err, errSessionRevoked) {
+		revokeReusedFamily(c, session)
+		respondError(c, unauthorized("Invalid refresh token"))
+		return
+	}
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// revokeReusedFamily handles a refresh token presented after it was
+// rotated: the whole family is revoked, logging out both the legitimate
+// client and whoever replayed the token
+func revokeReusedFamily(c *gin.Context, session *Session) {
+	store.Sessions().RevokeFamily(session.FamilyID, time.Now())
+
+	entry := auditEntry(c, "auth.refresh_token_reused", "session", session.FamilyID, map[string]interface{}{
+		"session_id": session.ID,
+	})
+	entry.UserID = session.UserID
+	entry.Status = "failure"
+	recordAudit(c, store, entry)
+}
+
+func jwksHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"keys": tokenKeys.JWKS()})
+}
+
+func rotateSigningKeyHandler(c *gin.Context) {
+	if err := tokenKeys.Rotate(); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	recordAudit(c, store, auditEntry(c, "auth.signing_key_rotated", "signing_key", "", nil))
+
+	c.JSON(http.StatusOK, gin.H{"keys": tokenKeys.JWKS()})
+}
+
+// MFA Handlers
+
+// mfaStatus reports whether user has confirmed a TOTP enrollment and
+// whether their role requires one
+func mfaStatus(user *User) (cred *MFACredential, enrolled, required bool) {
+	cred, err := store.MFA().Get(user.ID)
+	if err != nil {
+		cred = nil
+	}
+	if role, err := store.Roles().Get(user.RoleID); err == nil {
+		required = role.RequireMFA
+	}
+	return cred, cred != nil && cred.ConfirmedAt != nil, required
+}
+
+// startMFAChallenge answers a correct password from a user who needs a
+// second factor. Enrolled users redeem the returned token together with a
+// code at /auth/mfa/verify. Users whose role requires MFA but who have not
+// enrolled use it as a bearer token for /auth/mfa/enroll and
+// /auth/mfa/confirm, which then completes the login.
+func startMFAChallenge(c *gin.Context, user *User, enrolled bool) {
+	kind := "mfa_challenge"
+	if !enrolled {
+		kind = "mfa_enroll"
+	}
+
+	challenge := &Session{
+		ID:        generateID("sess"),
+		UserID:    user.ID,
+		Token:     generateID("mfa"),
+		Kind:      kind,
+		IPAddress: c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		ExpiresAt: time.Now().Add(mfaChallengeTTL),
+	}
+	if err := store.Sessions().Create(challenge); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"mfa_required":            enrolled,
+		"mfa_enrollment_required": !enrolled,
+		"mfa_token":               challenge.Token,
+		"expires_at":              challenge.ExpiresAt,
+	})
+}
+
+// mfaAuditLog builds an MFA audit entry for userID, who is not yet logged
+// in when completing a login
+func mfaAuditLog(c *gin.Context, userID, action, resourceID, status string, details map[string]interface{}) *AuditLog {
+	entry := auditEntry(c, action, "mfa", resourceID, details)
+	entry.UserID = userID
+	entry.Status = status
+	return entry
+}
+
+// verifyMFAHandler completes a login with a TOTP or recovery code
+func verifyMFAHandler(c *gin.Context) {
+	var request struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.MFAToken == "" ||
+		(request.Code == "") == (request.RecoveryCode == "") {
+		respondError(c, badRequest("Provide mfa_token and exactly one of code or recovery_code"))
+		return
+	}
+
+	challenge, err := store.Sessions().GetByToken(request.MFAToken)
+	if err != nil || challenge.Kind != "mfa_challenge" || challenge.RevokedAt != nil ||
+		time.Now().After(challenge.ExpiresAt) {
+		respondError(c, unauthorized("Invalid or expired MFA challenge"))
+		return
+	}
+
+	user, err := store.Users().Get(challenge.UserID)
+	if err != nil || !user.IsActive {
+		respondError(c, unauthorized("Invalid or expired MFA challenge"))
+		return
+	}
+	cred, enrolled, _ := mfaStatus(user)
+	if !enrolled {
+		respondError(c, unauthorized("Invalid or expired MFA challenge"))
+		return
+	}
+	read := cred.clone()
+
+	method := "totp"
+	// A wrong code uses up the challenge, so each guess costs a password
+	// check
+	reject := func() {
+		store.Sessions().Revoke(challenge.Token, time.Now())
+		recordAudit(c, store, mfaAuditLog(c, user.ID, "mfa.verified", user.ID, "failure",
+			map[string]interface{}{"method": method}))
+		respondError(c, unauthorized("Invalid MFA code"))
+	}
+	valid := false
+	if request.Code != "" {
+		var step int64
+		if step, valid = verifyTOTP(cred.Secret, request.Code, time.Now(), cred.LastUsedStep); valid {
+			cred.LastUsedStep = step
+		}
+	} else {
+		method = "recovery_code"
+		valid = consumeRecoveryCode(cred, request.RecoveryCode)
+	}
+
+	if !valid {
+		reject()
+		return
+	}
+
+	tokens, err := completeLogin(c, user, func(tx Store) error {
+		if err := tx.Sessions().Revoke(challenge.Token, time.Now()); err != nil {
+			return err
+		}
+		if err := tx.MFA().Use(cred, read); err != nil {
+			return err
+		}
+		return recordAudit(c, tx, mfaAuditLog(c, user.ID, "mfa.verified", user.ID, "success",
+			map[string]interface{}{"method": method, "recovery_codes_left": len(cred.RecoveryCodes)}))
+	})
+	if errors.Is(err, errSessionRevoked) {
+		respondError(c, unauthorized("Invalid or expired MFA challenge"))
+		return
+	}
+	// Another login accepted the same code first
+	if errors.Is(err, errMFACodeUsed) {
+		reject()
+		return
+	}
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, tokens)
+}
+
+// enrollMFAHandler starts TOTP enrollment, replacing any unconfirmed one
+func enrollMFAHandler(c *gin.Context) {
+	user := currentUser(c)
+	if _, enrolled, _ := mfaStatus(user); enrolled {
+		respondError(c, &ConflictError{Detail: "MFA is already enabled"})
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := store.MFA().Save(&MFACredential{UserID: user.ID, Secret: secret}); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"secret":           secret,
+		"provisioning_uri": totpProvisioningURI(appConfig.MFAIssuer, user.Email, secret),
+	})
+}
+
+// confirmMFAHandler enables MFA once the caller proves their authenticator
+// produces valid codes, and returns the recovery codes. If the caller is
+// enrolling during a login, the login is completed as well.
+func confirmMFAHandler(c *gin.Context) {
+	var request struct {
+		Code string `json:"code"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil || request.Code == "" {
+		respondError(c, badRequest("Invalid request"))
 		return
 	}
 
-	member.ID = generateID("member")
-	member.TeamID = teamID
-
-	if err := addTeamMember(&member); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	user := currentUser(c)
+	cred, enrolled, _ := mfaStatus(user)
+	if cred == nil {
+		respondError(c, notFound("MFA enrollment"))
+		return
+	}
+	if enrolled {
+		respondError(c, &ConflictError{Detail: "MFA is already enabled"})
 		return
 	}
 
-	c.JSON(http.StatusCreated, member)
-}
+	step, valid := verifyTOTP(cred.Secret, request.Code, time.Now(), cred.LastUsedStep)
+	if !valid {
+		respondError(c, badRequest("Invalid MFA code"))
+		return
+	}
 
-func getTeamMembersHandler(c *gin.Context) {
-	teamID := c.Param("id")
-	members := getTeamMembers(teamID)
-	c.JSON(http.StatusOK, members)
-}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	read := cred.clone()
+	now := time.Now()
+	cred.ConfirmedAt = &now
+	cred.LastUsedStep = step
+	cred.RecoveryCodes = hashes
+
+	enable := func(tx Store) error {
+		if err := tx.MFA().Use(cred, read); err != nil {
+			return err
+		}
+		return recordAudit(c, tx, mfaAuditLog(c, user.ID, "mfa.enrolled", user.ID, "success", nil))
+	}
 
-// Audit Log Handlers
-func getAuditLogsHandler(c *gin.Context) {
-	limitStr := c.DefaultQuery("limit", "50")
-	limit, err := strconv.Atoi(limitStr)
+	response := gin.H{"recovery_codes": codes}
+	if session := currentSession(c); session != nil && session.Kind == "mfa_enroll" {
+		var tokens *tokenPair
+		tokens, err = completeLogin(c, user, func(tx Store) error {
+			if err := tx.Sessions().Revoke(session.Token, now); err != nil {
+				return err
+			}
+			return enable(tx)
+		})
+		response["tokens"] = tokens
+	} else {
+		err = store.WithinTx(enable)
+	}
+	// Another request confirmed the enrollment with the same code first
+	if errors.Is(err, errMFACodeUsed) {
+		respondError(c, badRequest("Invalid MFA code"))
+		return
+	}
 	if err != nil {
-		limit = 50
+		respondError(c, err)
+		return
 	}
 
-	logs := getAuditLogs(limit)
-	c.JSON(http.StatusOK, logs)
+	c.JSON(http.StatusOK, response)
 }
 
-// Password Reset Handlers
-func requestPasswordResetHandler(c *gin.Context) {
-	var request struct {
-		Email string `json:"email"`
+// regenerateRecoveryCodesHandler replaces the caller's recovery codes
+func regenerateRecoveryCodesHandler(c *gin.Context) {
+	user, cred, ok := verifyCallerTOTP(c)
+	if !ok {
+		return
 	}
 
-	if err := c.BindJSON(&request); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		respondError(c, err)
 		return
 	}
+	cred.RecoveryCodes = hashes
 
-	// Generate reset token
-	token := generateID("reset")
-	reset := &PasswordReset{
-		ID:        generateID("pwreset"),
-		Token:     token,
-		ExpiresAt: time.Now().Add(24 * time.Hour),
-		Used:      false,
+	err = store.WithinTx(func(tx Store) error {
+		if err := tx.MFA().Save(cred); err != nil {
+			return err
+		}
+		return recordAudit(c, tx, mfaAuditLog(c, user.ID, "mfa.recovery_codes_regenerated", user.ID, "success", nil))
+	})
+	if err != nil {
+		respondError(c, err)
+		return
 	}
 
-	// In a real app, find user by email and set UserID
-	// For demo purposes, we'll accept any email
-	if err := createPasswordReset(reset); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// disableMFAHandler turns off MFA for the caller. If their role requires
+// MFA they will have to enroll again at their next login.
+func disableMFAHandler(c *gin.Context) {
+	user, _, ok := verifyCallerTOTP(c)
+	if !ok {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Password reset email sent",
-		"token":   token, // In production, this would be sent via email
+	err := store.WithinTx(func(tx Store) error {
+		if err := tx.MFA().Delete(user.ID); err != nil {
+			return err
+		}
+		return recordAudit(c, tx, mfaAuditLog(c, user.ID, "mfa.reset", user.ID, "success",
+			map[string]interface{}{"by": "self"}))
 	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "MFA disabled"})
 }
 
-func resetPasswordHandler(c *gin.Context) {
+// verifyCallerTOTP checks the TOTP code in the request body against the
+// caller's enrollment and records it as used, writing the error response
+// if it does not match
+func verifyCallerTOTP(c *gin.Context) (*User, *MFACredential, bool) {
 	var request struct {
-		Token       string `json:"token"`
-		NewPassword string `json:"new_password"`
+		Code string `json:"code"`
 	}
 
-	if err := c.BindJSON(&request); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
-		return
+	if err := c.ShouldBindJSON(&request); err != nil || request.Code == "" {
+		respondError(c, badRequest("Invalid request"))
+		return nil, nil, false
 	}
 
-	reset, err := getPasswordResetByToken(request.Token)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Invalid reset token"})
-		return
+	user := currentUser(c)
+	cred, enrolled, _ := mfaStatus(user)
+	if !enrolled {
+		respondError(c, notFound("MFA enrollment"))
+		return nil, nil, false
 	}
 
-	if reset.Used {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Token already used"})
-		return
+	step, valid := verifyTOTP(cred.Secret, request.Code, time.Now(), cred.LastUsedStep)
+	if !valid {
+		recordAudit(c, store, mfaAuditLog(c, user.ID, "mfa.verified", user.ID, "failure",
+			map[string]interface{}{"method": "totp"}))
+		respondError(c, badRequest("Invalid MFA code"))
+		return nil, nil, false
 	}
+	read := cred.clone()
+	cred.LastUsedStep = step
+	if err := store.MFA().Use(cred, read); err != nil {
+		if errors.Is(err, errMFACodeUsed) {
+			err = badRequest("Invalid MFA code")
+		}
+		respondError(c, err)
+		return nil, nil, false
+	}
+	return user, cred, true
+}
 
-	if time.Now().After(reset.ExpiresAt) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Token expired"})
+// resetUserMFAHandler lets an administrator remove a user's MFA, e.g. after
+// they lost their authenticator and recovery codes
+func resetUserMFAHandler(c *gin.Context) {
+	userID := c.Param("id")
+	caller := currentUser(c)
+
+	err := store.WithinTx(func(tx Store) error {
+		if err := tx.MFA().Delete(userID); err != nil {
+			return err
+		}
+		return recordAudit(c, tx, mfaAuditLog(c, caller.ID, "mfa.reset", userID, "success",
+			map[string]interface{}{"by": "admin"}))
+	})
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 
-	// In a real app, update user password here
-	markPasswordResetAsUsed(request.Token)
-
-	createAuditLog(&AuditLog{
-		ID:           generateID("audit"),
-		UserID:       reset.UserID,
-		Action:       "password.reset",
-		ResourceID:   reset.UserID,
-		ResourceType: "user",
-		Status:       "success",
-		IPAddress:    c.ClientIP(),
-	})
+	c.JSON(http.StatusOK, gin.H{"message": "MFA reset"})
+}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Password reset successful"})
+func meHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, currentUser(c))
 }
 
-// Session Handlers
-func createSessionHandler(c *gin.Context) {
-	var request struct {
-		UserID string `json:"user_id"`
+// logoutHandler ends the caller's session. Callers using an access token
+// have their refresh token family revoked; the access token itself stays
+// valid until it expires.
+func logoutHandler(c *gin.Context) {
+	var err error
+	if claims := currentClaims(c); claims != nil {
+		err = store.Sessions().RevokeFamily(claims.SessionID, time.Now())
+	} else {
+		err = store.Sessions().Delete(currentSession(c).Token)
 	}
-
-	if err := c.BindJSON(&request); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 
+	store.ActivityLogs().Create(&ActivityLog{
+		ID:           generateID("activity"),
+		UserID:       currentUser(c).ID,
+		ActivityType: "logout",
+		Description:  "User logged out",
+		IPAddress:    c.ClientIP(),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+// issueSession creates a session for user on behalf of the caller, an
+// administrator, and audits it with the caller as the actor
+func issueSession(c *gin.Context, user *User) (*Session, error) {
 	token := generateID("session")
 	session := &Session{
 		ID:        generateID("sess"),
-		UserID:    request.UserID,
+		UserID:    user.ID,
 		Token:     token,
+		Kind:      "session",
 		IPAddress: c.ClientIP(),
 		UserAgent: c.Request.UserAgent(),
 		ExpiresAt: time.Now().Add(7 * 24 * time.Hour),
 	}
 
-	if err := createSession(session); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	err := store.WithinTx(func(tx Store) error {
+		if err := tx.Sessions().Create(session); err != nil {
+			return err
+		}
+		return recordAudit(c, tx, auditEntry(c, "session.issued", "user", user.ID,
+			map[string]interface{}{"session_id": session.ID, "expires_at": session.ExpiresAt}))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// recordLogin writes the audit and activity entries for a successful login
+func recordLogin(tx Store, c *gin.Context, userID string) error {
+	// The user is not logged in until this commits
+	entry := auditEntry(c, "auth.login", "user", userID, nil)
+	entry.UserID = userID
+	if err := recordAudit(c, tx, entry); err != nil {
+		return err
 	}
 
-	createActivityLog(&ActivityLog{
+	return tx.ActivityLogs().Create(&ActivityLog{
 		ID:           generateID("activity"),
-		UserID:       request.UserID,
+		UserID:       userID,
 		ActivityType: "login",
 		Description:  "User logged in",
 		IPAddress:    c.ClientIP(),
 	})
+}
+
+// Session Handlers
+
+// createSessionHandler issues a session for a user without their
+// credentials. Users who have or need MFA only get sessions by logging in,
+// so that the second factor cannot be skipped this way.
+func createSessionHandler(c *gin.Context) {
+	var request struct {
+		UserID string `json:"user_id" binding:"required"`
+	}
+
+	if !bindJSON(c, &request) {
+		return
+	}
+
+	user, err := store.Users().Get(request.UserID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if !user.IsActive {
+		respondError(c, &ConflictError{Detail: "user is inactive", Field: "user_id"})
+		return
+	}
+	if _, enrolled, required := mfaStatus(user); enrolled || required {
+		respondError(c, &ConflictError{Detail: "user must log in with MFA", Field: "user_id"})
+		return
+	}
+
+	session, err := issueSession(c, user)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
 
 	c.JSON(http.StatusCreated, session)
 }
 
 func getUserSessionsHandler(c *gin.Context) {
 	userID := c.Param("userId")
-	sessions := getUserSessions(userID)
+	sessions, err := store.Sessions().ListByUser(userID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
 	c.JSON(http.StatusOK, sessions)
 }
 
 func deleteSessionHandler(c *gin.Context) {
 	token := c.Param("token")
-	if err := deleteSession(token); err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+	if err := store.Sessions().Delete(token); err != nil {
+		respondError(c, err)
 		return
 	}
 
@@ -382,25 +1571,35 @@ func deleteSessionHandler(c *gin.Context) {
 // Preferences Handlers
 func createPreferencesHandler(c *gin.Context) {
 	var prefs UserPreferences
-	if err := c.BindJSON(&prefs); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+	if !bindJSON(c, &prefs) {
 		return
 	}
 
 	prefs.ID = generateID("pref")
-	if err := createPreferences(&prefs); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	err := store.WithinTx(func(tx Store) error {
+		if err := tx.Preferences().Create(&prefs); err != nil {
+			return err
+		}
+		auditChange(c, nil, &prefs)
+		return recordAudit(c, tx, auditEntry(c, "preferences.created", "preferences", prefs.UserID, nil))
+	})
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 
+	setETag(c, prefs.Version)
 	c.JSON(http.StatusCreated, prefs)
 }
 
 func getPreferencesHandler(c *gin.Context) {
 	userID := c.Param("userId")
-	prefs, err := getPreferencesByUserID(userID)
+	prefs, err := store.Preferences().GetByUserID(userID)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Preferences not found"})
+		respondError(c, err)
+		return
+	}
+	if notModified(c, prefs.Version) {
 		return
 	}
 
@@ -410,33 +1609,107 @@ func getPreferencesHandler(c *gin.Context) {
 func updatePreferencesHandler(c *gin.Context) {
 	userID := c.Param("userId")
 	var prefs UserPreferences
-	if err := c.BindJSON(&prefs); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+	if !bindJSON(c, &prefs) {
+		return
+	}
+
+	existing, err := store.Preferences().GetByUserID(userID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := checkIfMatch(c, "preferences", existing.Version); err != nil {
+		respondError(c, err)
 		return
 	}
 
+	prefs.ID = existing.ID
 	prefs.UserID = userID
-	if err := updatePreferences(userID, &prefs); err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Preferences not found"})
+	prefs.Version = existing.Version
+	err = store.WithinTx(func(tx Store) error {
+		if err := tx.Preferences().Update(userID, &prefs); err != nil {
+			return err
+		}
+		auditChange(c, existing, &prefs)
+		return recordAudit(c, tx, auditEntry(c, "preferences.updated", "preferences", userID, nil))
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	setETag(c, prefs.Version)
+	c.JSON(http.StatusOK, prefs)
+}
+
+func patchPreferencesHandler(c *gin.Context) {
+	userID := c.Param("userId")
+	existing, err := store.Preferences().GetByUserID(userID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := checkIfMatch(c, "preferences", existing.Version); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	var prefs UserPreferences
+	if !applyPatch(c, existing, &prefs, "id", "user_id", "version", "updated_at") {
+		return
+	}
+	err = store.WithinTx(func(tx Store) error {
+		if err := tx.Preferences().Update(userID, &prefs); err != nil {
+			return err
+		}
+		auditChange(c, existing, &prefs)
+		return recordAudit(c, tx, auditEntry(c, "preferences.updated", "preferences", userID, nil))
+	})
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 
+	setETag(c, prefs.Version)
 	c.JSON(http.StatusOK, prefs)
 }
 
+func deletePreferencesHandler(c *gin.Context) {
+	userID := c.Param("userId")
+	err := store.WithinTx(func(tx Store) error {
+		prefs, err := tx.Preferences().GetByUserID(userID)
+		if err != nil {
+			return err
+		}
+		if err := checkIfMatch(c, "preferences", prefs.Version); err != nil {
+			return err
+		}
+		if err := tx.Preferences().Delete(userID); err != nil {
+			return err
+		}
+		auditChange(c, prefs, nil)
+		return recordAudit(c, tx, auditEntry(c, "preferences.deleted", "preferences", userID, nil))
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Preferences deleted"})
+}
+
 // Activity Log Handlers
 func createActivityLogHandler(c *gin.Context) {
 	var log ActivityLog
-	if err := c.BindJSON(&log); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+	if !bindJSON(c, &log) {
 		return
 	}
 
 	log.ID = generateID("activity")
 	log.IPAddress = c.ClientIP()
 
-	if err := createActivityLog(&log); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if err := store.ActivityLogs().Create(&log); err != nil {
+		respondError(c, err)
 		return
 	}
 
@@ -444,53 +1717,61 @@ func createActivityLogHandler(c *gin.Context) {
 }
 
 func getUserActivityLogsHandler(c *gin.Context) {
-	userID := c.Param("userId")
-	limitStr := c.DefaultQuery("limit", "50")
-	limit, err := strconv.Atoi(limitStr)
+	params := c.Request.URL.Query()
+	// Most recent first unless the caller picks an order
+	if !params.Has("sort") {
+		params.Set("sort", "-created_at")
+	}
+	params.Del("user_id")
+	q, err := parseListValues(params, activityLogListSpec)
+	if err != nil {
+		respondError(c, badRequest(err.Error()))
+		return
+	}
+	q.filters = append(q.filters, listFilter{field: "user_id", value: c.Param("userId")})
+
+	logs, next, err := store.ActivityLogs().ListPage(q)
 	if err != nil {
-		limit = 50
+		respondError(c, err)
+		return
 	}
 
-	logs := getUserActivityLogs(userID, limit)
-	c.JSON(http.StatusOK, logs)
+	c.JSON(http.StatusOK, newPage(logs, next))
 }
 
 // Invitation Handlers
 func createInvitationHandler(c *gin.Context) {
 	var invitation Invitation
-	if err := c.BindJSON(&invitation); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+	if !bindJSON(c, &invitation) {
 		return
 	}
 
 	invitation.ID = generateID("invitation")
+	invitation.InvitedBy = currentUser(c).ID
 	invitation.Token = generateID("invite")
 	invitation.Status = "pending"
 	invitation.ExpiresAt = time.Now().Add(7 * 24 * time.Hour)
 
-	if err := createInvitation(&invitation); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
+	err := store.WithinTx(func(tx Store) error {
+		if err := tx.Invitations().Create(&invitation); err != nil {
+			return err
+		}
 
-	createAuditLog(&AuditLog{
-		ID:           generateID("audit"),
-		UserID:       invitation.InvitedBy,
-		Action:       "invitation.created",
-		ResourceID:   invitation.ID,
-		ResourceType: "invitation",
-		Status:       "success",
-		IPAddress:    c.ClientIP(),
+		return recordAudit(c, tx, auditEntry(c, "invitation.created", "invitation", invitation.ID, nil))
 	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
 
 	c.JSON(http.StatusCreated, invitation)
 }
 
 func getInvitationHandler(c *gin.Context) {
 	token := c.Param("token")
-	invitation, err := getInvitationByToken(token)
+	invitation, err := store.Invitations().GetByToken(token)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+		respondError(c, err)
 		return
 	}
 
@@ -500,95 +1781,264 @@ func getInvitationHandler(c *gin.Context) {
 func acceptInvitationHandler(c *gin.Context) {
 	token := c.Param("token")
 
-	invitation, err := getInvitationByToken(token)
+	expired := false
+	err := store.WithinTx(func(tx Store) error {
+		invitation, err := tx.Invitations().GetByToken(token)
+		if err != nil {
+			return err
+		}
+		if time.Now().After(invitation.ExpiresAt) {
+			expired = true
+			return tx.Invitations().UpdateStatus(token, "expired")
+		}
+		if err := tx.Invitations().UpdateStatus(token, "accepted"); err != nil {
+			return err
+		}
+		return recordAudit(c, tx, auditEntry(c, "invitation.accepted", "invitation", invitation.ID, nil))
+	})
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+		respondError(c, err)
 		return
 	}
-
-	if invitation.Status != "pending" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invitation already processed"})
+	if expired {
+		respondError(c, badRequest("Invitation expired"))
 		return
 	}
 
-	if time.Now().After(invitation.ExpiresAt) {
-		updateInvitationStatus(token, "expired")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invitation expired"})
-		return
-	}
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation accepted"})
+}
 
-	if err := updateInvitationStatus(token, "accepted"); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+// revokeInvitationHandler withdraws a pending invitation; the record is
+// kept with status "revoked"
+func revokeInvitationHandler(c *gin.Context) {
+	token := c.Param("token")
+
+	err := store.WithinTx(func(tx Store) error {
+		invitation, err := tx.Invitations().GetByToken(token)
+		if err != nil {
+			return err
+		}
+		if err := tx.Invitations().UpdateStatus(token, "revoked"); err != nil {
+			return err
+		}
+		return recordAudit(c, tx, auditEntry(c, "invitation.revoked", "invitation", invitation.ID, nil))
+	})
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Invitation accepted"})
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation revoked"})
 }
 
 func getPendingInvitationsHandler(c *gin.Context) {
-	invitations := getPendingInvitations()
-	c.JSON(http.StatusOK, invitations)
+	q, err := parseListQuery(c, invitationListSpec)
+	if err != nil {
+		respondError(c, badRequest(err.Error()))
+		return
+	}
+	q.filters = append(q.filters, listFilter{field: "status", value: "pending"})
+
+	invitations, next, err := store.Invitations().ListPage(q)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, newPage(invitations, next))
 }
 
 // Permission Handlers
 func getAllPermissionsHandler(c *gin.Context) {
-	permissions := getAllPermissions()
+	permissions, err := store.Permissions().List()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
 	c.JSON(http.StatusOK, permissions)
 }
 
+func createPermissionHandler(c *gin.Context) {
+	var perm Permission
+	if !bindJSON(c, &perm) {
+		return
+	}
+
+	perm.ID = generateID("perm")
+	if perm.Name == "" {
+		perm.Name = perm.Resource + "." + perm.Action
+	}
+
+	err := store.WithinTx(func(tx Store) error {
+		if err := tx.Permissions().Create(&perm); err != nil {
+			return err
+		}
+		auditChange(c, nil, &perm)
+		return recordAudit(c, tx, auditEntry(c, "permission.created", "permission", perm.ID, nil))
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, perm)
+}
+
+func getPermissionHandler(c *gin.Context) {
+	id := c.Param("id")
+	perm, err := store.Permissions().Get(id)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, perm)
+}
+
+func updatePermissionHandler(c *gin.Context) {
+	id := c.Param("id")
+	var perm Permission
+	if !bindJSON(c, &perm) {
+		return
+	}
+
+	existing, err := store.Permissions().Get(id)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	perm.ID = id
+	perm.CreatedAt = existing.CreatedAt
+	if perm.Name == "" {
+		perm.Name = perm.Resource + "." + perm.Action
+	}
+
+	err = store.WithinTx(func(tx Store) error {
+		if err := tx.Permissions().Update(id, &perm); err != nil {
+			return err
+		}
+		auditChange(c, existing, &perm)
+		return recordAudit(c, tx, auditEntry(c, "permission.updated", "permission", id, nil))
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, perm)
+}
+
+// deletePermissionHandler removes a permission from the catalogue, revoking
+// it from every user it was granted to
+func deletePermissionHandler(c *gin.Context) {
+	id := c.Param("id")
+	err := store.WithinTx(func(tx Store) error {
+		perm, err := tx.Permissions().Get(id)
+		if err != nil {
+			return err
+		}
+		if err := tx.Permissions().Delete(id); err != nil {
+			return err
+		}
+		auditChange(c, perm, nil)
+		return recordAudit(c, tx, auditEntry(c, "permission.deleted", "permission", id, nil))
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Permission deleted"})
+}
+
 func grantUserPermissionHandler(c *gin.Context) {
-	userID := c.Param("userId")
+	userID := c.Param("id")
 	var request struct {
 		PermissionID string `json:"permission_id"`
-		GrantedBy    string `json:"granted_by"`
 	}
 
-	if err := c.BindJSON(&request); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+	if !bindJSON(c, &request) {
+		return
+	}
+
+	if _, err := store.Permissions().Get(request.PermissionID); err != nil {
+		respondError(c, err)
 		return
 	}
 
+	grantedBy := currentUser(c).ID
 	userPerm := &UserPermission{
 		ID:           generateID("userperm"),
 		UserID:       userID,
 		PermissionID: request.PermissionID,
-		GrantedBy:    request.GrantedBy,
+		GrantedBy:    grantedBy,
 	}
 
-	if err := grantUserPermission(userPerm); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
+	err := store.WithinTx(func(tx Store) error {
+		if err := tx.Permissions().Grant(userPerm); err != nil {
+			return err
+		}
+		auditChange(c, nil, userPerm)
 
-	createAuditLog(&AuditLog{
-		ID:           generateID("audit"),
-		UserID:       request.GrantedBy,
-		Action:       "permission.granted",
-		ResourceID:   userID,
-		ResourceType: "user",
-		Status:       "success",
-		IPAddress:    c.ClientIP(),
-		Details: map[string]interface{}{
+		return recordAudit(c, tx, auditEntry(c, "permission.granted", "user", userID, map[string]interface{}{
 			"permission_id": request.PermissionID,
 			"target_user":   userID,
-		},
+		}))
 	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
 
 	c.JSON(http.StatusCreated, userPerm)
 }
 
+func checkAccessHandler(c *gin.Context) {
+	var request struct {
+		UserID       string `json:"user_id" binding:"required"`
+		ResourceType string `json:"resource_type" binding:"required"`
+		ResourceID   string `json:"resource_id"`
+		Action       string `json:"action" binding:"required"`
+	}
+
+	if !bindJSON(c, &request) {
+		return
+	}
+
+	decision, err := checkAccess(request.UserID, request.ResourceType, request.ResourceID, request.Action)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, decision)
+}
+
 func getUserPermissionsHandler(c *gin.Context) {
-	userID := c.Param("userId")
-	permissions := getUserPermissions(userID)
+	userID := c.Param("id")
+	permissions, err := store.Permissions().UserGrants(userID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
 	c.JSON(http.StatusOK, permissions)
 }
 
 func revokeUserPermissionHandler(c *gin.Context) {
-	userID := c.Param("userId")
+	userID := c.Param("id")
 	permissionID := c.Param("permissionId")
 
-	if err := revokeUserPermission(userID, permissionID); err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	err := store.WithinTx(func(tx Store) error {
+		if err := tx.Permissions().Revoke(userID, permissionID); err != nil {
+			return err
+		}
+		return recordAudit(c, tx, auditEntry(c, "permission.revoked", "user", userID,
+			map[string]interface{}{"permission_id": permissionID, "target_user": userID}))
+	})
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 
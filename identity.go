@@ -0,0 +1,24 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// normalizeIdentifier is the canonical form emails and usernames are stored
+// and looked up in, so that they are unique regardless of case, surrounding
+// whitespace or, with NFKC enabled, equivalent Unicode spellings
+func normalizeIdentifier(value string) string {
+	value = strings.TrimSpace(value)
+	if appConfig.NormalizeNFKC {
+		value = norm.NFKC.String(value)
+	}
+	return strings.ToLower(value)
+}
+
+// normalizeUser puts the user's email and username in canonical form
+func normalizeUser(user *User) {
+	user.Email = normalizeIdentifier(user.Email)
+	user.Username = normalizeIdentifier(user.Username)
+}
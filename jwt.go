@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const signingKeyBits = 2048
+
+// accessClaims are carried by signed access tokens
+type accessClaims struct {
+	Role      string `json:"role,omitempty"`
+	TeamID    string `json:"team_id,omitempty"`
+	SessionID string `json:"sid"` // refresh token family the token was issued from
+	jwt.RegisteredClaims
+}
+
+// signingKey is one RSA key of the key ring
+type signingKey struct {
+	ID        string
+	Private   *rsa.PrivateKey
+	CreatedAt time.Time
+}
+
+// keyRing holds the RS256 keys used to sign access tokens. The newest key
+// signs; older keys are kept for verification until every token they
+// signed has expired.
+type keyRing struct {
+	keys        []*signingKey // oldest first
+	rotateEvery time.Duration
+	retain      time.Duration // how long a key verifies after it stops signing
+
+	mu sync.RWMutex
+}
+
+// tokenKeys signs and verifies access tokens; it is set up in main
+var tokenKeys *keyRing
+
+func newKeyRing(rotateEvery, retain time.Duration) (*keyRing, error) {
+	k := &keyRing{rotateEvery: rotateEvery, retain: retain}
+	if err := k.Rotate(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Rotate generates a new signing key and drops keys that can no longer
+// have valid tokens outstanding
+func (k *keyRing) Rotate() error {
+	private, err := rsa.GenerateKey(rand.Reader, signingKeyBits)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := time.Now()
+	kept := k.keys[:0]
+	for i, key := range k.keys {
+		// A key stops signing when its successor is created
+		retiredAt := now
+		if i+1 < len(k.keys) {
+			retiredAt = k.keys[i+1].CreatedAt
+		}
+		if now.Sub(retiredAt) < k.retain {
+			kept = append(kept, key)
+		}
+	}
+	k.keys = append(kept, &signingKey{ID: generateID("key"), Private: private, CreatedAt: now})
+	return nil
+}
+
+// current returns the signing key, rotating first if it is due
+func (k *keyRing) current() (*signingKey, error) {
+	k.mu.RLock()
+	key := k.keys[len(k.keys)-1]
+	k.mu.RUnlock()
+
+	if k.rotateEvery > 0 && time.Since(key.CreatedAt) >= k.rotateEvery {
+		if err := k.Rotate(); err != nil {
+			return nil, err
+		}
+		return k.current()
+	}
+	return key, nil
+}
+
+func (k *keyRing) publicKey(kid string) (*rsa.PublicKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, key := range k.keys {
+		if key.ID == kid {
+			return &key.Private.PublicKey, true
+		}
+	}
+	return nil, false
+}
+
+// jwk is the JSON Web Key representation of an RSA public key
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JWKS returns the public keys of the ring, newest first
+func (k *keyRing) JWKS() []jwk {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	keys := make([]jwk, 0, len(k.keys))
+	for i := len(k.keys) - 1; i >= 0; i-- {
+		pub := k.keys[i].Private.PublicKey
+		keys = append(keys, jwk{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: "RS256",
+			Kid: k.keys[i].ID,
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		})
+	}
+	return keys
+}
+
+// signAccessToken issues a short-lived access token for user
+func signAccessToken(user *User, familyID string) (string, time.Time, error) {
+	key, err := tokenKeys.current()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(appConfig.AccessTokenTTL)
+	claims := accessClaims{
+		Role:      user.RoleID,
+		TeamID:    user.TeamID,
+		SessionID: familyID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    appConfig.TokenIssuer,
+			Subject:   user.ID,
+			ID:        generateID("jti"),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = key.ID
+	signed, err := token.SignedString(key.Private)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, expiresAt, nil
+}
+
+// parseAccessToken verifies the signature and validity of an access token
+func parseAccessToken(tokenString string) (*accessClaims, error) {
+	claims := &accessClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := tokenKeys.publicKey(kid)
+		if !ok {
+			return nil, errors.New("unknown signing key")
+		}
+		return key, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
+		jwt.WithIssuer(appConfig.TokenIssuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// hashRefreshToken is how refresh tokens are stored in Session.Token, so a
+// leaked database does not yield usable tokens
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenPair is returned by login and refresh
+type tokenPair struct {
+	TokenType        string    `json:"token_type"`
+	AccessToken      string    `json:"access_token"`
+	ExpiresIn        int       `json:"expires_in"`
+	RefreshToken     string    `json:"refresh_token"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
+// issueTokens creates a refresh token in familyID, stored as a Session
+// through tx, and an access token bound to that family
+func issueTokens(tx Store, user *User, familyID, ipAddress, userAgent string) (*tokenPair, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	refreshToken := base64.RawURLEncoding.EncodeToString(random)
+
+	session := &Session{
+		ID:        generateID("sess"),
+		UserID:    user.ID,
+		Token:     hashRefreshToken(refreshToken),
+		Kind:      "refresh",
+		FamilyID:  familyID,
+		IPAddress: ipAddress,
+		UserAgent: userAgent,
+		ExpiresAt: time.Now().Add(appConfig.RefreshTokenTTL),
+	}
+	if err := tx.Sessions().Create(session); err != nil {
+		return nil, err
+	}
+
+	accessToken, expiresAt, err := signAccessToken(user, familyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokenPair{
+		TokenType:        "Bearer",
+		AccessToken:      accessToken,
+		ExpiresIn:        int(time.Until(expiresAt).Seconds()),
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: session.ExpiresAt,
+	}, nil
+}
@@ -1,70 +1,174 @@
 package main
 
 import (
+	"log"
+	"os"
+
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
+	cfg := loadConfig()
+	appConfig = cfg
+
+	// "migrate" runs schema migrations without starting the server
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(cfg, os.Args[2:]); err != nil {
+			log.Fatalf("migrate: %v", err)
+		}
+		return
+	}
+
+	// "audit verify" checks the audit log's hash chain and checkpoints;
+	// "audit export" exports the audit log
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		if err := runAuditCommand(cfg, os.Args[2:]); err != nil {
+			log.Fatalf("audit: %v", err)
+		}
+		return
+	}
+
+	s, err := openStore(cfg)
+	if err != nil {
+		log.Fatalf("failed to open %s store: %v", cfg.StorageDriver, err)
+	}
+	defer s.Close()
+	store = s
+
 	// Initialize default data
-	initializeData()
+	if err := seedDefaults(store, cfg); err != nil {
+		log.Fatalf("failed to seed default data: %v", err)
+	}
+
+	// Signing keys are kept in memory, so restarting the server invalidates
+	// outstanding access tokens; clients recover with their refresh token
+	tokenKeys, err = newKeyRing(cfg.SigningKeyRotate, cfg.AccessTokenTTL)
+	if err != nil {
+		log.Fatalf("failed to generate signing key: %v", err)
+	}
+
+	resetMailer = newMailer(cfg)
+
+	auditSigner, err = newCheckpointSigner(cfg.AuditSigningKey, cfg.AuditTrustedKeys)
+	if err != nil {
+		log.Fatalf("failed to set up audit checkpoints: %v", err)
+	}
+	startAuditCheckpoints(store, cfg.AuditCheckpointInterval)
+	startLogRetention(store, cfg, auditSigner)
+
+	if err := registerValidators(); err != nil {
+		log.Fatalf("failed to register validators: %v", err)
+	}
+
+	router := newRouter()
+	router.Run(cfg.Addr)
+}
 
+// newRouter registers the API's middleware and routes
+func newRouter() *gin.Engine {
 	router := gin.Default()
+	router.Use(requestID(), auditRequests(), renderErrors())
+
+	// Public routes
+	router.POST("/auth/login", loginHandler)
+	router.POST("/auth/refresh", refreshTokenHandler)
+	router.GET("/.well-known/jwks.json", jwksHandler)
+	router.POST("/auth/mfa/verify", verifyMFAHandler)
+	router.POST("/password-reset/request", requestPasswordResetHandler)
+	router.POST("/password-reset/reset", resetPasswordHandler)
+	router.GET("/invitations/:token", getInvitationHandler)
+
+	// MFA enrollment is also open to users who have passed the password
+	// check but must enroll before their login completes
+	enroll := router.Group("/auth/mfa", requireAuth("mfa_enroll"))
+	enroll.POST("/enroll", enrollMFAHandler)
+	enroll.POST("/confirm", confirmMFAHandler)
+
+	// All other routes require a valid session token, and each declares the
+	// permission it needs as "<resource>.<action>" (see rbac.go)
+	authed := router.Group("/", requireAuth())
+
+	// Auth routes
+	authed.GET("/auth/me", meHandler)
+	authed.POST("/auth/logout", logoutHandler)
+	authed.POST("/auth/keys/rotate", requirePermission("signing_keys.manage", nil), rotateSigningKeyHandler)
+	authed.POST("/auth/mfa/recovery-codes", regenerateRecoveryCodesHandler)
+	authed.POST("/auth/mfa/disable", disableMFAHandler)
+	authed.DELETE("/users/:id/mfa", requirePermission("mfa.delete", nil), resetUserMFAHandler)
 
 	// User routes
-	router.POST("/users", createUserHandler)
-	router.GET("/users", getAllUsersHandler)
-	router.GET("/users/:id", getUserHandler)
-	router.PUT("/users/:id", updateUserHandler)
+	authed.POST("/users", requirePermission("users.create", nil), createUserHandler)
+	authed.GET("/users", requirePermission("users.read", nil), getAllUsersHandler)
+	authed.GET("/users/:id", requirePermission("users.read", ownerParam("id")), getUserHandler)
+	authed.PUT("/users/:id", requirePermission("users.update", ownerParam("id")), updateUserHandler)
+	authed.PATCH("/users/:id", requirePermission("users.update", ownerParam("id")), patchUserHandler)
+	authed.DELETE("/users/:id", requirePermission("users.delete", ownerParam("id")), deleteUserHandler)
 
 	// Role routes (RBAC)
-	router.POST("/roles", createRoleHandler)
-	router.GET("/roles", getAllRolesHandler)
-	router.GET("/roles/:id", getRoleHandler)
+	authed.POST("/roles", requirePermission("roles.manage", nil), createRoleHandler)
+	authed.GET("/roles", requirePermission("roles.read", nil), getAllRolesHandler)
+	authed.GET("/roles/:id", requirePermission("roles.read", nil), getRoleHandler)
+	authed.PUT("/roles/:id", requirePermission("roles.manage", nil), updateRoleHandler)
+	authed.DELETE("/roles/:id", requirePermission("roles.manage", nil), deleteRoleHandler)
+	authed.PUT("/roles/:id/mfa", requirePermission("roles.manage", nil), setRoleMFAHandler)
 
 	// Profile routes
-	router.POST("/profiles", createProfileHandler)
-	router.GET("/profiles/user/:userId", getProfileHandler)
-	router.PUT("/profiles/user/:userId", updateProfileHandler)
+	authed.POST("/profiles", requirePermission("profiles.create", ownerBodyField("user_id")), createProfileHandler)
+	authed.GET("/profiles/user/:userId", requirePermission("profiles.read", ownerParam("userId")), getProfileHandler)
+	authed.PUT("/profiles/user/:userId", requirePermission("profiles.update", ownerParam("userId")), updateProfileHandler)
+	authed.PATCH("/profiles/user/:userId", requirePermission("profiles.update", ownerParam("userId")), patchProfileHandler)
+	authed.DELETE("/profiles/user/:userId", requirePermission("profiles.delete", ownerParam("userId")), deleteProfileHandler)
 
 	// Team routes
-	router.POST("/teams", createTeamHandler)
-	router.GET("/teams", getAllTeamsHandler)
-	router.GET("/teams/:id", getTeamHandler)
-	router.POST("/teams/:id/members", addTeamMemberHandler)
-	router.GET("/teams/:id/members", getTeamMembersHandler)
+	authed.POST("/teams", requirePermission("teams.create", ownerBodyField("owner_id")), createTeamHandler)
+	authed.GET("/teams", requirePermission("teams.read", nil), getAllTeamsHandler)
+	authed.GET("/teams/:id", requirePermission("teams.read", resourceParam("teams", "id")), getTeamHandler)
+	authed.PUT("/teams/:id", requirePermission("teams.update", resourceParam("teams", "id")), updateTeamHandler)
+	authed.PATCH("/teams/:id", requirePermission("teams.update", resourceParam("teams", "id")), patchTeamHandler)
+	authed.DELETE("/teams/:id", requirePermission("teams.delete", resourceParam("teams", "id")), deleteTeamHandler)
+	authed.POST("/teams/:id/members", requirePermission("teams.update", resourceParam("teams", "id")), addTeamMemberHandler)
+	authed.GET("/teams/:id/members", requirePermission("teams.read", resourceParam("teams", "id")), getTeamMembersHandler)
+	authed.DELETE("/teams/:id/members/:userId", requirePermission("teams.update", resourceParam("teams", "id")), removeTeamMemberHandler)
 
 	// Audit log routes
-	router.GET("/audit-logs", getAuditLogsHandler)
-
-	// Password reset routes
-	router.POST("/password-reset/request", requestPasswordResetHandler)
-	router.POST("/password-reset/reset", resetPasswordHandler)
+	authed.GET("/audit-logs", requirePermission("audit_logs.read", nil), getAuditLogsHandler)
+	authed.GET("/audit-logs/verify", requirePermission("audit_logs.read", nil), verifyAuditLogHandler)
+	authed.GET("/audit-logs/export", requirePermission("audit_logs.read", nil), exportAuditLogsHandler)
+	authed.GET("/audit-logs/stream", requirePermission("audit_logs.read", nil), streamAuditLogsHandler)
 
 	// Session routes
-	router.POST("/sessions", createSessionHandler)
-	router.GET("/sessions/user/:userId", getUserSessionsHandler)
-	router.DELETE("/sessions/:token", deleteSessionHandler)
+	authed.POST("/sessions", requirePermission("sessions.create", nil), createSessionHandler)
+	authed.GET("/sessions/user/:userId", requirePermission("sessions.read", ownerParam("userId")), getUserSessionsHandler)
+	authed.DELETE("/sessions/:token", requirePermission("sessions.delete", resourceParam("sessions", "token")), deleteSessionHandler)
 
 	// Preferences routes
-	router.POST("/preferences", createPreferencesHandler)
-	router.GET("/preferences/user/:userId", getPreferencesHandler)
-	router.PUT("/preferences/user/:userId", updatePreferencesHandler)
+	authed.POST("/preferences", requirePermission("preferences.create", ownerBodyField("user_id")), createPreferencesHandler)
+	authed.GET("/preferences/user/:userId", requirePermission("preferences.read", ownerParam("userId")), getPreferencesHandler)
+	authed.PUT("/preferences/user/:userId", requirePermission("preferences.update", ownerParam("userId")), updatePreferencesHandler)
+	authed.PATCH("/preferences/user/:userId", requirePermission("preferences.update", ownerParam("userId")), patchPreferencesHandler)
+	authed.DELETE("/preferences/user/:userId", requirePermission("preferences.delete", ownerParam("userId")), deletePreferencesHandler)
 
 	// Activity log routes
-	router.POST("/activity-logs", createActivityLogHandler)
-	router.GET("/activity-logs/user/:userId", getUserActivityLogsHandler)
+	authed.POST("/activity-logs", requirePermission("activity_logs.create", ownerBodyField("user_id")), createActivityLogHandler)
+	authed.GET("/activity-logs/user/:userId", requirePermission("activity_logs.read", ownerParam("userId")), getUserActivityLogsHandler)
+	authed.GET("/activity-logs/stream", requirePermission("activity_logs.read", ownerQuery("user_id")), streamActivityLogsHandler)
 
 	// Invitation routes
-	router.POST("/invitations", createInvitationHandler)
-	router.GET("/invitations/:token", getInvitationHandler)
-	router.POST("/invitations/:token/accept", acceptInvitationHandler)
-	router.GET("/invitations/pending", getPendingInvitationsHandler)
+	authed.POST("/invitations", requirePermission("invitations.create", nil), createInvitationHandler)
+	authed.POST("/invitations/:token/accept", requirePermission("invitations.update", resourceParam("invitations", "token")), acceptInvitationHandler)
+	authed.DELETE("/invitations/:token", requirePermission("invitations.delete", resourceParam("invitations", "token")), revokeInvitationHandler)
+	authed.GET("/invitations/pending", requirePermission("invitations.read", nil), getPendingInvitationsHandler)
 
 	// Permission routes
-	router.GET("/permissions", getAllPermissionsHandler)
-	router.POST("/users/:userId/permissions", grantUserPermissionHandler)
-	router.GET("/users/:userId/permissions", getUserPermissionsHandler)
-	router.DELETE("/users/:userId/permissions/:permissionId", revokeUserPermissionHandler)
+	authed.POST("/authz/check", requirePermission("permissions.read", nil), checkAccessHandler)
+	authed.POST("/permissions", requirePermission("permissions.manage", nil), createPermissionHandler)
+	authed.GET("/permissions", requirePermission("permissions.read", nil), getAllPermissionsHandler)
+	authed.GET("/permissions/:id", requirePermission("permissions.read", nil), getPermissionHandler)
+	authed.PUT("/permissions/:id", requirePermission("permissions.manage", nil), updatePermissionHandler)
+	authed.DELETE("/permissions/:id", requirePermission("permissions.manage", nil), deletePermissionHandler)
+	authed.POST("/users/:id/permissions", requirePermission("permissions.manage", nil), grantUserPermissionHandler)
+	authed.GET("/users/:id/permissions", requirePermission("permissions.read", ownerParam("id")), getUserPermissionsHandler)
+	authed.DELETE("/users/:id/permissions/:permissionId", requirePermission("permissions.manage", nil), revokeUserPermissionHandler)
 
-	router.Run("localhost:8080")
+	return router
 }
@@ -0,0 +1,1390 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps all data in process memory; it is lost on restart. It
+// is a view of the data: the store itself, or a transaction on it that
+// WithinTx passes to its fn.
+type memoryStore struct {
+	*memoryData
+	tx *memoryTx // nil outside WithinTx
+}
+
+// memoryData is the content of a memory store.
+//
+// Each kind of record has its own lock, so that traffic on unrelated data
+// is not serialized. The few writes that span kinds (deleting a user or a
+// team, removing a team member) take the locks they need in the order the
+// fields are declared below, which rules out deadlocks. The audit and
+// activity logs are append-only and readers take no lock at all; audit
+// appends are serialized by auditMu to keep the hash chain in order.
+type memoryData struct {
+	usersMu         sync.RWMutex
+	users           map[string]*User
+	usersByEmail    map[string]string // email → user ID
+	usersByUsername map[string]string // username → user ID
+
+	profilesMu     sync.RWMutex
+	profiles       map[string]*UserProfile
+	profilesByUser map[string]string // user ID → profile ID
+
+	preferencesMu sync.RWMutex
+	preferences   map[string]*UserPreferences
+
+	sessionsMu     sync.RWMutex
+	sessions       map[string]*Session
+	sessionsByUser map[string]keySet // user ID → session tokens
+
+	passwordResetsMu sync.RWMutex
+	passwordResets   map[string]*PasswordReset
+
+	permissionsMu   sync.RWMutex
+	permissions     map[string]*Permission
+	userPermissions map[string][]*UserPermission
+
+	mfaMu sync.RWMutex
+	mfa   map[string]*MFACredential
+
+	teamsMu     sync.RWMutex
+	teams       map[string]*Team
+	teamMembers map[string][]*TeamMember
+
+	invitationsMu       sync.RWMutex
+	invitations         map[string]*Invitation
+	invitationsByStatus map[string]keySet // status → invitation tokens
+
+	rolesMu sync.RWMutex
+	roles   map[string]*Role
+
+	auditMu          sync.Mutex // orders audit appends; guards auditCheckpoints
+	auditLogs        appendLog[AuditLog]
+	auditCheckpoints []*AuditCheckpoint
+
+	activityLogs   appendLog[ActivityLog]
+	activityByUser sync.Map   // user ID → *appendLog[ActivityLog]
+	pruneMu        sync.Mutex // serializes retention of the logs
+}
+
+// lockAll write-locks mutexes, given in the order of memoryStore's fields,
+// and returns a function that unlocks them
+func lockAll(mutexes ...*sync.RWMutex) (unlock func()) {
+	for _, mu := range mutexes {
+		mu.Lock()
+	}
+	return func() {
+		for i := len(mutexes) - 1; i >= 0; i-- {
+			mutexes[i].Unlock()
+		}
+	}
+}
+
+// keySet is a set of map keys, used by the secondary indexes
+type keySet map[string]struct{}
+
+func (k keySet) clone() keySet {
+	return maps.Clone(k)
+}
+
+func addToIndex(index map[string]keySet, key, value string) {
+	if index[key] == nil {
+		index[key] = keySet{}
+	}
+	index[key][value] = struct{}{}
+}
+
+func removeFromIndex(index map[string]keySet, key, value string) {
+	delete(index[key], value)
+	if len(index[key]) == 0 {
+		delete(index, key)
+	}
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{memoryData: &memoryData{
+		users:           make(map[string]*User),
+		usersByEmail:    make(map[string]string),
+		usersByUsername: make(map[string]string),
+
+		profiles:       make(map[string]*UserProfile),
+		profilesByUser: make(map[string]string),
+
+		preferences: make(map[string]*UserPreferences),
+
+		sessions:       make(map[string]*Session),
+		sessionsByUser: make(map[string]keySet),
+
+		passwordResets: make(map[string]*PasswordReset),
+
+		permissions:     make(map[string]*Permission),
+		userPermissions: make(map[string][]*UserPermission),
+
+		mfa: make(map[string]*MFACredential),
+
+		teams:       make(map[string]*Team),
+		teamMembers: make(map[string][]*TeamMember),
+
+		invitations:         make(map[string]*Invitation),
+		invitationsByStatus: make(map[string]keySet),
+
+		roles: make(map[string]*Role),
+	}}
+}
+
+// indexUser and unindexUser maintain the email and username indexes. The
+// caller must hold usersMu.
+func (s *memoryStore) indexUser(user *User) {
+	s.usersByEmail[user.Email] = user.ID
+	s.usersByUsername[user.Username] = user.ID
+}
+
+func (s *memoryStore) unindexUser(user *User) {
+	if s.usersByEmail[user.Email] == user.ID {
+		delete(s.usersByEmail, user.Email)
+	}
+	if s.usersByUsername[user.Username] == user.ID {
+		delete(s.usersByUsername, user.Username)
+	}
+}
+
+// checkUnique fails if another user has user's email or username. The
+// caller must hold usersMu.
+func (s *memoryStore) checkUnique(user *User) error {
+	if id, taken := s.usersByEmail[user.Email]; taken && id != user.ID {
+		return &ConflictError{Detail: "email already in use", Field: "email"}
+	}
+	if id, taken := s.usersByUsername[user.Username]; taken && id != user.ID {
+		return &ConflictError{Detail: "username already in use", Field: "username"}
+	}
+	return nil
+}
+
+// checkVersion fails unless expected is the stored version of a resource
+func checkVersion(resource string, stored, expected int64) error {
+	if stored != expected {
+		return &VersionMismatchError{Resource: resource}
+	}
+	return nil
+}
+
+// userByIndex resolves a user through one of the user indexes. The caller
+// must hold usersMu.
+func (s *memoryStore) userByIndex(index map[string]string, key string) (*User, error) {
+	if user, exists := s.users[index[key]]; exists {
+		return user.clone(), nil
+	}
+	return nil, notFound("user")
+}
+
+func (s *memoryStore) Users() UserRepository                   { return memoryUserRepo{s} }
+func (s *memoryStore) Roles() RoleRepository                   { return memoryRoleRepo{s} }
+func (s *memoryStore) Profiles() ProfileRepository             { return memoryProfileRepo{s} }
+func (s *memoryStore) Teams() TeamRepository                   { return memoryTeamRepo{s} }
+func (s *memoryStore) AuditLogs() AuditLogRepository           { return memoryAuditLogRepo{s} }
+func (s *memoryStore) PasswordResets() PasswordResetRepository { return memoryPasswordResetRepo{s} }
+func (s *memoryStore) Sessions() SessionRepository             { return memorySessionRepo{s} }
+func (s *memoryStore) Preferences() PreferencesRepository      { return memoryPreferencesRepo{s} }
+func (s *memoryStore) ActivityLogs() ActivityLogRepository     { return memoryActivityLogRepo{s} }
+func (s *memoryStore) Invitations() InvitationRepository       { return memoryInvitationRepo{s} }
+func (s *memoryStore) Permissions() PermissionRepository       { return memoryPermissionRepo{s} }
+func (s *memoryStore) MFA() MFARepository                      { return memoryMFARepo{s} }
+
+// memoryTx records what a transaction has to undo if it rolls back, and
+// what to do once it commits
+type memoryTx struct {
+	undo   []func() // oldest first
+	commit []func()
+}
+
+// WithinTx runs fn against a view of the store that records how to undo
+// each write, and undoes them if fn fails or panics. Log entries are only
+// appended once fn has succeeded. Unlike a database transaction, this does
+// not isolate the writes: other requests see them before fn returns, and
+// undoing a write restores the record even if another request has changed
+// it since.
+func (s *memoryStore) WithinTx(fn func(tx Store) error) error {
+	if s.tx != nil {
+		return fn(s)
+	}
+
+	tx := &memoryStore{memoryData: s.memoryData, tx: &memoryTx{}}
+	committed := false
+	defer func() {
+		if !committed {
+			tx.rollback()
+		}
+	}()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	committed = true
+	for _, f := range tx.tx.commit {
+		f()
+	}
+	return nil
+}
+
+// rollback undoes the writes of the store's transaction, newest first
+func (s *memoryStore) rollback() {
+	defer lockAll(&s.usersMu, &s.profilesMu, &s.preferencesMu, &s.sessionsMu, &s.passwordResetsMu,
+		&s.permissionsMu, &s.mfaMu, &s.teamsMu, &s.invitationsMu, &s.rolesMu)()
+	for i := len(s.tx.undo) - 1; i >= 0; i-- {
+		s.tx.undo[i]()
+	}
+}
+
+// saveForUndo records how to put key of m back as it is now, should the
+// store's transaction roll back; copy, unless nil, copies a value that may
+// be changed in place. Outside a transaction it does nothing. The caller
+// must hold the lock that guards m.
+func saveForUndo[V any](s *memoryStore, m map[string]V, key string, copy func(V) V) {
+	if s.tx == nil {
+		return
+	}
+	old, existed := m[key]
+	if existed && copy != nil {
+		old = copy(old)
+	}
+	s.tx.undo = append(s.tx.undo, func() {
+		if existed {
+			m[key] = old
+		} else {
+			delete(m, key)
+		}
+	})
+}
+
+// afterCommit runs f once the store's transaction has committed, or right
+// away outside a transaction
+func (s *memoryStore) afterCommit(f func()) {
+	if s.tx != nil {
+		s.tx.commit = append(s.tx.commit, f)
+		return
+	}
+	f()
+}
+
+// saveUserForUndo saves a user and its index entries. The caller must hold
+// usersMu.
+func (s *memoryStore) saveUserForUndo(user *User) {
+	saveForUndo(s, s.users, user.ID, (*User).clone)
+	saveForUndo(s, s.usersByEmail, user.Email, nil)
+	saveForUndo(s, s.usersByUsername, user.Username, nil)
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// UserRepository methods
+type memoryUserRepo struct{ *memoryStore }
+
+func (r memoryUserRepo) Create(user *User) error {
+	r.usersMu.Lock()
+	defer r.usersMu.Unlock()
+
+	if _, exists := r.users[user.ID]; exists {
+		return &ConflictError{Detail: "user already exists"}
+	}
+
+	normalizeUser(user)
+	if err := r.checkUnique(user); err != nil {
+		return err
+	}
+
+	r.saveUserForUndo(user)
+	user.Version = 1
+	user.CreatedAt = time.Now()
+	user.UpdatedAt = time.Now()
+	r.users[user.ID] = user.clone()
+	r.indexUser(user)
+	return nil
+}
+
+func (r memoryUserRepo) Get(id string) (*User, error) {
+	r.usersMu.RLock()
+	defer r.usersMu.RUnlock()
+
+	user, exists := r.users[id]
+	if !exists {
+		return nil, notFound("user")
+	}
+	return user.clone(), nil
+}
+
+func (r memoryUserRepo) GetByEmail(email string) (*User, error) {
+	r.usersMu.RLock()
+	defer r.usersMu.RUnlock()
+
+	return r.userByIndex(r.usersByEmail, normalizeIdentifier(email))
+}
+
+func (r memoryUserRepo) GetByUsername(username string) (*User, error) {
+	r.usersMu.RLock()
+	defer r.usersMu.RUnlock()
+
+	return r.userByIndex(r.usersByUsername, normalizeIdentifier(username))
+}
+
+func (r memoryUserRepo) List() ([]*User, error) {
+	r.usersMu.RLock()
+	defer r.usersMu.RUnlock()
+
+	userList := make([]*User, 0, len(r.users))
+	for _, user := range r.users {
+		userList = append(userList, user.clone())
+	}
+	return userList, nil
+}
+
+func (r memoryUserRepo) ListPage(q listQuery) ([]*User, string, error) {
+	users, _ := r.List()
+	items, next := paginate(users, userListSpec, q)
+	return items, next, nil
+}
+
+func (r memoryUserRepo) Update(id string, updatedUser *User) error {
+	r.usersMu.Lock()
+	defer r.usersMu.Unlock()
+
+	existing, exists := r.users[id]
+	if !exists {
+		return notFound("user")
+	}
+
+	if err := checkVersion("user", existing.Version, updatedUser.Version); err != nil {
+		return err
+	}
+	normalizeUser(updatedUser)
+	if err := r.checkUnique(updatedUser); err != nil {
+		return err
+	}
+
+	r.saveUserForUndo(existing)
+	r.saveUserForUndo(updatedUser)
+	updatedUser.Version++
+	updatedUser.UpdatedAt = time.Now()
+	r.unindexUser(existing)
+	r.users[id] = updatedUser.clone()
+	r.indexUser(updatedUser)
+	return nil
+}
+
+func (r memoryUserRepo) Delete(id string) error {
+	defer lockAll(&r.usersMu, &r.profilesMu, &r.preferencesMu, &r.sessionsMu,
+		&r.passwordResetsMu, &r.permissionsMu, &r.mfaMu, &r.teamsMu)()
+
+	user, exists := r.users[id]
+	if !exists {
+		return notFound("user")
+	}
+
+	saveForUndo(r.memoryStore, r.profiles, r.profilesByUser[id], (*UserProfile).clone)
+	saveForUndo(r.memoryStore, r.profilesByUser, id, nil)
+	delete(r.profiles, r.profilesByUser[id])
+	delete(r.profilesByUser, id)
+	saveForUndo(r.memoryStore, r.preferences, id, (*UserPreferences).clone)
+	delete(r.preferences, id)
+	for token := range r.sessionsByUser[id] {
+		saveForUndo(r.memoryStore, r.sessions, token, (*Session).clone)
+		delete(r.sessions, token)
+	}
+	saveForUndo(r.memoryStore, r.sessionsByUser, id, keySet.clone)
+	delete(r.sessionsByUser, id)
+	for token, reset := range r.passwordResets {
+		if reset.UserID == id {
+			saveForUndo(r.memoryStore, r.passwordResets, token, (*PasswordReset).clone)
+			delete(r.passwordResets, token)
+		}
+	}
+	saveForUndo(r.memoryStore, r.userPermissions, id, cloneAll[*UserPermission])
+	delete(r.userPermissions, id)
+	saveForUndo(r.memoryStore, r.mfa, id, (*MFACredential).clone)
+	delete(r.mfa, id)
+	for teamID := range r.teamMembers {
+		r.removeMember(teamID, id)
+	}
+
+	r.saveUserForUndo(user)
+	r.unindexUser(user)
+	delete(r.users, id)
+	return nil
+}
+
+// RoleRepository methods
+type memoryRoleRepo struct{ *memoryStore }
+
+func (r memoryRoleRepo) Get(id string) (*Role, error) {
+	r.rolesMu.RLock()
+	defer r.rolesMu.RUnlock()
+
+	role, exists := r.roles[id]
+	if !exists {
+		return nil, notFound("role")
+	}
+	return role.clone(), nil
+}
+
+func (r memoryRoleRepo) List() ([]*Role, error) {
+	r.rolesMu.RLock()
+	defer r.rolesMu.RUnlock()
+
+	roleList := make([]*Role, 0, len(r.roles))
+	for _, role := range r.roles {
+		roleList = append(roleList, role.clone())
+	}
+	return roleList, nil
+}
+
+func (r memoryRoleRepo) ListPage(q listQuery) ([]*Role, string, error) {
+	roles, _ := r.List()
+	items, next := paginate(roles, roleListSpec, q)
+	return items, next, nil
+}
+
+func (r memoryRoleRepo) Create(role *Role) error {
+	r.rolesMu.Lock()
+	defer r.rolesMu.Unlock()
+
+	saveForUndo(r.memoryStore, r.roles, role.ID, (*Role).clone)
+	role.Version = 1
+	role.CreatedAt = time.Now()
+	r.roles[role.ID] = role.clone()
+	return nil
+}
+
+func (r memoryRoleRepo) Update(id string, updatedRole *Role) error {
+	r.rolesMu.Lock()
+	defer r.rolesMu.Unlock()
+
+	existing, exists := r.roles[id]
+	if !exists {
+		return notFound("role")
+	}
+	if err := checkVersion("role", existing.Version, updatedRole.Version); err != nil {
+		return err
+	}
+	saveForUndo(r.memoryStore, r.roles, id, (*Role).clone)
+	updatedRole.Version++
+	r.roles[id] = updatedRole.clone()
+	return nil
+}
+
+func (r memoryRoleRepo) Delete(id string) error {
+	r.rolesMu.Lock()
+	defer r.rolesMu.Unlock()
+
+	if _, exists := r.roles[id]; !exists {
+		return notFound("role")
+	}
+	saveForUndo(r.memoryStore, r.roles, id, (*Role).clone)
+	delete(r.roles, id)
+	return nil
+}
+
+func (r memoryRoleRepo) SetRequireMFA(id string, required bool) error {
+	r.rolesMu.Lock()
+	defer r.rolesMu.Unlock()
+
+	role, exists := r.roles[id]
+	if !exists {
+		return notFound("role")
+	}
+	saveForUndo(r.memoryStore, r.roles, id, (*Role).clone)
+	role.RequireMFA = required
+	role.Version++
+	return nil
+}
+
+// ProfileRepository methods
+type memoryProfileRepo struct{ *memoryStore }
+
+func (r memoryProfileRepo) Create(profile *UserProfile) error {
+	r.profilesMu.Lock()
+	defer r.profilesMu.Unlock()
+
+	if _, exists := r.profilesByUser[profile.UserID]; exists {
+		return profileExists()
+	}
+
+	saveForUndo(r.memoryStore, r.profiles, profile.ID, (*UserProfile).clone)
+	saveForUndo(r.memoryStore, r.profilesByUser, profile.UserID, nil)
+	profile.Version = 1
+	profile.UpdatedAt = time.Now()
+	r.profiles[profile.ID] = profile.clone()
+	r.profilesByUser[profile.UserID] = profile.ID
+	return nil
+}
+
+func (r memoryProfileRepo) GetByUserID(userID string) (*UserProfile, error) {
+	r.profilesMu.RLock()
+	defer r.profilesMu.RUnlock()
+
+	profile, exists := r.profiles[r.profilesByUser[userID]]
+	if !exists {
+		return nil, notFound("profile")
+	}
+	return profile.clone(), nil
+}
+
+func (r memoryProfileRepo) Update(id string, updatedProfile *UserProfile) error {
+	r.profilesMu.Lock()
+	defer r.profilesMu.Unlock()
+
+	existing, exists := r.profiles[id]
+	if !exists {
+		return notFound("profile")
+	}
+	if err := checkVersion("profile", existing.Version, updatedProfile.Version); err != nil {
+		return err
+	}
+
+	saveForUndo(r.memoryStore, r.profiles, id, (*UserProfile).clone)
+	saveForUndo(r.memoryStore, r.profilesByUser, existing.UserID, nil)
+	saveForUndo(r.memoryStore, r.profilesByUser, updatedProfile.UserID, nil)
+	updatedProfile.Version++
+	updatedProfile.UpdatedAt = time.Now()
+	if r.profilesByUser[existing.UserID] == id {
+		delete(r.profilesByUser, existing.UserID)
+	}
+	r.profiles[id] = updatedProfile.clone()
+	r.profilesByUser[updatedProfile.UserID] = id
+	return nil
+}
+
+func (r memoryProfileRepo) DeleteByUserID(userID string) error {
+	r.profilesMu.Lock()
+	defer r.profilesMu.Unlock()
+
+	id, exists := r.profilesByUser[userID]
+	if !exists {
+		return notFound("profile")
+	}
+	saveForUndo(r.memoryStore, r.profiles, id, (*UserProfile).clone)
+	saveForUndo(r.memoryStore, r.profilesByUser, userID, nil)
+	delete(r.profiles, id)
+	delete(r.profilesByUser, userID)
+	return nil
+}
+
+// TeamRepository methods
+type memoryTeamRepo struct{ *memoryStore }
+
+func (r memoryTeamRepo) Create(team *Team) error {
+	r.teamsMu.Lock()
+	defer r.teamsMu.Unlock()
+
+	saveForUndo(r.memoryStore, r.teams, team.ID, (*Team).clone)
+	team.Version = 1
+	team.CreatedAt = time.Now()
+	team.UpdatedAt = time.Now()
+	r.teams[team.ID] = team.clone()
+	return nil
+}
+
+func (r memoryTeamRepo) Get(id string) (*Team, error) {
+	r.teamsMu.RLock()
+	defer r.teamsMu.RUnlock()
+
+	team, exists := r.teams[id]
+	if !exists {
+		return nil, notFound("team")
+	}
+	return team.clone(), nil
+}
+
+func (r memoryTeamRepo) List() ([]*Team, error) {
+	r.teamsMu.RLock()
+	defer r.teamsMu.RUnlock()
+
+	teamList := make([]*Team, 0, len(r.teams))
+	for _, team := range r.teams {
+		teamList = append(teamList, team.clone())
+	}
+	return teamList, nil
+}
+
+func (r memoryTeamRepo) ListPage(q listQuery) ([]*Team, string, error) {
+	teams, _ := r.List()
+	items, next := paginate(teams, teamListSpec, q)
+	return items, next, nil
+}
+
+func (r memoryTeamRepo) Update(id string, updatedTeam *Team) error {
+	r.teamsMu.Lock()
+	defer r.teamsMu.Unlock()
+
+	existing, exists := r.teams[id]
+	if !exists {
+		return notFound("team")
+	}
+	if err := checkVersion("team", existing.Version, updatedTeam.Version); err != nil {
+		return err
+	}
+
+	saveForUndo(r.memoryStore, r.teams, id, (*Team).clone)
+	updatedTeam.Version++
+	updatedTeam.UpdatedAt = time.Now()
+	r.teams[id] = updatedTeam.clone()
+	return nil
+}
+
+func (r memoryTeamRepo) Delete(id string) error {
+	defer lockAll(&r.usersMu, &r.teamsMu, &r.invitationsMu)()
+
+	if _, exists := r.teams[id]; !exists {
+		return notFound("team")
+	}
+
+	saveForUndo(r.memoryStore, r.teamMembers, id, cloneAll[*TeamMember])
+	delete(r.teamMembers, id)
+	for _, user := range r.users {
+		if user.TeamID == id {
+			saveForUndo(r.memoryStore, r.users, user.ID, (*User).clone)
+			user.TeamID = ""
+			user.Version++
+			user.UpdatedAt = time.Now()
+		}
+	}
+	for token := range r.invitationsByStatus["pending"] {
+		if invitation := r.invitations[token]; invitation.TeamID == id {
+			r.setInvitationStatus(invitation, "revoked")
+		}
+	}
+
+	saveForUndo(r.memoryStore, r.teams, id, (*Team).clone)
+	delete(r.teams, id)
+	return nil
+}
+
+func (r memoryTeamRepo) AddMember(member *TeamMember) error {
+	defer lockAll(&r.usersMu, &r.teamsMu)()
+
+	team, exists := r.teams[member.TeamID]
+	if !exists {
+		return notFound("team")
+	}
+	user, exists := r.users[member.UserID]
+	if !exists {
+		return notFound("user")
+	}
+	for _, existing := range r.teamMembers[member.TeamID] {
+		if existing.UserID == member.UserID {
+			return alreadyTeamMember()
+		}
+	}
+
+	saveForUndo(r.memoryStore, r.teamMembers, member.TeamID, cloneAll[*TeamMember])
+	saveForUndo(r.memoryStore, r.teams, member.TeamID, (*Team).clone)
+	saveForUndo(r.memoryStore, r.users, member.UserID, (*User).clone)
+	member.JoinedAt = time.Now()
+	r.teamMembers[member.TeamID] = append(r.teamMembers[member.TeamID], member.clone())
+
+	team.MemberCount++
+	team.Version++
+	team.UpdatedAt = time.Now()
+	user.TeamID = member.TeamID
+	user.Version++
+	user.UpdatedAt = time.Now()
+	return nil
+}
+
+func (r memoryTeamRepo) RemoveMember(teamID, userID string) error {
+	defer lockAll(&r.usersMu, &r.teamsMu)()
+
+	if !r.removeMember(teamID, userID) {
+		return notFound("team member")
+	}
+	return nil
+}
+
+// removeMember drops userID's memberships of teamID, keeping MemberCount
+// and User.TeamID consistent. The caller must hold usersMu and teamsMu.
+func (s *memoryStore) removeMember(teamID, userID string) bool {
+	members := s.teamMembers[teamID]
+	kept := members[:0:0]
+	for _, member := range members {
+		if member.UserID != userID {
+			kept = append(kept, member)
+		}
+	}
+	removed := len(members) - len(kept)
+	if removed == 0 {
+		return false
+	}
+	saveForUndo(s, s.teamMembers, teamID, cloneAll[*TeamMember])
+	saveForUndo(s, s.teams, teamID, (*Team).clone)
+	saveForUndo(s, s.users, userID, (*User).clone)
+	s.teamMembers[teamID] = kept
+
+	if team, exists := s.teams[teamID]; exists {
+		team.MemberCount -= removed
+		team.Version++
+		team.UpdatedAt = time.Now()
+	}
+	if user, exists := s.users[userID]; exists && user.TeamID == teamID {
+		user.TeamID = ""
+		user.Version++
+		user.UpdatedAt = time.Now()
+	}
+	return true
+}
+
+func (r memoryTeamRepo) Members(teamID string) ([]*TeamMember, error) {
+	r.teamsMu.RLock()
+	defer r.teamsMu.RUnlock()
+
+	return cloneAll(r.teamMembers[teamID]), nil
+}
+
+// logEntries returns the entries of a log that q is paginated over. A query
+// in seq order, as streams make, only sees entries up to the first one
+// still being appended: a stream's cursor would otherwise pass over it.
+func logEntries[T any](log *appendLog[T], q listQuery) []*T {
+	if q.sort == "seq" {
+		return log.published()
+	}
+	return log.all()
+}
+
+// AuditLogRepository methods
+type memoryAuditLogRepo struct{ *memoryStore }
+
+// Create appends the entry at once, or inside a transaction a copy of it
+// once the transaction commits
+func (r memoryAuditLogRepo) Create(log *AuditLog) error {
+	if r.tx != nil {
+		entry := log.clone()
+		r.afterCommit(func() { r.append(entry) })
+		return nil
+	}
+	r.append(log)
+	return nil
+}
+
+func (r memoryAuditLogRepo) append(log *AuditLog) {
+	r.auditMu.Lock()
+	defer r.auditMu.Unlock()
+
+	var prevHash string
+	if head := r.auditLogs.last(1); len(head) > 0 {
+		prevHash = head[0].Hash
+	}
+	log.link(prevHash)
+	slot := r.auditLogs.reserve()
+	log.Seq = slot + 1
+	r.auditLogs.publish(slot, log.clone())
+	auditLogSignal.notify()
+}
+
+func (r memoryAuditLogRepo) Walk(fn func(log *AuditLog) error) error {
+	for _, log := range r.auditLogs.all() {
+		if err := fn(log.clone()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r memoryAuditLogRepo) Head() (*AuditLog, error) {
+	if head := r.auditLogs.last(1); len(head) > 0 {
+		return head[0].clone(), nil
+	}
+	return nil, nil
+}
+
+func (r memoryAuditLogRepo) CreateCheckpoint(cp *AuditCheckpoint) error {
+	r.auditMu.Lock()
+	defer r.auditMu.Unlock()
+
+	r.auditCheckpoints = append(r.auditCheckpoints, cp.clone())
+	return nil
+}
+
+func (r memoryAuditLogRepo) Checkpoints() ([]*AuditCheckpoint, error) {
+	r.auditMu.Lock()
+	defer r.auditMu.Unlock()
+
+	return cloneAll(r.auditCheckpoints), nil
+}
+
+// ChainStart is 1: the memory store has chained every entry
+func (r memoryAuditLogRepo) ChainStart() (int64, error) {
+	return 1, nil
+}
+
+func (r memoryAuditLogRepo) ListPage(q listQuery) ([]*AuditLog, string, error) {
+	items, next := paginate(logEntries(&r.auditLogs, q), auditLogListSpec, q)
+	return cloneAll(items), next, nil
+}
+
+func (r memoryAuditLogRepo) Prune(policy retentionPolicy, archive func([]*AuditLog) error) (int, error) {
+	r.pruneMu.Lock()
+	defer r.pruneMu.Unlock()
+
+	cutoff := policy.cutoff(time.Now())
+	expired := r.auditLogs.expired(policy.MaxEntries, func(log *AuditLog) bool {
+		return log.CreatedAt.Before(cutoff)
+	})
+	return pruneBatches(expired, archive, r.auditLogs.drop)
+}
+
+// pruneBatches archives expired, the oldest entries of a log, in batches
+// and drops each batch once it is archived. It returns how many entries
+// were dropped.
+func pruneBatches[T any](expired []*T, archive func([]*T) error, drop func(n int)) (int, error) {
+	pruned := 0
+	for pruned < len(expired) {
+		batch := expired[pruned:min(pruned+retentionBatchSize, len(expired))]
+		if archive != nil {
+			if err := archive(batch); err != nil {
+				return pruned, err
+			}
+		}
+		drop(len(batch))
+		pruned += len(batch)
+	}
+	return pruned, nil
+}
+
+// PasswordResetRepository methods
+type memoryPasswordResetRepo struct{ *memoryStore }
+
+func (r memoryPasswordResetRepo) Create(reset *PasswordReset) error {
+	r.passwordResetsMu.Lock()
+	defer r.passwordResetsMu.Unlock()
+
+	saveForUndo(r.memoryStore, r.passwordResets, reset.Token, (*PasswordReset).clone)
+	reset.CreatedAt = time.Now()
+	r.passwordResets[reset.Token] = reset.clone()
+	return nil
+}
+
+func (r memoryPasswordResetRepo) GetByToken(token string) (*PasswordReset, error) {
+	r.passwordResetsMu.RLock()
+	defer r.passwordResetsMu.RUnlock()
+
+	reset, exists := r.passwordResets[token]
+	if !exists {
+		return nil, notFound("reset token")
+	}
+	return reset.clone(), nil
+}
+
+func (r memoryPasswordResetRepo) MarkUsed(token string) error {
+	r.passwordResetsMu.Lock()
+	defer r.passwordResetsMu.Unlock()
+
+	reset, exists := r.passwordResets[token]
+	if !exists {
+		return notFound("reset token")
+	}
+	if reset.Used {
+		return errResetTokenUsed
+	}
+	saveForUndo(r.memoryStore, r.passwordResets, token, (*PasswordReset).clone)
+	reset.Used = true
+	return nil
+}
+
+// SessionRepository methods
+type memorySessionRepo struct{ *memoryStore }
+
+func (r memorySessionRepo) Create(session *Session) error {
+	r.sessionsMu.Lock()
+	defer r.sessionsMu.Unlock()
+
+	saveForUndo(r.memoryStore, r.sessions, session.Token, (*Session).clone)
+	saveForUndo(r.memoryStore, r.sessionsByUser, session.UserID, keySet.clone)
+	session.CreatedAt = time.Now()
+	session.LastActivity = time.Now()
+	r.sessions[session.Token] = session.clone()
+	addToIndex(r.sessionsByUser, session.UserID, session.Token)
+	return nil
+}
+
+func (r memorySessionRepo) GetByToken(token string) (*Session, error) {
+	r.sessionsMu.RLock()
+	defer r.sessionsMu.RUnlock()
+
+	session, exists := r.sessions[token]
+	if !exists {
+		return nil, notFound("session")
+	}
+	return session.clone(), nil
+}
+
+func (r memorySessionRepo) ListByUser(userID string) ([]*Session, error) {
+	r.sessionsMu.RLock()
+	defer r.sessionsMu.RUnlock()
+
+	var userSessions []*Session
+	for token := range r.sessionsByUser[userID] {
+		userSessions = append(userSessions, r.sessions[token].clone())
+	}
+	return userSessions, nil
+}
+
+func (r memorySessionRepo) Touch(token string, at time.Time) error {
+	r.sessionsMu.Lock()
+	defer r.sessionsMu.Unlock()
+
+	session, exists := r.sessions[token]
+	if !exists {
+		return notFound("session")
+	}
+	saveForUndo(r.memoryStore, r.sessions, token, (*Session).clone)
+	session.LastActivity = at
+	return nil
+}
+
+func (r memorySessionRepo) Revoke(token string, at time.Time) error {
+	r.sessionsMu.Lock()
+	defer r.sessionsMu.Unlock()
+
+	session, exists := r.sessions[token]
+	if !exists {
+		return notFound("session")
+	}
+	if session.RevokedAt != nil {
+		return errSessionRevoked
+	}
+	saveForUndo(r.memoryStore, r.sessions, token, (*Session).clone)
+	session.RevokedAt = &at
+	return nil
+}
+
+func (r memorySessionRepo) RevokeFamily(familyID string, at time.Time) error {
+	r.sessionsMu.Lock()
+	defer r.sessionsMu.Unlock()
+
+	for token, session := range r.sessions {
+		if session.FamilyID == familyID && session.RevokedAt == nil {
+			saveForUndo(r.memoryStore, r.sessions, token, (*Session).clone)
+			revokedAt := at
+			session.RevokedAt = &revokedAt
+		}
+	}
+	return nil
+}
+
+func (r memorySessionRepo) RevokeUser(userID string, at time.Time) error {
+	r.sessionsMu.Lock()
+	defer r.sessionsMu.Unlock()
+
+	for token := range r.sessionsByUser[userID] {
+		if session := r.sessions[token]; session.RevokedAt == nil {
+			saveForUndo(r.memoryStore, r.sessions, token, (*Session).clone)
+			revokedAt := at
+			session.RevokedAt = &revokedAt
+		}
+	}
+	return nil
+}
+
+func (r memorySessionRepo) Delete(token string) error {
+	r.sessionsMu.Lock()
+	defer r.sessionsMu.Unlock()
+
+	session, exists := r.sessions[token]
+	if !exists {
+		return notFound("session")
+	}
+	saveForUndo(r.memoryStore, r.sessions, token, (*Session).clone)
+	saveForUndo(r.memoryStore, r.sessionsByUser, session.UserID, keySet.clone)
+	removeFromIndex(r.sessionsByUser, session.UserID, token)
+	delete(r.sessions, token)
+	return nil
+}
+
+// PreferencesRepository methods
+type memoryPreferencesRepo struct{ *memoryStore }
+
+func (r memoryPreferencesRepo) Create(prefs *UserPreferences) error {
+	r.preferencesMu.Lock()
+	defer r.preferencesMu.Unlock()
+
+	// Creating preferences for a user who has them replaces them
+	saveForUndo(r.memoryStore, r.preferences, prefs.UserID, (*UserPreferences).clone)
+	prefs.Version = 1
+	if existing, exists := r.preferences[prefs.UserID]; exists {
+		prefs.Version = existing.Version + 1
+	}
+	prefs.UpdatedAt = time.Now()
+	r.preferences[prefs.UserID] = prefs.clone()
+	return nil
+}
+
+func (r memoryPreferencesRepo) GetByUserID(userID string) (*UserPreferences, error) {
+	r.preferencesMu.RLock()
+	defer r.preferencesMu.RUnlock()
+
+	prefs, exists := r.preferences[userID]
+	if !exists {
+		return nil, notFound("preferences")
+	}
+	return prefs.clone(), nil
+}
+
+func (r memoryPreferencesRepo) Update(userID string, updatedPrefs *UserPreferences) error {
+	r.preferencesMu.Lock()
+	defer r.preferencesMu.Unlock()
+
+	existing, exists := r.preferences[userID]
+	if !exists {
+		return notFound("preferences")
+	}
+	if err := checkVersion("preferences", existing.Version, updatedPrefs.Version); err != nil {
+		return err
+	}
+
+	saveForUndo(r.memoryStore, r.preferences, userID, (*UserPreferences).clone)
+	updatedPrefs.Version++
+	updatedPrefs.UpdatedAt = time.Now()
+	r.preferences[userID] = updatedPrefs.clone()
+	return nil
+}
+
+func (r memoryPreferencesRepo) Delete(userID string) error {
+	r.preferencesMu.Lock()
+	defer r.preferencesMu.Unlock()
+
+	if _, exists := r.preferences[userID]; !exists {
+		return notFound("preferences")
+	}
+	saveForUndo(r.memoryStore, r.preferences, userID, (*UserPreferences).clone)
+	delete(r.preferences, userID)
+	return nil
+}
+
+// ActivityLogRepository methods
+type memoryActivityLogRepo struct{ *memoryStore }
+
+// Create appends the entry at once, or inside a transaction a copy of it
+// once the transaction commits
+func (r memoryActivityLogRepo) Create(log *ActivityLog) error {
+	if r.tx != nil {
+		entry := log.clone()
+		r.afterCommit(func() { r.append(entry) })
+		return nil
+	}
+	r.append(log)
+	return nil
+}
+
+func (r memoryActivityLogRepo) append(log *ActivityLog) {
+	log.CreatedAt = time.Now()
+	slot := r.activityLogs.reserve()
+	log.Seq = slot + 1
+	stored := log.clone()
+	r.activityLogs.publish(slot, stored)
+	r.userActivity(log.UserID, true).append(stored)
+	activityLogSignal.notify()
+}
+
+func (r memoryActivityLogRepo) ListPage(q listQuery) ([]*ActivityLog, string, error) {
+	items, next := paginate(logEntries(&r.activityLogs, q), activityLogListSpec, q)
+	return cloneAll(items), next, nil
+}
+
+func (r memoryActivityLogRepo) ListByUser(userID string, limit int) ([]*ActivityLog, error) {
+	logs := r.userActivity(userID, false)
+	if logs == nil {
+		return nil, nil
+	}
+
+	// Most recent first
+	recent := logs.last(limit)
+	userLogs := make([]*ActivityLog, len(recent))
+	for i, log := range recent {
+		userLogs[len(recent)-1-i] = log.clone()
+	}
+	return userLogs, nil
+}
+
+func (r memoryActivityLogRepo) Prune(policy retentionPolicy, archive func([]*ActivityLog) error) (int, error) {
+	r.pruneMu.Lock()
+	defer r.pruneMu.Unlock()
+
+	cutoff := policy.cutoff(time.Now())
+	expired := r.activityLogs.expired(policy.MaxEntries, func(log *ActivityLog) bool {
+		return log.CreatedAt.Before(cutoff)
+	})
+	pruned, err := pruneBatches(expired, archive, r.activityLogs.drop)
+
+	// Drop the same entries from the per-user logs
+	dropped := make(map[*ActivityLog]bool, pruned)
+	for _, log := range expired[:pruned] {
+		dropped[log] = true
+	}
+	r.activityByUser.Range(func(_, logs interface{}) bool {
+		userLogs := logs.(*appendLog[ActivityLog])
+		userLogs.drop(len(userLogs.expired(0, func(log *ActivityLog) bool { return dropped[log] })))
+		return true
+	})
+	return pruned, err
+}
+
+// userActivity returns the activity log of one user, creating it if create
+// is set
+func (s *memoryStore) userActivity(userID string, create bool) *appendLog[ActivityLog] {
+	if logs, ok := s.activityByUser.Load(userID); ok {
+		return logs.(*appendLog[ActivityLog])
+	}
+	if !create {
+		return nil
+	}
+	logs, _ := s.activityByUser.LoadOrStore(userID, new(appendLog[ActivityLog]))
+	return logs.(*appendLog[ActivityLog])
+}
+
+// InvitationRepository methods
+type memoryInvitationRepo struct{ *memoryStore }
+
+func (r memoryInvitationRepo) Create(invitation *Invitation) error {
+	r.invitationsMu.Lock()
+	defer r.invitationsMu.Unlock()
+
+	saveForUndo(r.memoryStore, r.invitations, invitation.Token, (*Invitation).clone)
+	saveForUndo(r.memoryStore, r.invitationsByStatus, invitation.Status, keySet.clone)
+	invitation.CreatedAt = time.Now()
+	r.invitations[invitation.Token] = invitation.clone()
+	addToIndex(r.invitationsByStatus, invitation.Status, invitation.Token)
+	return nil
+}
+
+func (r memoryInvitationRepo) GetByToken(token string) (*Invitation, error) {
+	r.invitationsMu.RLock()
+	defer r.invitationsMu.RUnlock()
+
+	invitation, exists := r.invitations[token]
+	if !exists {
+		return nil, notFound("invitation")
+	}
+	return invitation.clone(), nil
+}
+
+func (r memoryInvitationRepo) UpdateStatus(token string, status string) error {
+	r.invitationsMu.Lock()
+	defer r.invitationsMu.Unlock()
+
+	invitation, exists := r.invitations[token]
+	if !exists {
+		return notFound("invitation")
+	}
+	if invitation.Status != "pending" {
+		return invitationProcessed()
+	}
+	r.setInvitationStatus(invitation, status)
+	if status == "accepted" {
+		now := time.Now()
+		invitation.AcceptedAt = &now
+	}
+	return nil
+}
+
+// setInvitationStatus changes an invitation's status, keeping the status
+// index in step. The caller must hold invitationsMu.
+func (s *memoryStore) setInvitationStatus(invitation *Invitation, status string) {
+	saveForUndo(s, s.invitations, invitation.Token, (*Invitation).clone)
+	saveForUndo(s, s.invitationsByStatus, invitation.Status, keySet.clone)
+	saveForUndo(s, s.invitationsByStatus, status, keySet.clone)
+	removeFromIndex(s.invitationsByStatus, invitation.Status, invitation.Token)
+	invitation.Status = status
+	addToIndex(s.invitationsByStatus, status, invitation.Token)
+}
+
+func (r memoryInvitationRepo) ListPage(q listQuery) ([]*Invitation, string, error) {
+	// A status filter narrows the candidates through the status index
+	status, byStatus := "", false
+	for _, f := range q.filters {
+		if f.field == "status" {
+			status, byStatus = f.value.(string), true
+		}
+	}
+
+	r.invitationsMu.RLock()
+	var invitations []*Invitation
+	if byStatus {
+		for token := range r.invitationsByStatus[status] {
+			invitations = append(invitations, r.invitations[token].clone())
+		}
+	} else {
+		for _, inv := range r.invitations {
+			invitations = append(invitations, inv.clone())
+		}
+	}
+	r.invitationsMu.RUnlock()
+
+	items, next := paginate(invitations, invitationListSpec, q)
+	return items, next, nil
+}
+
+// PermissionRepository methods
+type memoryPermissionRepo struct{ *memoryStore }
+
+func (r memoryPermissionRepo) Create(perm *Permission) error {
+	r.permissionsMu.Lock()
+	defer r.permissionsMu.Unlock()
+
+	saveForUndo(r.memoryStore, r.permissions, perm.ID, (*Permission).clone)
+	perm.CreatedAt = time.Now()
+	r.permissions[perm.ID] = perm.clone()
+	return nil
+}
+
+func (r memoryPermissionRepo) Get(id string) (*Permission, error) {
+	r.permissionsMu.RLock()
+	defer r.permissionsMu.RUnlock()
+
+	perm, exists := r.permissions[id]
+	if !exists {
+		return nil, notFound("permission")
+	}
+	return perm.clone(), nil
+}
+
+func (r memoryPermissionRepo) List() ([]*Permission, error) {
+	r.permissionsMu.RLock()
+	defer r.permissionsMu.RUnlock()
+
+	permList := make([]*Permission, 0, len(r.permissions))
+	for _, perm := range r.permissions {
+		permList = append(permList, perm.clone())
+	}
+	return permList, nil
+}
+
+func (r memoryPermissionRepo) Update(id string, updatedPerm *Permission) error {
+	r.permissionsMu.Lock()
+	defer r.permissionsMu.Unlock()
+
+	if _, exists := r.permissions[id]; !exists {
+		return notFound("permission")
+	}
+	saveForUndo(r.memoryStore, r.permissions, id, (*Permission).clone)
+	r.permissions[id] = updatedPerm.clone()
+	return nil
+}
+
+func (r memoryPermissionRepo) Delete(id string) error {
+	r.permissionsMu.Lock()
+	defer r.permissionsMu.Unlock()
+
+	if _, exists := r.permissions[id]; !exists {
+		return notFound("permission")
+	}
+
+	for userID, grants := range r.userPermissions {
+		kept := grants[:0:0]
+		for _, grant := range grants {
+			if grant.PermissionID != id {
+				kept = append(kept, grant)
+			}
+		}
+		if len(kept) != len(grants) {
+			saveForUndo(r.memoryStore, r.userPermissions, userID, cloneAll[*UserPermission])
+			r.userPermissions[userID] = kept
+		}
+	}
+
+	saveForUndo(r.memoryStore, r.permissions, id, (*Permission).clone)
+	delete(r.permissions, id)
+	return nil
+}
+
+func (r memoryPermissionRepo) Grant(userPerm *UserPermission) error {
+	defer lockAll(&r.usersMu, &r.permissionsMu)()
+
+	if _, exists := r.users[userPerm.UserID]; !exists {
+		return notFound("user")
+	}
+	for _, existing := range r.userPermissions[userPerm.UserID] {
+		if existing.PermissionID == userPerm.PermissionID {
+			return alreadyGranted()
+		}
+	}
+
+	saveForUndo(r.memoryStore, r.userPermissions, userPerm.UserID, cloneAll[*UserPermission])
+	userPerm.GrantedAt = time.Now()
+	r.userPermissions[userPerm.UserID] = append(r.userPermissions[userPerm.UserID], userPerm.clone())
+	return nil
+}
+
+func (r memoryPermissionRepo) UserGrants(userID string) ([]*UserPermission, error) {
+	r.permissionsMu.RLock()
+	defer r.permissionsMu.RUnlock()
+
+	return cloneAll(r.userPermissions[userID]), nil
+}
+
+func (r memoryPermissionRepo) Revoke(userID, permissionID string) error {
+	r.permissionsMu.Lock()
+	defer r.permissionsMu.Unlock()
+
+	perms := r.userPermissions[userID]
+	for i, perm := range perms {
+		if perm.PermissionID == permissionID {
+			saveForUndo(r.memoryStore, r.userPermissions, userID, cloneAll[*UserPermission])
+			r.userPermissions[userID] = append(perms[:i], perms[i+1:]...)
+			return nil
+		}
+	}
+	return notFound("permission grant")
+}
+
+// MFARepository methods
+type memoryMFARepo struct{ *memoryStore }
+
+func (r memoryMFARepo) Get(userID string) (*MFACredential, error) {
+	r.mfaMu.RLock()
+	defer r.mfaMu.RUnlock()
+
+	cred, exists := r.mfa[userID]
+	if !exists {
+		return nil, notFound("mfa credential")
+	}
+	return cred.clone(), nil
+}
+
+func (r memoryMFARepo) Save(cred *MFACredential) error {
+	r.mfaMu.Lock()
+	defer r.mfaMu.Unlock()
+
+	saveForUndo(r.memoryStore, r.mfa, cred.UserID, (*MFACredential).clone)
+	if cred.CreatedAt.IsZero() {
+		cred.CreatedAt = time.Now()
+	}
+	r.mfa[cred.UserID] = cred.clone()
+	return nil
+}
+
+func (r memoryMFARepo) Use(cred, read *MFACredential) error {
+	r.mfaMu.Lock()
+	defer r.mfaMu.Unlock()
+
+	stored, exists := r.mfa[cred.UserID]
+	if !exists || stored.Secret != read.Secret || stored.LastUsedStep != read.LastUsedStep ||
+		!slices.Equal(stored.RecoveryCodes, read.RecoveryCodes) {
+		return errMFACodeUsed
+	}
+	saveForUndo(r.memoryStore, r.mfa, cred.UserID, (*MFACredential).clone)
+	r.mfa[cred.UserID] = cred.clone()
+	return nil
+}
+
+func (r memoryMFARepo) Delete(userID string) error {
+	r.mfaMu.Lock()
+	defer r.mfaMu.Unlock()
+
+	if _, exists := r.mfa[userID]; !exists {
+		return notFound("mfa credential")
+	}
+	saveForUndo(r.memoryStore, r.mfa, userID, (*MFACredential).clone)
+	delete(r.mfa, userID)
+	return nil
+}
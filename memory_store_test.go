@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The memory store answers lookups by email, username, user ID and
+// invitation status through secondary indexes. Each benchmark below runs
+// the indexed lookup next to the linear scan of the primary data it
+// replaces, at store sizes from a small deployment to a large one:
+//
+//	go test -run '^$' -bench Lookup -benchmem
+var benchStoreSizes = []int{1_000, 10_000, 100_000}
+
+// benchmarkLookup fills a store of each size, then times indexed and scan
+// on it; both are given a number in [0, n) to look up
+func benchmarkLookup(b *testing.B, fill func(s *memoryStore, n int), indexed, scan func(s *memoryStore, i int)) {
+	for _, n := range benchStoreSizes {
+		s := newMemoryStore()
+		fill(s, n)
+		b.Run(fmt.Sprintf("n=%d/indexed", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				indexed(s, i*7919%n)
+			}
+		})
+		b.Run(fmt.Sprintf("n=%d/scan", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				scan(s, i*7919%n)
+			}
+		})
+	}
+}
+
+func benchUserID(i int) string { return fmt.Sprintf("user-%08d", i) }
+
+// fillUsers adds n users, each with a profile and two sessions
+func fillUsers(s *memoryStore, n int) {
+	for i := 0; i < n; i++ {
+		id := benchUserID(i)
+		s.Users().Create(&User{ID: id, Email: fmt.Sprintf("u%d@example.test", i), Username: fmt.Sprintf("u%d", i)})
+		s.Profiles().Create(&UserProfile{ID: "profile-" + id, UserID: id})
+		for j := 0; j < 2; j++ {
+			s.Sessions().Create(&Session{ID: fmt.Sprintf("s%d-%s", j, id), Token: fmt.Sprintf("t%d-%s", j, id), UserID: id, Kind: "session"})
+		}
+	}
+}
+
+// fillActivity adds ten activity log entries for each of n users,
+// interleaved as concurrent users would produce them
+func fillActivity(s *memoryStore, n int) {
+	for j := 0; j < 10; j++ {
+		for i := 0; i < n; i++ {
+			s.ActivityLogs().Create(&ActivityLog{ID: fmt.Sprintf("a%d-%d", j, i), UserID: benchUserID(i), ActivityType: "view"})
+		}
+	}
+}
+
+func BenchmarkLookupUserByEmail(b *testing.B) {
+	benchmarkLookup(b, fillUsers,
+		func(s *memoryStore, i int) {
+			if _, err := s.Users().GetByEmail(fmt.Sprintf("u%d@example.test", i)); err != nil {
+				b.Fatal(err)
+			}
+		},
+		func(s *memoryStore, i int) {
+			email := fmt.Sprintf("u%d@example.test", i)
+			s.usersMu.RLock()
+			defer s.usersMu.RUnlock()
+			for _, user := range s.users {
+				if user.Email == email {
+					user.clone()
+					return
+				}
+			}
+			b.Fatal("not found")
+		})
+}
+
+func BenchmarkLookupUserByUsername(b *testing.B) {
+	benchmarkLookup(b, fillUsers,
+		func(s *memoryStore, i int) {
+			if _, err := s.Users().GetByUsername(fmt.Sprintf("u%d", i)); err != nil {
+				b.Fatal(err)
+			}
+		},
+		func(s *memoryStore, i int) {
+			username := fmt.Sprintf("u%d", i)
+			s.usersMu.RLock()
+			defer s.usersMu.RUnlock()
+			for _, user := range s.users {
+				if user.Username == username {
+					user.clone()
+					return
+				}
+			}
+			b.Fatal("not found")
+		})
+}
+
+func BenchmarkLookupProfileByUser(b *testing.B) {
+	benchmarkLookup(b, fillUsers,
+		func(s *memoryStore, i int) {
+			if _, err := s.Profiles().GetByUserID(benchUserID(i)); err != nil {
+				b.Fatal(err)
+			}
+		},
+		func(s *memoryStore, i int) {
+			userID := benchUserID(i)
+			s.profilesMu.RLock()
+			defer s.profilesMu.RUnlock()
+			for _, profile := range s.profiles {
+				if profile.UserID == userID {
+					profile.clone()
+					return
+				}
+			}
+			b.Fatal("not found")
+		})
+}
+
+func BenchmarkLookupSessionsByUser(b *testing.B) {
+	benchmarkLookup(b, fillUsers,
+		func(s *memoryStore, i int) {
+			if sessions, _ := s.Sessions().ListByUser(benchUserID(i)); len(sessions) != 2 {
+				b.Fatalf("got %d sessions", len(sessions))
+			}
+		},
+		func(s *memoryStore, i int) {
+			userID := benchUserID(i)
+			s.sessionsMu.RLock()
+			defer s.sessionsMu.RUnlock()
+			var sessions []*Session
+			for _, session := range s.sessions {
+				if session.UserID == userID {
+					sessions = append(sessions, session.clone())
+				}
+			}
+			if len(sessions) != 2 {
+				b.Fatalf("got %d sessions", len(sessions))
+			}
+		})
+}
+
+func BenchmarkLookupActivityByUser(b *testing.B) {
+	benchmarkLookup(b, fillActivity,
+		func(s *memoryStore, i int) {
+			if logs, _ := s.ActivityLogs().ListByUser(benchUserID(i), 50); len(logs) != 10 {
+				b.Fatalf("got %d entries", len(logs))
+			}
+		},
+		func(s *memoryStore, i int) {
+			userID := benchUserID(i)
+			var logs []*ActivityLog
+			all := s.activityLogs.all()
+			for j := len(all) - 1; j >= 0 && len(logs) < 50; j-- {
+				if all[j].UserID == userID {
+					logs = append(logs, all[j].clone())
+				}
+			}
+			if len(logs) != 10 {
+				b.Fatalf("got %d entries", len(logs))
+			}
+		})
+}
+
+// BenchmarkLookupPendingInvitations lists the first page of pending
+// invitations when 1% of all invitations are pending
+func BenchmarkLookupPendingInvitations(b *testing.B) {
+	// As getPendingInvitationsHandler builds it
+	q, err := parseListValues(url.Values{"limit": {"20"}}, invitationListSpec)
+	if err != nil {
+		b.Fatal(err)
+	}
+	q.filters = append(q.filters, listFilter{field: "status", value: "pending"})
+	fill := func(s *memoryStore, n int) {
+		for i := 0; i < n; i++ {
+			status := "accepted"
+			if i%100 == 0 {
+				status = "pending"
+			}
+			token := fmt.Sprintf("inv-%08d", i)
+			s.Invitations().Create(&Invitation{ID: token, Token: token, Email: fmt.Sprintf("i%d@example.test", i), Status: status})
+		}
+	}
+	benchmarkLookup(b, fill,
+		func(s *memoryStore, i int) {
+			if _, _, err := s.Invitations().ListPage(q); err != nil {
+				b.Fatal(err)
+			}
+		},
+		func(s *memoryStore, i int) {
+			s.invitationsMu.RLock()
+			var invitations []*Invitation
+			for _, inv := range s.invitations {
+				if inv.Status == "pending" {
+					invitations = append(invitations, inv.clone())
+				}
+			}
+			s.invitationsMu.RUnlock()
+			paginate(invitations, invitationListSpec, q)
+		})
+}
+
+// BenchmarkParallelMixed runs a workload of 90% reads and 10% writes over
+// users, profiles, sessions and the activity log from GOMAXPROCS
+// goroutines. "per-kind" is the store as it is; "one-lock" additionally
+// serializes every call behind a single store-wide RWMutex, as the store
+// did before it had a lock per kind of record:
+//
+//	go test -run '^$' -bench ParallelMixed -cpu 1,4,8
+func BenchmarkParallelMixed(b *testing.B) {
+	const n = 10_000
+	s := newMemoryStore()
+	fillUsers(s, n)
+	fillActivity(s, n)
+
+	var global sync.RWMutex
+	for _, mode := range []string{"per-kind", "one-lock"} {
+		read, write := func() func() { return func() {} }, func() func() { return func() {} }
+		if mode == "one-lock" {
+			read = func() func() { global.RLock(); return global.RUnlock }
+			write = func() func() { global.Lock(); return global.Unlock }
+		}
+		b.Run(mode, func(b *testing.B) {
+			var seed atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				rng := rand.New(rand.NewSource(seed.Add(1)))
+				for pb.Next() {
+					i := rng.Intn(n)
+					id := benchUserID(i)
+					switch op := rng.Intn(10); {
+					case op < 3:
+						unlock := read()
+						s.Users().Get(id)
+						unlock()
+					case op < 5:
+						unlock := read()
+						s.Users().GetByEmail(fmt.Sprintf("u%d@example.test", i))
+						unlock()
+					case op < 7:
+						unlock := read()
+						s.Profiles().GetByUserID(id)
+						unlock()
+					case op < 9:
+						unlock := read()
+						s.ActivityLogs().ListByUser(id, 20)
+						unlock()
+					case rng.Intn(2) == 0:
+						unlock := write()
+						s.Sessions().Touch("t0-"+id, time.Now())
+						unlock()
+					default:
+						unlock := write()
+						s.ActivityLogs().Create(&ActivityLog{ID: "bench", UserID: id, ActivityType: "view"})
+						unlock()
+					}
+				}
+			})
+		})
+	}
+}
+
+// TestLogSeqOrderWaitsForSlowAppends checks that a query in seq order, as
+// streams make, does not pass over an entry whose append has reserved its
+// slot but not yet published it
+func TestLogSeqOrderWaitsForSlowAppends(t *testing.T) {
+	s := newMemoryStore()
+	logs := s.ActivityLogs()
+	logs.Create(&ActivityLog{ID: "first"})
+
+	// A slow writer holds the next slot while a faster one appends after it
+	slow := s.activityLogs.reserve()
+	logs.Create(&ActivityLog{ID: "third"})
+
+	q := listQuery{sort: "seq", limit: 10, cursor: &pageCursor{Sort: "seq", Value: "1", ID: "first"}}
+	if entries, _, _ := logs.ListPage(q); len(entries) != 0 {
+		t.Fatalf("got %d entries past an unpublished slot", len(entries))
+	}
+
+	s.activityLogs.publish(slow, &ActivityLog{ID: "second", Seq: slow + 1})
+	entries, _, _ := logs.ListPage(q)
+	if len(entries) != 2 || entries[0].ID != "second" || entries[1].ID != "third" {
+		t.Errorf("after the slow append: got %v", entries)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Context keys set by requireAuth
+const (
+	contextUserKey    = "currentUser"
+	contextSessionKey = "currentSession"
+	contextClaimsKey  = "currentClaims"
+
+	contextRequestIDKey  = "requestID"
+	contextPermissionKey = "requiredPermission" // set by requirePermission
+	contextAuditKey      = "auditState"         // set by auditRequests
+)
+
+// requestID tags each request with an ID, taken from a well-formed
+// X-Request-ID header or generated, and echoes it in the response
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if id == "" || len(id) > 128 || strings.ContainsFunc(id, func(r rune) bool { return r < 0x21 || r > 0x7e }) {
+			id = generateID("req")
+		}
+		c.Set(contextRequestIDKey, id)
+		c.Header("X-Request-ID", id)
+		c.Next()
+	}
+}
+
+// respondError aborts the request with err, which renderErrors turns into
+// the response
+func respondError(c *gin.Context, err error) {
+	c.Abort()
+	c.Error(err)
+}
+
+// renderErrors writes the last error recorded for a request as an
+// application/problem+json response, unless a response was already written
+func renderErrors() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if len(c.Errors) == 0 || c.Writer.Written() {
+			return
+		}
+		err := c.Errors.Last().Err
+		p := problemFor(err)
+		p.Instance = c.Request.URL.Path
+		p.RequestID = c.GetString(contextRequestIDKey)
+		if p.Status == http.StatusInternalServerError {
+			log.Printf("request %s: %s %s: %v", p.RequestID, c.Request.Method, p.Instance, err)
+		}
+
+		c.Header("Content-Type", "application/problem+json")
+		c.JSON(p.Status, p)
+	}
+}
+
+// requireAuth resolves the caller from an "Authorization: Bearer <token>"
+// header, which carries either a JWT access token or an opaque session
+// token, and rejects the request if it is missing, invalid or expired.
+// Session tokens of the kinds in allowKinds are accepted besides regular
+// sessions, e.g. "mfa_enroll" for the MFA enrollment routes.
+func requireAuth(allowKinds ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := bearerToken(c)
+		if token == "" {
+			respondError(c, unauthorized("Authentication required"))
+			return
+		}
+
+		if strings.Count(token, ".") == 2 {
+			authenticateAccessToken(c, token)
+			return
+		}
+
+		session, err := store.Sessions().GetByToken(token)
+		if err != nil || session.RevokedAt != nil ||
+			(session.Kind != "session" && !slices.Contains(allowKinds, session.Kind)) {
+			respondError(c, unauthorized("Invalid session"))
+			return
+		}
+
+		now := time.Now()
+		if now.After(session.ExpiresAt) {
+			store.Sessions().Delete(token)
+			respondError(c, unauthorized("Session expired"))
+			return
+		}
+
+		user, err := store.Users().Get(session.UserID)
+		if err != nil || !user.IsActive {
+			respondError(c, unauthorized("Invalid session"))
+			return
+		}
+
+		if err := store.Sessions().Touch(token, now); err == nil {
+			session.LastActivity = now
+		}
+
+		c.Set(contextUserKey, user)
+		c.Set(contextSessionKey, session)
+		c.Next()
+	}
+}
+
+// authenticateAccessToken verifies a JWT access token. Its claims are
+// trusted until expiry, but the user is still loaded so that deactivation
+// takes effect immediately.
+func authenticateAccessToken(c *gin.Context, token string) {
+	claims, err := parseAccessToken(token)
+	if err != nil {
+		respondError(c, unauthorized("Invalid access token"))
+		return
+	}
+
+	user, err := store.Users().Get(claims.Subject)
+	if err != nil || !user.IsActive {
+		respondError(c, unauthorized("Invalid access token"))
+		return
+	}
+
+	c.Set(contextUserKey, user)
+	c.Set(contextClaimsKey, claims)
+	c.Next()
+}
+
+// bearerToken extracts the token from the Authorization header
+func bearerToken(c *gin.Context) string {
+	scheme, token, ok := strings.Cut(c.GetHeader("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// currentUser returns the authenticated caller, or nil on public routes
+func currentUser(c *gin.Context) *User {
+	if user, ok := c.Get(contextUserKey); ok {
+		return user.(*User)
+	}
+	return nil
+}
+
+// currentSession returns the session the caller authenticated with, or nil
+// if they used an access token
+func currentSession(c *gin.Context) *Session {
+	if session, ok := c.Get(contextSessionKey); ok {
+		return session.(*Session)
+	}
+	return nil
+}
+
+// currentClaims returns the caller's access token claims, or nil if they
+// authenticated with a session token
+func currentClaims(c *gin.Context) *accessClaims {
+	if claims, ok := c.Get(contextClaimsKey); ok {
+		return claims.(*accessClaims)
+	}
+	return nil
+}
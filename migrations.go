@@ -0,0 +1,408 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// migration is one versioned schema change, loaded from a pair of
+// NNNN_name.up.sql / NNNN_name.down.sql files
+type migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// migrationStatus reports whether a migration has been applied
+type migrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+// Migrator applies the migrations of one SQL dialect to a database
+type Migrator struct {
+	db         *sql.DB
+	dialect    sqlDialect
+	migrations []migration
+}
+
+func newMigrator(db *sql.DB, dialect sqlDialect) (*Migrator, error) {
+	migrations, err := loadMigrations(migrationFiles, path.Join("migrations", string(dialect)))
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, dialect: dialect, migrations: migrations}, nil
+}
+
+// loadMigrations reads and orders all migrations in dir
+func loadMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		name := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		versionStr, label, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s: expected NNNN_name.%s.sql", name, direction)
+		}
+		version, err := strconv.Atoi(versionStr)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: invalid version: %w", name, err)
+		}
+
+		content, err := fs.ReadFile(fsys, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		m, exists := byVersion[version]
+		if !exists {
+			m = &migration{Version: version, Name: label}
+			byVersion[version] = m
+		} else if m.Name != label {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, m.Name, label)
+		}
+		if direction == "up" {
+			m.Up = string(content)
+			sum := sha256.Sum256(content)
+			m.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d (%s) has no up script", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// appliedMigration is a row of the schema_migrations table
+type appliedMigration struct {
+	Version   int
+	Name      string
+	Checksum  string
+	AppliedAt time.Time
+}
+
+func (m *Migrator) ensureTable() error {
+	_, err := m.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		name       TEXT NOT NULL,
+		checksum   TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	return err
+}
+
+func (m *Migrator) applied() (map[int]appliedMigration, error) {
+	if err := m.ensureTable(); err != nil {
+		return nil, err
+	}
+
+	rows, err := m.db.Query(`SELECT version, name, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]appliedMigration)
+	for rows.Next() {
+		var a appliedMigration
+		if err := rows.Scan(&a.Version, &a.Name, &a.Checksum, &a.AppliedAt); err != nil {
+			return nil, err
+		}
+		applied[a.Version] = a
+	}
+	return applied, rows.Err()
+}
+
+// validate checks that every applied migration still exists unchanged
+func (m *Migrator) validate(applied map[int]appliedMigration) error {
+	known := make(map[int]migration, len(m.migrations))
+	for _, mig := range m.migrations {
+		known[mig.Version] = mig
+	}
+	for version, a := range applied {
+		mig, exists := known[version]
+		if !exists {
+			return fmt.Errorf("migration %d (%s) is applied but no longer exists", version, a.Name)
+		}
+		if mig.Checksum != a.Checksum {
+			return fmt.Errorf("migration %d (%s) has been modified since it was applied", version, a.Name)
+		}
+	}
+	return nil
+}
+
+// Up applies all pending migrations in order
+func (m *Migrator) Up() error {
+	applied, err := m.applied()
+	if err != nil {
+		return err
+	}
+	if err := m.validate(applied); err != nil {
+		return err
+	}
+
+	for _, mig := range m.migrations {
+		if _, done := applied[mig.Version]; done {
+			continue
+		}
+		var prepare func(tx *sql.Tx) error
+		if step := migrationPrepares[mig.Version]; step != nil {
+			prepare = func(tx *sql.Tx) error { return step(tx, m.dialect) }
+		}
+		if err := m.apply(mig, mig.Up, prepare, func(tx *sql.Tx) error {
+			_, err := tx.Exec(m.dialect.rebind(`INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (?, ?, ?, ?)`),
+				mig.Version, mig.Name, mig.Checksum, time.Now().UTC())
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrationPrepares run in the transaction of the migration of the same
+// version, before its script. They stop the migration, explaining how to
+// fix the data, if it would fail on it.
+var migrationPrepares = map[int]func(tx *sql.Tx, dialect sqlDialect) error{
+	4: normalizeIdentifiers,
+}
+
+// normalizeIdentifiers puts existing emails and usernames in the form
+// normalizeIdentifier stores them in, ahead of migration 4 indexing them
+// as unique. The migration's own lower(trim()) is then a no-op; it cannot
+// apply NFKC folding or Unicode case mapping the way Go does. Users whose
+// identifiers would collide are reported instead.
+func normalizeIdentifiers(tx *sql.Tx, dialect sqlDialect) error {
+	type identifiers struct{ id, email, username string }
+	rows, err := tx.Query(`SELECT id, email, username FROM users ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	var users []identifiers
+	for rows.Next() {
+		var u identifiers
+		if err := rows.Scan(&u.id, &u.email, &u.username); err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var conflicts []string
+	for _, column := range []string{"email", "username"} {
+		owners := make(map[string][]string)
+		for _, u := range users {
+			value := u.email
+			if column == "username" {
+				value = u.username
+			}
+			value = normalizeIdentifier(value)
+			owners[value] = append(owners[value], u.id)
+		}
+		values := make([]string, 0, len(owners))
+		for value, ids := range owners {
+			if len(ids) > 1 {
+				values = append(values, value)
+			}
+		}
+		sort.Strings(values)
+		for _, value := range values {
+			conflicts = append(conflicts, fmt.Sprintf("%s %q: users %s", column, value, strings.Join(owners[value], ", ")))
+		}
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("emails and usernames become case-insensitive, but some users share one:\n  %s\n"+
+			"change the email or username of all but one user of each, or merge or delete the duplicate accounts, then migrate again",
+			strings.Join(conflicts, "\n  "))
+	}
+
+	for _, u := range users {
+		email, username := normalizeIdentifier(u.email), normalizeIdentifier(u.username)
+		if email == u.email && username == u.username {
+			continue
+		}
+		if _, err := tx.Exec(dialect.rebind(`UPDATE users SET email = ?, username = ? WHERE id = ?`), email, username, u.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Down rolls back the most recent steps applied migrations
+func (m *Migrator) Down(steps int) error {
+	applied, err := m.applied()
+	if err != nil {
+		return err
+	}
+	if err := m.validate(applied); err != nil {
+		return err
+	}
+
+	for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+		mig := m.migrations[i]
+		if _, done := applied[mig.Version]; !done {
+			continue
+		}
+		if mig.Down == "" {
+			return fmt.Errorf("migration %d (%s) has no down script", mig.Version, mig.Name)
+		}
+		if err := m.apply(mig, mig.Down, nil, func(tx *sql.Tx) error {
+			_, err := tx.Exec(m.dialect.rebind(`DELETE FROM schema_migrations WHERE version = ?`), mig.Version)
+			return err
+		}); err != nil {
+			return err
+		}
+		steps--
+	}
+	return nil
+}
+
+// Status lists every known migration and when it was applied
+func (m *Migrator) Status() ([]migrationStatus, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	if err := m.validate(applied); err != nil {
+		return nil, err
+	}
+
+	statuses := make([]migrationStatus, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		status := migrationStatus{Version: mig.Version, Name: mig.Name}
+		if a, done := applied[mig.Version]; done {
+			appliedAt := a.AppliedAt
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// apply runs prepare, if any, script and the bookkeeping statement in one
+// transaction
+func (m *Migrator) apply(mig migration, script string, prepare, record func(tx *sql.Tx) error) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if prepare != nil {
+		if err := prepare(tx); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", mig.Version, mig.Name, err)
+		}
+	}
+	if _, err := tx.Exec(script); err != nil {
+		return fmt.Errorf("migration %d (%s): %w", mig.Version, mig.Name, err)
+	}
+	if err := record(tx); err != nil {
+		return fmt.Errorf("migration %d (%s): %w", mig.Version, mig.Name, err)
+	}
+	return tx.Commit()
+}
+
+var errUnsupportedMigrationDriver = errors.New("migrations are only available for SQL storage drivers")
+
+// runMigrateCommand implements "migrate [up | down [steps] | status]"
+func runMigrateCommand(cfg Config, args []string) error {
+	var db *sql.DB
+	var dialect sqlDialect
+	var err error
+	switch cfg.StorageDriver {
+	case "sqlite":
+		db, err = openSQLiteDB(cfg.StorageDSN)
+		dialect = dialectSQLite
+	case "postgres":
+		db, err = openPostgresDB(cfg.StorageDSN)
+		dialect = dialectPostgres
+	default:
+		return errUnsupportedMigrationDriver
+	}
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	migrator, err := newMigrator(db, dialect)
+	if err != nil {
+		return err
+	}
+
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch command {
+	case "up":
+		return migrator.Up()
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid step count %q", args[1])
+			}
+		}
+		return migrator.Down(steps)
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d %-30s %s\n", s.Version, s.Name, applied)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q (want up, down or status)", command)
+	}
+}
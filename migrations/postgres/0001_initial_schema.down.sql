@@ -0,0 +1,13 @@
+DROP TABLE user_permissions;
+DROP TABLE permissions;
+DROP TABLE invitations;
+DROP TABLE activity_logs;
+DROP TABLE user_preferences;
+DROP TABLE sessions;
+DROP TABLE password_resets;
+DROP TABLE audit_logs;
+DROP TABLE team_members;
+DROP TABLE teams;
+DROP TABLE user_profiles;
+DROP TABLE roles;
+DROP TABLE users;
@@ -0,0 +1,2 @@
+DROP TABLE mfa_credentials;
+ALTER TABLE roles DROP COLUMN require_mfa;
@@ -0,0 +1,10 @@
+ALTER TABLE roles ADD COLUMN require_mfa BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE mfa_credentials (
+    user_id        TEXT PRIMARY KEY,
+    secret         TEXT NOT NULL,
+    recovery_codes JSONB NOT NULL DEFAULT '[]',
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    confirmed_at   TIMESTAMPTZ,
+    created_at     TIMESTAMPTZ NOT NULL
+);
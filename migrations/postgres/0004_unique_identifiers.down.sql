@@ -0,0 +1,2 @@
+DROP INDEX users_username_key;
+DROP INDEX users_email_key;
@@ -0,0 +1,6 @@
+-- Stored emails and usernames are trimmed and lowercased by the application;
+-- bring existing rows into that form. NFKC folding is applied on next write.
+UPDATE users SET email = lower(trim(email)), username = lower(trim(username));
+
+CREATE UNIQUE INDEX users_email_key ON users (email);
+CREATE UNIQUE INDEX users_username_key ON users (username);
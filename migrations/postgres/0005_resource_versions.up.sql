@@ -0,0 +1,5 @@
+ALTER TABLE users ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
+ALTER TABLE roles ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
+ALTER TABLE user_profiles ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
+ALTER TABLE teams ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
+ALTER TABLE user_preferences ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
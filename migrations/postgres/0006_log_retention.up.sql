@@ -0,0 +1,3 @@
+-- Retention prunes the logs by age
+CREATE INDEX idx_audit_logs_created_at ON audit_logs (created_at);
+CREATE INDEX idx_activity_logs_created_at ON activity_logs (created_at);
@@ -0,0 +1,3 @@
+DROP INDEX idx_audit_logs_action;
+DROP INDEX idx_audit_logs_resource;
+DROP INDEX idx_audit_logs_user_id;
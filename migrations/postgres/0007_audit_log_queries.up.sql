@@ -0,0 +1,4 @@
+-- Filters of the audit log query API
+CREATE INDEX idx_audit_logs_user_id ON audit_logs (user_id);
+CREATE INDEX idx_audit_logs_resource ON audit_logs (resource_type, resource_id);
+CREATE INDEX idx_audit_logs_action ON audit_logs (action);
@@ -0,0 +1,4 @@
+DROP TABLE audit_checkpoints;
+DROP INDEX idx_audit_logs_prev_hash;
+ALTER TABLE audit_logs DROP COLUMN hash;
+ALTER TABLE audit_logs DROP COLUMN prev_hash;
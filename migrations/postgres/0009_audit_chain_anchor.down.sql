@@ -0,0 +1,2 @@
+DROP TABLE audit_chain;
+ALTER TABLE audit_checkpoints DROP COLUMN kind;
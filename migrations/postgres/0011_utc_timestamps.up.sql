@@ -0,0 +1,3 @@
+-- TIMESTAMPTZ columns store instants, so there is nothing to convert;
+-- see the SQLite migration of the same number
+SELECT 1;
@@ -0,0 +1,143 @@
+CREATE TABLE users (
+    id         TEXT PRIMARY KEY,
+    email      TEXT NOT NULL,
+    username   TEXT NOT NULL,
+    password   TEXT NOT NULL DEFAULT '',
+    first_name TEXT NOT NULL DEFAULT '',
+    last_name  TEXT NOT NULL DEFAULT '',
+    role_id    TEXT NOT NULL DEFAULT '',
+    team_id    TEXT NOT NULL DEFAULT '',
+    is_active  BOOLEAN NOT NULL DEFAULT 1,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE roles (
+    id          TEXT PRIMARY KEY,
+    name        TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    permissions TEXT NOT NULL DEFAULT '[]',
+    created_at  TIMESTAMP NOT NULL
+);
+
+CREATE TABLE user_profiles (
+    id           TEXT PRIMARY KEY,
+    user_id      TEXT NOT NULL,
+    avatar       TEXT NOT NULL DEFAULT '',
+    bio          TEXT NOT NULL DEFAULT '',
+    phone_number TEXT NOT NULL DEFAULT '',
+    location     TEXT NOT NULL DEFAULT '',
+    company      TEXT NOT NULL DEFAULT '',
+    website      TEXT NOT NULL DEFAULT '',
+    updated_at   TIMESTAMP NOT NULL
+);
+CREATE INDEX idx_user_profiles_user_id ON user_profiles (user_id);
+
+CREATE TABLE teams (
+    id           TEXT PRIMARY KEY,
+    name         TEXT NOT NULL,
+    description  TEXT NOT NULL DEFAULT '',
+    owner_id     TEXT NOT NULL DEFAULT '',
+    member_count INTEGER NOT NULL DEFAULT 0,
+    created_at   TIMESTAMP NOT NULL,
+    updated_at   TIMESTAMP NOT NULL
+);
+
+CREATE TABLE team_members (
+    id        TEXT PRIMARY KEY,
+    team_id   TEXT NOT NULL,
+    user_id   TEXT NOT NULL,
+    role      TEXT NOT NULL DEFAULT '',
+    joined_at TIMESTAMP NOT NULL
+);
+CREATE INDEX idx_team_members_team_id ON team_members (team_id);
+
+CREATE TABLE audit_logs (
+    seq           INTEGER PRIMARY KEY AUTOINCREMENT,
+    id            TEXT NOT NULL UNIQUE,
+    user_id       TEXT NOT NULL DEFAULT '',
+    action        TEXT NOT NULL,
+    resource_id   TEXT NOT NULL DEFAULT '',
+    resource_type TEXT NOT NULL DEFAULT '',
+    ip_address    TEXT NOT NULL DEFAULT '',
+    user_agent    TEXT NOT NULL DEFAULT '',
+    status        TEXT NOT NULL DEFAULT '',
+    details       TEXT,
+    created_at    TIMESTAMP NOT NULL
+);
+
+CREATE TABLE password_resets (
+    id         TEXT PRIMARY KEY,
+    user_id    TEXT NOT NULL DEFAULT '',
+    token      TEXT NOT NULL UNIQUE,
+    expires_at TIMESTAMP NOT NULL,
+    used       BOOLEAN NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE sessions (
+    id            TEXT PRIMARY KEY,
+    user_id       TEXT NOT NULL,
+    token         TEXT NOT NULL UNIQUE,
+    ip_address    TEXT NOT NULL DEFAULT '',
+    user_agent    TEXT NOT NULL DEFAULT '',
+    expires_at    TIMESTAMP NOT NULL,
+    last_activity TIMESTAMP NOT NULL,
+    created_at    TIMESTAMP NOT NULL
+);
+CREATE INDEX idx_sessions_user_id ON sessions (user_id);
+
+CREATE TABLE user_preferences (
+    id            TEXT NOT NULL,
+    user_id       TEXT PRIMARY KEY,
+    theme         TEXT NOT NULL DEFAULT '',
+    language      TEXT NOT NULL DEFAULT '',
+    timezone      TEXT NOT NULL DEFAULT '',
+    notifications TEXT,
+    settings      TEXT,
+    updated_at    TIMESTAMP NOT NULL
+);
+
+CREATE TABLE activity_logs (
+    seq           INTEGER PRIMARY KEY AUTOINCREMENT,
+    id            TEXT NOT NULL UNIQUE,
+    user_id       TEXT NOT NULL DEFAULT '',
+    activity_type TEXT NOT NULL DEFAULT '',
+    description   TEXT NOT NULL DEFAULT '',
+    metadata      TEXT,
+    ip_address    TEXT NOT NULL DEFAULT '',
+    created_at    TIMESTAMP NOT NULL
+);
+CREATE INDEX idx_activity_logs_user_id ON activity_logs (user_id);
+
+CREATE TABLE invitations (
+    id          TEXT PRIMARY KEY,
+    email       TEXT NOT NULL,
+    team_id     TEXT NOT NULL DEFAULT '',
+    role_id     TEXT NOT NULL DEFAULT '',
+    invited_by  TEXT NOT NULL DEFAULT '',
+    token       TEXT NOT NULL UNIQUE,
+    status      TEXT NOT NULL,
+    expires_at  TIMESTAMP NOT NULL,
+    accepted_at TIMESTAMP,
+    created_at  TIMESTAMP NOT NULL
+);
+CREATE INDEX idx_invitations_status ON invitations (status);
+
+CREATE TABLE permissions (
+    id          TEXT PRIMARY KEY,
+    name        TEXT NOT NULL,
+    resource    TEXT NOT NULL,
+    action      TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    created_at  TIMESTAMP NOT NULL
+);
+
+CREATE TABLE user_permissions (
+    id            TEXT PRIMARY KEY,
+    user_id       TEXT NOT NULL,
+    permission_id TEXT NOT NULL,
+    granted_by    TEXT NOT NULL DEFAULT '',
+    granted_at    TIMESTAMP NOT NULL
+);
+CREATE INDEX idx_user_permissions_user_id ON user_permissions (user_id);
@@ -0,0 +1,4 @@
+ALTER TABLE sessions ADD COLUMN kind TEXT NOT NULL DEFAULT 'session';
+ALTER TABLE sessions ADD COLUMN family_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN revoked_at TIMESTAMP;
+CREATE INDEX idx_sessions_family_id ON sessions (family_id);
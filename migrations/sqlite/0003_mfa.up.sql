@@ -0,0 +1,10 @@
+ALTER TABLE roles ADD COLUMN require_mfa BOOLEAN NOT NULL DEFAULT 0;
+
+CREATE TABLE mfa_credentials (
+    user_id        TEXT PRIMARY KEY,
+    secret         TEXT NOT NULL,
+    recovery_codes TEXT NOT NULL DEFAULT '[]',
+    last_used_step INTEGER NOT NULL DEFAULT 0,
+    confirmed_at   TIMESTAMP,
+    created_at     TIMESTAMP NOT NULL
+);
@@ -0,0 +1,5 @@
+ALTER TABLE user_preferences DROP COLUMN version;
+ALTER TABLE teams DROP COLUMN version;
+ALTER TABLE user_profiles DROP COLUMN version;
+ALTER TABLE roles DROP COLUMN version;
+ALTER TABLE users DROP COLUMN version;
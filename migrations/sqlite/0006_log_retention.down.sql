@@ -0,0 +1,2 @@
+DROP INDEX idx_activity_logs_created_at;
+DROP INDEX idx_audit_logs_created_at;
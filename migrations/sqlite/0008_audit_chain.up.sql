@@ -0,0 +1,14 @@
+-- Entries written before this migration stay unchained (NULL hashes)
+ALTER TABLE audit_logs ADD COLUMN prev_hash TEXT;
+ALTER TABLE audit_logs ADD COLUMN hash TEXT;
+CREATE UNIQUE INDEX idx_audit_logs_prev_hash ON audit_logs (prev_hash);
+
+CREATE TABLE audit_checkpoints (
+    seq        INTEGER PRIMARY KEY AUTOINCREMENT,
+    id         TEXT NOT NULL UNIQUE,
+    entry_id   TEXT NOT NULL,
+    entry_hash TEXT NOT NULL,
+    key_id     TEXT NOT NULL,
+    signature  TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
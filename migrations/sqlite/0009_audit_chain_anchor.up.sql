@@ -0,0 +1,14 @@
+-- Anchor checkpoints sign the hash of the last entry retention dropped,
+-- which the oldest retained entry links to
+ALTER TABLE audit_checkpoints ADD COLUMN kind TEXT NOT NULL DEFAULT 'head';
+
+-- Entries before chain_start were written before the log was chained by
+-- 0008; every later entry must have a hash
+CREATE TABLE audit_chain (
+    id          INTEGER PRIMARY KEY CHECK (id = 1),
+    chain_start INTEGER NOT NULL
+);
+INSERT INTO audit_chain (id, chain_start)
+SELECT 1, COALESCE((SELECT MIN(seq) FROM audit_logs WHERE hash IS NOT NULL),
+                   (SELECT MAX(seq) + 1 FROM audit_logs),
+                   1);
@@ -0,0 +1,3 @@
+DROP INDEX idx_user_profiles_user_id;
+CREATE INDEX idx_user_profiles_user_id ON user_profiles (user_id);
+DROP INDEX idx_team_members_team_user;
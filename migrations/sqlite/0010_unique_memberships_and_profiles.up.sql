@@ -0,0 +1,20 @@
+-- A user joins a team at most once. Keep the earliest of any duplicate
+-- memberships and recount the teams.
+DELETE FROM team_members WHERE EXISTS (
+    SELECT 1 FROM team_members earlier
+    WHERE earlier.team_id = team_members.team_id AND earlier.user_id = team_members.user_id
+      AND (earlier.joined_at < team_members.joined_at
+           OR (earlier.joined_at = team_members.joined_at AND earlier.id < team_members.id))
+);
+UPDATE teams SET member_count = (SELECT COUNT(*) FROM team_members WHERE team_members.team_id = teams.id);
+CREATE UNIQUE INDEX idx_team_members_team_user ON team_members (team_id, user_id);
+
+-- A user has at most one profile. Keep the most recently updated one.
+DELETE FROM user_profiles WHERE EXISTS (
+    SELECT 1 FROM user_profiles newer
+    WHERE newer.user_id = user_profiles.user_id
+      AND (newer.updated_at > user_profiles.updated_at
+           OR (newer.updated_at = user_profiles.updated_at AND newer.id > user_profiles.id))
+);
+DROP INDEX idx_user_profiles_user_id;
+CREATE UNIQUE INDEX idx_user_profiles_user_id ON user_profiles (user_id);
@@ -0,0 +1,2 @@
+-- The UTC times are the same instants; there is nothing to undo
+SELECT 1;
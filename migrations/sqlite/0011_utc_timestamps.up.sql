@@ -0,0 +1,51 @@
+-- Times were stored in the offset of the host that wrote them, as text
+-- such as 2024-05-01 14:30:00.123456+02:00, and compared as text. Convert
+-- them to UTC, as they are now written, keeping the fractional seconds.
+UPDATE users SET created_at = datetime(created_at) || substr(created_at, 20, length(created_at) - 25) || '+00:00'
+    WHERE substr(created_at, -6) GLOB '[+-][0-9][0-9]:[0-9][0-9]' AND substr(created_at, -6) <> '+00:00';
+UPDATE users SET updated_at = datetime(updated_at) || substr(updated_at, 20, length(updated_at) - 25) || '+00:00'
+    WHERE substr(updated_at, -6) GLOB '[+-][0-9][0-9]:[0-9][0-9]' AND substr(updated_at, -6) <> '+00:00';
+UPDATE roles SET created_at = datetime(created_at) || substr(created_at, 20, length(created_at) - 25) || '+00:00'
+    WHERE substr(created_at, -6) GLOB '[+-][0-9][0-9]:[0-9][0-9]' AND substr(created_at, -6) <> '+00:00';
+UPDATE user_profiles SET updated_at = datetime(updated_at) || substr(updated_at, 20, length(updated_at) - 25) || '+00:00'
+    WHERE substr(updated_at, -6) GLOB '[+-][0-9][0-9]:[0-9][0-9]' AND substr(updated_at, -6) <> '+00:00';
+UPDATE teams SET created_at = datetime(created_at) || substr(created_at, 20, length(created_at) - 25) || '+00:00'
+    WHERE substr(created_at, -6) GLOB '[+-][0-9][0-9]:[0-9][0-9]' AND substr(created_at, -6) <> '+00:00';
+UPDATE teams SET updated_at = datetime(updated_at) || substr(updated_at, 20, length(updated_at) - 25) || '+00:00'
+    WHERE substr(updated_at, -6) GLOB '[+-][0-9][0-9]:[0-9][0-9]' AND substr(updated_at, -6) <> '+00:00';
+UPDATE team_members SET joined_at = datetime(joined_at) || substr(joined_at, 20, length(joined_at) - 25) || '+00:00'
+    WHERE substr(joined_at, -6) GLOB '[+-][0-9][0-9]:[0-9][0-9]' AND substr(joined_at, -6) <> '+00:00';
+UPDATE audit_logs SET created_at = datetime(created_at) || substr(created_at, 20, length(created_at) - 25) || '+00:00'
+    WHERE substr(created_at, -6) GLOB '[+-][0-9][0-9]:[0-9][0-9]' AND substr(created_at, -6) <> '+00:00';
+UPDATE audit_checkpoints SET created_at = datetime(created_at) || substr(created_at, 20, length(created_at) - 25) || '+00:00'
+    WHERE substr(created_at, -6) GLOB '[+-][0-9][0-9]:[0-9][0-9]' AND substr(created_at, -6) <> '+00:00';
+UPDATE password_resets SET expires_at = datetime(expires_at) || substr(expires_at, 20, length(expires_at) - 25) || '+00:00'
+    WHERE substr(expires_at, -6) GLOB '[+-][0-9][0-9]:[0-9][0-9]' AND substr(expires_at, -6) <> '+00:00';
+UPDATE password_resets SET created_at = datetime(created_at) || substr(created_at, 20, length(created_at) - 25) || '+00:00'
+    WHERE substr(created_at, -6) GLOB '[+-][0-9][0-9]:[0-9][0-9]' AND substr(created_at, -6) <> '+00:00';
+UPDATE sessions SET expires_at = datetime(expires_at) || substr(expires_at, 20, length(expires_at) - 25) || '+00:00'
+    WHERE substr(expires_at, -6) GLOB '[+-][0-9][0-9]:[0-9][0-9]' AND substr(expires_at, -6) <> '+00:00';
+UPDATE sessions SET last_activity = datetime(last_activity) || substr(last_activity, 20, length(last_activity) - 25) || '+00:00'
+    WHERE substr(last_activity, -6) GLOB '[+-][0-9][0-9]:[0-9][0-9]' AND substr(last_activity, -6) <> '+00:00';
+UPDATE sessions SET created_at = datetime(created_at) || substr(created_at, 20, length(created_at) - 25) || '+00:00'
+    WHERE substr(created_at, -6) GLOB '[+-][0-9][0-9]:[0-9][0-9]' AND substr(created_at, -6) <> '+00:00';
+UPDATE sessions SET revoked_at = datetime(revoked_at) || substr(revoked_at, 20, length(revoked_at) - 25) || '+00:00'
+    WHERE substr(revoked_at, -6) GLOB '[+-][0-9][0-9]:[0-9][0-9]' AND substr(revoked_at, -6) <> '+00:00';
+UPDATE user_preferences SET updated_at = datetime(updated_at) || substr(updated_at, 20, length(updated_at) - 25) || '+00:00'
+    WHERE substr(updated_at, -6) GLOB '[+-][0-9][0-9]:[0-9][0-9]' AND substr(updated_at, -6) <> '+00:00';
+UPDATE activity_logs SET created_at = datetime(created_at) || substr(created_at, 20, length(created_at) - 25) || '+00:00'
+    WHERE substr(created_at, -6) GLOB '[+-][0-9][0-9]:[0-9][0-9]' AND substr(created_at, -6) <> '+00:00';
+UPDATE invitations SET expires_at = datetime(expires_at) || substr(expires_at, 20, length(expires_at) - 25) || '+00:00'
+    WHERE substr(expires_at, -6) GLOB '[+-][0-9][0-9]:[0-9][0-9]' AND substr(expires_at, -6) <> '+00:00';
+UPDATE invitations SET accepted_at = datetime(accepted_at) || substr(accepted_at, 20, length(accepted_at) - 25) || '+00:00'
+    WHERE substr(accepted_at, -6) GLOB '[+-][0-9][0-9]:[0-9][0-9]' AND substr(accepted_at, -6) <> '+00:00';
+UPDATE invitations SET created_at = datetime(created_at) || substr(created_at, 20, length(created_at) - 25) || '+00:00'
+    WHERE substr(created_at, -6) GLOB '[+-][0-9][0-9]:[0-9][0-9]' AND substr(created_at, -6) <> '+00:00';
+UPDATE permissions SET created_at = datetime(created_at) || substr(created_at, 20, length(created_at) - 25) || '+00:00'
+    WHERE substr(created_at, -6) GLOB '[+-][0-9][0-9]:[0-9][0-9]' AND substr(created_at, -6) <> '+00:00';
+UPDATE user_permissions SET granted_at = datetime(granted_at) || substr(granted_at, 20, length(granted_at) - 25) || '+00:00'
+    WHERE substr(granted_at, -6) GLOB '[+-][0-9][0-9]:[0-9][0-9]' AND substr(granted_at, -6) <> '+00:00';
+UPDATE mfa_credentials SET confirmed_at = datetime(confirmed_at) || substr(confirmed_at, 20, length(confirmed_at) - 25) || '+00:00'
+    WHERE substr(confirmed_at, -6) GLOB '[+-][0-9][0-9]:[0-9][0-9]' AND substr(confirmed_at, -6) <> '+00:00';
+UPDATE mfa_credentials SET created_at = datetime(created_at) || substr(created_at, 20, length(created_at) - 25) || '+00:00'
+    WHERE substr(created_at, -6) GLOB '[+-][0-9][0-9]:[0-9][0-9]' AND substr(created_at, -6) <> '+00:00';
@@ -0,0 +1 @@
+DROP INDEX idx_user_permissions_user_permission;
@@ -0,0 +1,9 @@
+-- A permission is granted to a user at most once. Keep the earliest of any
+-- duplicate grants.
+DELETE FROM user_permissions WHERE EXISTS (
+    SELECT 1 FROM user_permissions earlier
+    WHERE earlier.user_id = user_permissions.user_id AND earlier.permission_id = user_permissions.permission_id
+      AND (earlier.granted_at < user_permissions.granted_at
+           OR (earlier.granted_at = user_permissions.granted_at AND earlier.id < user_permissions.id))
+);
+CREATE UNIQUE INDEX idx_user_permissions_user_permission ON user_permissions (user_id, permission_id);
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMigrateCaseVariantIdentifiers checks that migration 4 stops with the
+// conflicting users, instead of a bare index error, when emails only differ
+// in case or Unicode spelling, and otherwise stores them as
+// normalizeIdentifier would
+func TestMigrateCaseVariantIdentifiers(t *testing.T) {
+	nfkc := appConfig.NormalizeNFKC
+	appConfig.NormalizeNFKC = true
+	defer func() { appConfig.NormalizeNFKC = nfkc }()
+
+	db, err := openSQLiteDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	migrator, err := newMigrator(db, dialectSQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+	status, _ := migrator.Status()
+	if err := migrator.Down(len(status) - 3); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, user := range [][]string{
+		{"user-a", "Ada@example.test", "ada"},
+		{"user-b", "ada@example.test ", "ÄDA"},
+		{"user-c", "carol@example.test", "ａｄａ"},
+	} {
+		if _, err := db.Exec(`INSERT INTO users (id, email, username, created_at, updated_at) VALUES (?, ?, ?, ?, ?)`,
+			user[0], user[1], user[2], time.Now(), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = migrator.Up()
+	for _, conflict := range []string{`email "ada@example.test": users user-a, user-b`, `username "ada": users user-a, user-c`} {
+		if err == nil || !strings.Contains(err.Error(), conflict) {
+			t.Fatalf("got %v, want %s", err, conflict)
+		}
+	}
+
+	if _, err := db.Exec(`UPDATE users SET email = 'grace@example.test' WHERE id = 'user-b'`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE users SET username = 'carol' WHERE id = 'user-c'`); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Up(); err != nil {
+		t.Fatalf("after fixing the conflicts: %v", err)
+	}
+	var username string
+	if err := db.QueryRow(`SELECT username FROM users WHERE id = 'user-b'`).Scan(&username); err != nil || username != "äda" {
+		t.Errorf("got username %q, %v, want it lowercased as Go does", username, err)
+	}
+}
@@ -5,24 +5,27 @@ import "time"
 // User represents the main user entity
 type User struct {
 	ID        string    `json:"id"`
-	Email     string    `json:"email"`
-	Username  string    `json:"username"`
+	Email     string    `json:"email" binding:"required,email"`
+	Username  string    `json:"username" binding:"required,username"`
 	Password  string    `json:"-"` // Never expose password in JSON
 	FirstName string    `json:"first_name"`
 	LastName  string    `json:"last_name"`
 	RoleID    string    `json:"role_id"`
 	TeamID    string    `json:"team_id,omitempty"`
 	IsActive  bool      `json:"is_active"`
+	Version   int64     `json:"version"` // incremented on every change; see etag.go
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
 // Role represents user roles for RBAC
 type Role struct {
-	ID          string   `json:"id"`
-	Name        string   `json:"name"`
-	Description string   `json:"description"`
-	Permissions []string `json:"permissions"`
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Permissions []string  `json:"permissions"`
+	RequireMFA  bool      `json:"require_mfa"` // members must enroll in MFA before they can log in
+	Version     int64     `json:"version"`
 	CreatedAt   time.Time `json:"created_at"`
 }
 
@@ -32,20 +35,22 @@ type UserProfile struct {
 	UserID      string    `json:"user_id"`
 	Avatar      string    `json:"avatar"`
 	Bio         string    `json:"bio"`
-	PhoneNumber string    `json:"phone_number"`
+	PhoneNumber string    `json:"phone_number" binding:"omitempty,e164"`
 	Location    string    `json:"location"`
 	Company     string    `json:"company"`
-	Website     string    `json:"website"`
+	Website     string    `json:"website" binding:"omitempty,url"`
+	Version     int64     `json:"version"`
 	UpdatedAt   time.Time `json:"updated_at"`
 }
 
 // Team represents a group of users
 type Team struct {
 	ID          string    `json:"id"`
-	Name        string    `json:"name"`
+	Name        string    `json:"name" binding:"required"`
 	Description string    `json:"description"`
 	OwnerID     string    `json:"owner_id"`
 	MemberCount int       `json:"member_count"`
+	Version     int64     `json:"version"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 }
@@ -54,23 +59,26 @@ type Team struct {
 type TeamMember struct {
 	ID       string    `json:"id"`
 	TeamID   string    `json:"team_id"`
-	UserID   string    `json:"user_id"`
-	Role     string    `json:"role"` // admin, member, viewer
+	UserID   string    `json:"user_id" binding:"required"`
+	Role     string    `json:"role" binding:"omitempty,oneof=admin member viewer"`
 	JoinedAt time.Time `json:"joined_at"`
 }
 
 // AuditLog represents system audit trail
 type AuditLog struct {
-	ID          string                 `json:"id"`
-	UserID      string                 `json:"user_id"`
-	Action      string                 `json:"action"`
-	ResourceID  string                 `json:"resource_id"`
-	ResourceType string                `json:"resource_type"`
-	IPAddress   string                 `json:"ip_address"`
-	UserAgent   string                 `json:"user_agent"`
-	Status      string                 `json:"status"` // success, failure
-	Details     map[string]interface{} `json:"details,omitempty"`
-	CreatedAt   time.Time              `json:"created_at"`
+	ID           string                 `json:"id"`
+	UserID       string                 `json:"user_id"`
+	Action       string                 `json:"action"`
+	ResourceID   string                 `json:"resource_id"`
+	ResourceType string                 `json:"resource_type"`
+	IPAddress    string                 `json:"ip_address"`
+	UserAgent    string                 `json:"user_agent"`
+	Status       string                 `json:"status"` // success, failure
+	Details      map[string]interface{} `json:"details,omitempty"`
+	CreatedAt    time.Time              `json:"created_at"`
+	PrevHash     string                 `json:"prev_hash,omitempty"` // hash chain; see auditchain.go
+	Hash         string                 `json:"hash,omitempty"`
+	Seq          int64                  `json:"-"` // position in the log; see stream.go
 }
 
 // PasswordReset represents password reset tokens
@@ -85,59 +93,74 @@ type PasswordReset struct {
 
 // Session represents user sessions
 type Session struct {
-	ID           string    `json:"id"`
-	UserID       string    `json:"user_id"`
-	Token        string    `json:"token"`
-	IPAddress    string    `json:"ip_address"`
-	UserAgent    string    `json:"user_agent"`
-	ExpiresAt    time.Time `json:"expires_at"`
-	LastActivity time.Time `json:"last_activity"`
-	CreatedAt    time.Time `json:"created_at"`
+	ID           string     `json:"id"`
+	UserID       string     `json:"user_id"`
+	Token        string     `json:"token"` // for refresh tokens, the SHA-256 of the token
+	Kind         string     `json:"kind"`  // session, refresh, mfa_challenge, mfa_enroll
+	FamilyID     string     `json:"family_id,omitempty"`
+	IPAddress    string     `json:"ip_address"`
+	UserAgent    string     `json:"user_agent"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	LastActivity time.Time  `json:"last_activity"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// MFACredential holds a user's TOTP enrollment
+type MFACredential struct {
+	UserID        string     `json:"user_id"`
+	Secret        string     `json:"-"` // base32 TOTP secret
+	RecoveryCodes []string   `json:"-"` // SHA-256 of each unused recovery code
+	LastUsedStep  int64      `json:"-"` // last accepted TOTP time step, so a code cannot be replayed
+	ConfirmedAt   *time.Time `json:"confirmed_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
 }
 
 // UserPreferences represents user-specific settings
 type UserPreferences struct {
-	ID           string                 `json:"id"`
-	UserID       string                 `json:"user_id"`
-	Theme        string                 `json:"theme"` // light, dark, auto
-	Language     string                 `json:"language"`
-	Timezone     string                 `json:"timezone"`
-	Notifications map[string]bool       `json:"notifications"`
-	Settings     map[string]interface{} `json:"settings"`
-	UpdatedAt    time.Time              `json:"updated_at"`
+	ID            string                 `json:"id"`
+	UserID        string                 `json:"user_id"`
+	Theme         string                 `json:"theme" binding:"omitempty,oneof=light dark auto"`
+	Language      string                 `json:"language"`
+	Timezone      string                 `json:"timezone" binding:"omitempty,timezone"`
+	Notifications map[string]bool        `json:"notifications"`
+	Settings      map[string]interface{} `json:"settings"`
+	Version       int64                  `json:"version"`
+	UpdatedAt     time.Time              `json:"updated_at"`
 }
 
 // ActivityLog represents user activity tracking
 type ActivityLog struct {
-	ID          string                 `json:"id"`
-	UserID      string                 `json:"user_id"`
-	ActivityType string                `json:"activity_type"` // login, logout, view, edit, create, delete
-	Description string                 `json:"description"`
-	Metadata    map[string]interface{} `json:"metadata,omitempty"`
-	IPAddress   string                 `json:"ip_address"`
-	CreatedAt   time.Time              `json:"created_at"`
+	ID           string                 `json:"id"`
+	UserID       string                 `json:"user_id"`
+	ActivityType string                 `json:"activity_type"` // login, logout, view, edit, create, delete
+	Description  string                 `json:"description"`
+	Metadata     map[string]interface{} `json:"metadata,omitempty"`
+	IPAddress    string                 `json:"ip_address"`
+	CreatedAt    time.Time              `json:"created_at"`
+	Seq          int64                  `json:"-"` // position in the log; see stream.go
 }
 
 // Invitation represents team/system invitations
 type Invitation struct {
-	ID         string    `json:"id"`
-	Email      string    `json:"email"`
-	TeamID     string    `json:"team_id,omitempty"`
-	RoleID     string    `json:"role_id"`
-	InvitedBy  string    `json:"invited_by"`
-	Token      string    `json:"token"`
-	Status     string    `json:"status"` // pending, accepted, expired, revoked
-	ExpiresAt  time.Time `json:"expires_at"`
+	ID         string     `json:"id"`
+	Email      string     `json:"email" binding:"required,email"`
+	TeamID     string     `json:"team_id,omitempty"`
+	RoleID     string     `json:"role_id"`
+	InvitedBy  string     `json:"invited_by"`
+	Token      string     `json:"token"`
+	Status     string     `json:"status"` // pending, accepted, expired, revoked
+	ExpiresAt  time.Time  `json:"expires_at"`
 	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
-	CreatedAt  time.Time `json:"created_at"`
+	CreatedAt  time.Time  `json:"created_at"`
 }
 
 // Permission represents individual permissions
 type Permission struct {
 	ID          string    `json:"id"`
 	Name        string    `json:"name"`
-	Resource    string    `json:"resource"`
-	Action      string    `json:"action"` // create, read, update, delete, manage
+	Resource    string    `json:"resource" binding:"required"`
+	Action      string    `json:"action" binding:"required"` // create, read, update, delete, manage
 	Description string    `json:"description"`
 	CreatedAt   time.Time `json:"created_at"`
 }
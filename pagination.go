@@ -0,0 +1,531 @@
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// fieldKind is the type of a listField's values
+type fieldKind int
+
+const (
+	kindString fieldKind = iota
+	kindBool
+	kindTime
+	kindInt
+)
+
+// listField is a model field that list endpoints can filter or sort on
+type listField[T any] struct {
+	column string // SQL column
+	kind   fieldKind
+	value  func(item T) interface{} // string, bool, time.Time or int64, per kind
+}
+
+// listSpec declares how a list endpoint may be filtered and sorted
+type listSpec[T any] struct {
+	fields      map[string]listField[T]
+	filters     []string // fields accepted as ?<field>=<value>
+	prefixes    []string // string filters that also accept ?<field>=<prefix>*
+	sorts       []string // fields accepted as ?sort=<field> or ?sort=-<field>
+	defaultSort string
+	created     string // time field compared by ?created_after and ?created_before
+	id          func(item T) string
+
+	// Text searched case-insensitively by ?q=, and the SQL expression for
+	// it, overridden per dialect in searchColumns where they differ
+	search        func(item T) string
+	searchColumn  string
+	searchColumns map[sqlDialect]string
+}
+
+// listFilter restricts a list to items whose field equals value, or
+// starts with it if prefix is set
+type listFilter struct {
+	field  string
+	value  interface{}
+	prefix bool
+}
+
+// listQuery selects one page of a list. Items are ordered by the sort
+// field and then by ID, so the order is stable and cursors stay valid
+// while items are added or removed.
+type listQuery struct {
+	filters       []listFilter
+	createdAfter  *time.Time
+	createdBefore *time.Time
+	search        string
+	sort          string
+	desc          bool
+	cursor        *pageCursor
+	limit         int
+}
+
+// pageCursor marks the last item of a page. It records the sort it was
+// issued for, so it cannot be replayed against a different ordering.
+type pageCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+// page is the response body of paginated list endpoints
+type page[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	HasMore    bool   `json:"has_more"`
+}
+
+func newPage[T any](items []T, next string) page[T] {
+	if items == nil {
+		items = []T{}
+	}
+	return page[T]{Items: items, NextCursor: next, HasMore: next != ""}
+}
+
+// parseListQuery reads limit, cursor, sort, created_after, created_before,
+// q and the spec's filters from the query string
+func parseListQuery[T any](c *gin.Context, spec listSpec[T]) (listQuery, error) {
+	return parseListValues(c.Request.URL.Query(), spec)
+}
+
+// parseListValues is parseListQuery for parameters from another source,
+// such as the command line
+func parseListValues[T any](params url.Values, spec listSpec[T]) (listQuery, error) {
+	q := listQuery{limit: defaultPageSize, sort: spec.defaultSort}
+
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return q, errors.New("limit must be a positive integer")
+		}
+		q.limit = min(n, maxPageSize)
+	}
+
+	if sort := params.Get("sort"); sort != "" {
+		q.sort, q.desc = strings.CutPrefix(sort, "-")
+		if !slices.Contains(spec.sorts, q.sort) {
+			return q, fmt.Errorf("sort must be one of %s, optionally prefixed with -", strings.Join(spec.sorts, ", "))
+		}
+	}
+
+	for _, name := range spec.filters {
+		if !params.Has(name) {
+			continue
+		}
+		raw := params.Get(name)
+		if prefix, ok := strings.CutSuffix(raw, "*"); ok && slices.Contains(spec.prefixes, name) {
+			q.filters = append(q.filters, listFilter{field: name, value: prefix, prefix: true})
+			continue
+		}
+		value, err := parseFieldValue(spec.fields[name].kind, raw)
+		if err != nil {
+			return q, fmt.Errorf("invalid %s %q", name, raw)
+		}
+		q.filters = append(q.filters, listFilter{field: name, value: value})
+	}
+
+	for param, dst := range map[string]**time.Time{"created_after": &q.createdAfter, "created_before": &q.createdBefore} {
+		raw := params.Get(param)
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return q, fmt.Errorf("%s must be an RFC 3339 timestamp", param)
+		}
+		*dst = &t
+	}
+
+	if spec.search != nil {
+		q.search = params.Get("q")
+	}
+
+	if raw := params.Get("cursor"); raw != "" {
+		cursor, err := decodeCursor(raw)
+		if err != nil || cursor.Sort != q.sortKey() {
+			return q, errors.New("invalid cursor")
+		}
+		if _, err := parseFieldValue(spec.fields[q.sort].kind, cursor.Value); err != nil {
+			return q, errors.New("invalid cursor")
+		}
+		q.cursor = cursor
+	}
+
+	return q, nil
+}
+
+// sortKey is the ?sort value the query was made with
+func (q listQuery) sortKey() string {
+	if q.desc {
+		return "-" + q.sort
+	}
+	return q.sort
+}
+
+func decodeCursor(raw string) (*pageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, err
+	}
+	var cursor pageCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
+func (p *pageCursor) encode() string {
+	data, _ := json.Marshal(p)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func parseFieldValue(kind fieldKind, raw string) (interface{}, error) {
+	switch kind {
+	case kindBool:
+		return strconv.ParseBool(raw)
+	case kindTime:
+		return time.Parse(time.RFC3339Nano, raw)
+	case kindInt:
+		return strconv.ParseInt(raw, 10, 64)
+	}
+	return raw, nil
+}
+
+func formatFieldValue(value interface{}) string {
+	switch v := value.(type) {
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case bool:
+		return strconv.FormatBool(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	}
+	return fmt.Sprint(value)
+}
+
+func compareFieldValues(a, b interface{}) int {
+	switch a := a.(type) {
+	case time.Time:
+		return a.Compare(b.(time.Time))
+	case int64:
+		return cmp.Compare(a, b.(int64))
+	case bool:
+		switch {
+		case a == b.(bool):
+			return 0
+		case !a:
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a.(string), b.(string))
+}
+
+// cursorValue returns the cursor's sort value in the field's type
+func (q listQuery) cursorValue(kind fieldKind) interface{} {
+	value, _ := parseFieldValue(kind, q.cursor.Value)
+	return value
+}
+
+// compare orders two items by the query's sort
+func (spec listSpec[T]) compare(q listQuery, a, b T) int {
+	field := spec.fields[q.sort]
+	c := compareFieldValues(field.value(a), field.value(b))
+	if c == 0 {
+		c = strings.Compare(spec.id(a), spec.id(b))
+	}
+	if q.desc {
+		return -c
+	}
+	return c
+}
+
+// afterCursor reports whether item sorts after the query's cursor
+func (spec listSpec[T]) afterCursor(q listQuery, item T) bool {
+	field := spec.fields[q.sort]
+	c := compareFieldValues(field.value(item), q.cursorValue(field.kind))
+	if c == 0 {
+		c = strings.Compare(spec.id(item), q.cursor.ID)
+	}
+	if q.desc {
+		c = -c
+	}
+	return c > 0
+}
+
+func (spec listSpec[T]) matches(q listQuery, item T) bool {
+	for _, f := range q.filters {
+		value := spec.fields[f.field].value(item)
+		if f.prefix {
+			if !strings.HasPrefix(value.(string), f.value.(string)) {
+				return false
+			}
+		} else if compareFieldValues(value, f.value) != 0 {
+			return false
+		}
+	}
+	if q.search != "" && !strings.Contains(strings.ToLower(spec.search(item)), strings.ToLower(q.search)) {
+		return false
+	}
+	if q.createdAfter != nil || q.createdBefore != nil {
+		created := spec.fields[spec.created].value(item).(time.Time)
+		if q.createdAfter != nil && created.Before(*q.createdAfter) {
+			return false
+		}
+		if q.createdBefore != nil && !created.Before(*q.createdBefore) {
+			return false
+		}
+	}
+	return q.cursor == nil || spec.afterCursor(q, item)
+}
+
+// finish trims items, sorted and fetched with one extra item to detect a
+// following page, to the page size and returns the cursor for the next page
+func (spec listSpec[T]) finish(q listQuery, items []T) ([]T, string) {
+	if len(items) <= q.limit {
+		return items, ""
+	}
+	items = items[:q.limit]
+	return items, spec.cursorAfter(q, items[len(items)-1]).encode()
+}
+
+// cursorAfter returns the cursor that continues q after item
+func (spec listSpec[T]) cursorAfter(q listQuery, item T) *pageCursor {
+	return &pageCursor{
+		Sort:  q.sortKey(),
+		Value: formatFieldValue(spec.fields[q.sort].value(item)),
+		ID:    spec.id(item),
+	}
+}
+
+// paginate applies q to an in-memory collection
+func paginate[T any](items []T, spec listSpec[T], q listQuery) ([]T, string) {
+	var matched []T
+	for _, item := range items {
+		if spec.matches(q, item) {
+			matched = append(matched, item)
+		}
+	}
+	slices.SortFunc(matched, func(a, b T) int { return spec.compare(q, a, b) })
+	if len(matched) > q.limit+1 {
+		matched = matched[:q.limit+1]
+	}
+	return spec.finish(q, matched)
+}
+
+// sqlClauses renders q as WHERE, ORDER BY and LIMIT clauses for a table
+// whose primary key column is id
+func (spec listSpec[T]) sqlClauses(q listQuery, dialect sqlDialect) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	for _, f := range q.filters {
+		if f.prefix {
+			conds = append(conds, spec.fields[f.field].column+` LIKE ? ESCAPE '\'`)
+			args = append(args, escapeLike(f.value.(string))+"%")
+			continue
+		}
+		conds = append(conds, spec.fields[f.field].column+" = ?")
+		args = append(args, f.value)
+	}
+	if q.search != "" {
+		column := spec.searchColumn
+		if c, ok := spec.searchColumns[dialect]; ok {
+			column = c
+		}
+		conds = append(conds, "LOWER("+column+`) LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+escapeLike(strings.ToLower(q.search))+"%")
+	}
+	created := spec.fields[spec.created].column
+	if q.createdAfter != nil {
+		conds = append(conds, created+" >= ?")
+		args = append(args, *q.createdAfter)
+	}
+	if q.createdBefore != nil {
+		conds = append(conds, created+" < ?")
+		args = append(args, *q.createdBefore)
+	}
+
+	field := spec.fields[q.sort]
+	op, dir := ">", "ASC"
+	if q.desc {
+		op, dir = "<", "DESC"
+	}
+	if q.cursor != nil {
+		value := q.cursorValue(field.kind)
+		conds = append(conds, fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND id %[2]s ?))", field.column, op))
+		args = append(args, value, value, q.cursor.ID)
+	}
+
+	var clauses string
+	if len(conds) > 0 {
+		clauses = " WHERE " + strings.Join(conds, " AND ")
+	}
+	clauses += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT ?", field.column, dir, dir)
+	return clauses, append(args, q.limit+1)
+}
+
+// escapeLike escapes the LIKE wildcards in s, using \ as escape character
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// List specs of the paginated endpoints
+
+var userListSpec = listSpec[*User]{
+	fields: map[string]listField[*User]{
+		"email":      {"email", kindString, func(u *User) interface{} { return u.Email }},
+		"username":   {"username", kindString, func(u *User) interface{} { return u.Username }},
+		"role_id":    {"role_id", kindString, func(u *User) interface{} { return u.RoleID }},
+		"team_id":    {"team_id", kindString, func(u *User) interface{} { return u.TeamID }},
+		"is_active":  {"is_active", kindBool, func(u *User) interface{} { return u.IsActive }},
+		"created_at": {"created_at", kindTime, func(u *User) interface{} { return u.CreatedAt }},
+		"updated_at": {"updated_at", kindTime, func(u *User) interface{} { return u.UpdatedAt }},
+	},
+	filters:     []string{"role_id", "team_id", "is_active"},
+	sorts:       []string{"created_at", "updated_at", "email", "username"},
+	defaultSort: "created_at",
+	created:     "created_at",
+	id:          func(u *User) string { return u.ID },
+}
+
+var teamListSpec = listSpec[*Team]{
+	fields: map[string]listField[*Team]{
+		"name":       {"name", kindString, func(t *Team) interface{} { return t.Name }},
+		"owner_id":   {"owner_id", kindString, func(t *Team) interface{} { return t.OwnerID }},
+		"created_at": {"created_at", kindTime, func(t *Team) interface{} { return t.CreatedAt }},
+		"updated_at": {"updated_at", kindTime, func(t *Team) interface{} { return t.UpdatedAt }},
+	},
+	filters:     []string{"owner_id"},
+	sorts:       []string{"created_at", "updated_at", "name"},
+	defaultSort: "created_at",
+	created:     "created_at",
+	id:          func(t *Team) string { return t.ID },
+}
+
+var roleListSpec = listSpec[*Role]{
+	fields: map[string]listField[*Role]{
+		"name":        {"name", kindString, func(r *Role) interface{} { return r.Name }},
+		"require_mfa": {"require_mfa", kindBool, func(r *Role) interface{} { return r.RequireMFA }},
+		"created_at":  {"created_at", kindTime, func(r *Role) interface{} { return r.CreatedAt }},
+	},
+	filters:     []string{"require_mfa"},
+	sorts:       []string{"created_at", "name"},
+	defaultSort: "created_at",
+	created:     "created_at",
+	id:          func(r *Role) string { return r.ID },
+}
+
+var invitationListSpec = listSpec[*Invitation]{
+	fields: map[string]listField[*Invitation]{
+		"email":      {"email", kindString, func(i *Invitation) interface{} { return i.Email }},
+		"team_id":    {"team_id", kindString, func(i *Invitation) interface{} { return i.TeamID }},
+		"role_id":    {"role_id", kindString, func(i *Invitation) interface{} { return i.RoleID }},
+		"invited_by": {"invited_by", kindString, func(i *Invitation) interface{} { return i.InvitedBy }},
+		"status":     {"status", kindString, func(i *Invitation) interface{} { return i.Status }},
+		"expires_at": {"expires_at", kindTime, func(i *Invitation) interface{} { return i.ExpiresAt }},
+		"created_at": {"created_at", kindTime, func(i *Invitation) interface{} { return i.CreatedAt }},
+	},
+	filters:     []string{"team_id", "invited_by", "role_id", "email"},
+	sorts:       []string{"created_at", "expires_at", "email"},
+	defaultSort: "created_at",
+	created:     "created_at",
+	id:          func(i *Invitation) string { return i.ID },
+}
+
+var auditLogListSpec = listSpec[*AuditLog]{
+	fields: map[string]listField[*AuditLog]{
+		"user_id":       {"user_id", kindString, func(l *AuditLog) interface{} { return l.UserID }},
+		"action":        {"action", kindString, func(l *AuditLog) interface{} { return l.Action }},
+		"resource_type": {"resource_type", kindString, func(l *AuditLog) interface{} { return l.ResourceType }},
+		"resource_id":   {"resource_id", kindString, func(l *AuditLog) interface{} { return l.ResourceID }},
+		"status":        {"status", kindString, func(l *AuditLog) interface{} { return l.Status }},
+		"ip_address":    {"ip_address", kindString, func(l *AuditLog) interface{} { return l.IPAddress }},
+		"created_at":    {"created_at", kindTime, func(l *AuditLog) interface{} { return l.CreatedAt }},
+		"seq":           {"seq", kindInt, func(l *AuditLog) interface{} { return l.Seq }}, // streams only
+	},
+	filters:     []string{"user_id", "action", "resource_type", "resource_id", "status", "ip_address"},
+	prefixes:    []string{"action"},
+	sorts:       []string{"created_at"},
+	defaultSort: "created_at",
+	created:     "created_at",
+	id:          func(l *AuditLog) string { return l.ID },
+
+	// Details are searched by their values, at any depth, one at a time:
+	// keys and JSON syntax are not searched, since each backend renders
+	// them differently
+	search: func(l *AuditLog) string {
+		return strings.Join(jsonValues(l.Details, nil), "\n")
+	},
+	searchColumns: map[sqlDialect]string{
+		dialectSQLite: `(SELECT group_concat(CASE type WHEN 'true' THEN 'true' WHEN 'false' THEN 'false' ELSE value END, char(10))
+			FROM json_tree(details) WHERE type NOT IN ('object', 'array', 'null'))`,
+		dialectPostgres: `(SELECT string_agg(v #>> '{}', E'\n') FROM jsonb_path_query(details, 'strict $.**') AS v
+			WHERE jsonb_typeof(v) NOT IN ('object', 'array', 'null'))`,
+	},
+}
+
+// jsonValues appends the strings, numbers and booleans in v, a decoded
+// JSON value, to values in the form the SQL backends render them
+func jsonValues(v interface{}, values []string) []string {
+	switch v := v.(type) {
+	case nil:
+		return values
+	case string:
+		return append(values, v)
+	case bool:
+		return append(values, strconv.FormatBool(v))
+	case float64:
+		return append(values, strconv.FormatFloat(v, 'f', -1, 64))
+	case map[string]interface{}:
+		for _, value := range v {
+			values = jsonValues(value, values)
+		}
+		return values
+	case []interface{}:
+		for _, value := range v {
+			values = jsonValues(value, values)
+		}
+		return values
+	}
+
+	// Details built in Go may hold other types; use their JSON form
+	var decoded interface{}
+	data, err := json.Marshal(v)
+	if err != nil || json.Unmarshal(data, &decoded) != nil {
+		return values
+	}
+	return jsonValues(decoded, values)
+}
+
+var activityLogListSpec = listSpec[*ActivityLog]{
+	fields: map[string]listField[*ActivityLog]{
+		"user_id":       {"user_id", kindString, func(l *ActivityLog) interface{} { return l.UserID }},
+		"activity_type": {"activity_type", kindString, func(l *ActivityLog) interface{} { return l.ActivityType }},
+		"ip_address":    {"ip_address", kindString, func(l *ActivityLog) interface{} { return l.IPAddress }},
+		"created_at":    {"created_at", kindTime, func(l *ActivityLog) interface{} { return l.CreatedAt }},
+		"seq":           {"seq", kindInt, func(l *ActivityLog) interface{} { return l.Seq }}, // streams only
+	},
+	filters:      []string{"user_id", "activity_type", "ip_address"},
+	sorts:        []string{"created_at"},
+	defaultSort:  "created_at",
+	created:      "created_at",
+	id:           func(l *ActivityLog) string { return l.ID },
+	search:       func(l *ActivityLog) string { return l.Description },
+	searchColumn: "description",
+}
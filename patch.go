@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// Media types accepted by the PATCH endpoints
+const (
+	mergePatchType = "application/merge-patch+json" // RFC 7396
+	jsonPatchType  = "application/json-patch+json"  // RFC 6902
+)
+
+// errPatchTestFailed is returned when a JSON Patch "test" operation fails
+var errPatchTestFailed = errors.New("test operation failed")
+
+// applyPatch applies the request body, a merge patch or a JSON patch, to
+// the JSON form of current and decodes the result into patched, which must
+// point to a zero value of the same type. Changes to the readOnly fields
+// (JSON names) are rejected and the result must pass the validation rules.
+// On failure it responds with the error and reports false.
+func applyPatch(c *gin.Context, current, patched interface{}, readOnly ...string) bool {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		respondError(c, badRequest("Invalid request"))
+		return false
+	}
+
+	// Patches modify doc in place, so keep a separate copy to compare with
+	var doc interface{}
+	var original map[string]interface{}
+	if err := roundTripJSON(current, &doc); err != nil {
+		respondError(c, err)
+		return false
+	}
+	if err := roundTripJSON(current, &original); err != nil {
+		respondError(c, err)
+		return false
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(c.ContentType())
+	switch mediaType {
+	case mergePatchType:
+		var patch interface{}
+		if err := json.Unmarshal(body, &patch); err != nil {
+			respondError(c, badRequest("Invalid merge patch"))
+			return false
+		}
+		doc = mergePatch(doc, patch)
+	case jsonPatchType:
+		var ops []patchOperation
+		if err := json.Unmarshal(body, &ops); err != nil {
+			respondError(c, badRequest("Invalid JSON patch"))
+			return false
+		}
+		if doc, err = applyJSONPatch(doc, ops); err != nil {
+			if errors.Is(err, errPatchTestFailed) {
+				respondError(c, &ConflictError{Detail: err.Error()})
+			} else {
+				respondError(c, &ValidationError{Detail: err.Error()})
+			}
+			return false
+		}
+	default:
+		respondError(c, &statusError{
+			Status: http.StatusUnsupportedMediaType,
+			Detail: "PATCH requires " + mergePatchType + " or " + jsonPatchType,
+		})
+		return false
+	}
+
+	after, ok := doc.(map[string]interface{})
+	if !ok {
+		respondError(c, &ValidationError{Detail: "patched document must be an object"})
+		return false
+	}
+	var fields []fieldError
+	for _, name := range readOnly {
+		if !reflect.DeepEqual(original[name], after[name]) {
+			fields = append(fields, fieldError{Field: name, Rule: "readonly", Message: ruleMessages["readonly"]})
+		}
+	}
+	if len(fields) > 0 {
+		respondError(c, &ValidationError{Fields: fields})
+		return false
+	}
+
+	if err := roundTripJSON(after, patched); err != nil {
+		respondError(c, &ValidationError{Detail: err.Error()})
+		return false
+	}
+	if err := binding.Validator.ValidateStruct(patched); err != nil {
+		var invalid validator.ValidationErrors
+		if errors.As(err, &invalid) {
+			err = validationFailure(invalid)
+		}
+		respondError(c, err)
+		return false
+	}
+	return true
+}
+
+// roundTripJSON copies from into to through their JSON encoding
+func roundTripJSON(from, to interface{}) error {
+	data, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, to)
+}
+
+// mergePatch applies an RFC 7396 merge patch: objects are merged key by
+// key, null removes a key and any other value replaces the target
+func mergePatch(target, patch interface{}) interface{} {
+	fields, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	doc, ok := target.(map[string]interface{})
+	if !ok {
+		doc = map[string]interface{}{}
+	}
+	for key, value := range fields {
+		if value == nil {
+			delete(doc, key)
+		} else {
+			doc[key] = mergePatch(doc[key], value)
+		}
+	}
+	return doc
+}
+
+// patchOperation is one operation of an RFC 6902 JSON patch
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// applyJSONPatch applies ops in order, failing on the first that cannot be
+// applied
+func applyJSONPatch(doc interface{}, ops []patchOperation) (interface{}, error) {
+	for i, op := range ops {
+		var err error
+		if doc, err = applyPatchOperation(doc, op); err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+func applyPatchOperation(doc interface{}, op patchOperation) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, errors.New("missing value")
+		}
+		if err := json.Unmarshal(op.Value, &value); err != nil {
+			return nil, err
+		}
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if value, err = pointerGet(doc, from); err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			if strings.HasPrefix(op.Path, op.From+"/") {
+				return nil, errors.New("cannot move a value into itself")
+			}
+			if doc, err = pointerRemove(doc, from); err != nil {
+				return nil, err
+			}
+		} else {
+			var duplicate interface{}
+			if err := roundTripJSON(value, &duplicate); err != nil {
+				return nil, err
+			}
+			value = duplicate
+		}
+	}
+
+	switch op.Op {
+	case "add", "move", "copy":
+		return pointerAdd(doc, path, value)
+	case "remove":
+		return pointerRemove(doc, path)
+	case "replace":
+		if _, err := pointerGet(doc, path); err != nil {
+			return nil, err
+		}
+		if doc, err = pointerRemove(doc, path); err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, value)
+	case "test":
+		actual, err := pointerGet(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(actual, value) {
+			return nil, errPatchTestFailed
+		}
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("unknown op %q", op.Op)
+	}
+}
+
+// parsePointer splits an RFC 6901 JSON pointer into unescaped tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses an array index token; "-" (one past the end) is only
+// valid when appending
+func arrayIndex(token string, length int, appending bool) (int, error) {
+	if token == "-" && appending {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > length || (i == length && !appending) ||
+		(len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	return i, nil
+}
+
+func pointerGet(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("path /%s not found", strings.Join(path, "/"))
+			}
+			doc = value
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, fmt.Errorf("path /%s not found", strings.Join(path, "/"))
+		}
+	}
+	return doc, nil
+}
+
+// updateParent applies fn to the container holding the last token of path
+// and returns the document with the updated container in place
+func updateParent(doc interface{}, path []string, fn func(parent interface{}, key string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		child, ok := node[path[0]]
+		if !ok {
+			return nil, fmt.Errorf("path segment %q not found", path[0])
+		}
+		updated, err := updateParent(child, path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		node[path[0]] = updated
+		return node, nil
+	case []interface{}:
+		i, err := arrayIndex(path[0], len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := updateParent(node[i], path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = updated
+		return node, nil
+	default:
+		return nil, fmt.Errorf("path segment %q not found", path[0])
+	}
+}
+
+func pointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return updateParent(doc, path, func(parent interface{}, key string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[key] = value
+			return node, nil
+		case []interface{}:
+			i, err := arrayIndex(key, len(node), true)
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = value
+			return node, nil
+		default:
+			return nil, fmt.Errorf("cannot add %q to a scalar", key)
+		}
+	})
+}
+
+func pointerRemove(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, errors.New("cannot remove the whole document")
+	}
+	return updateParent(doc, path, func(parent interface{}, key string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := node[key]; !ok {
+				return nil, fmt.Errorf("path segment %q not found", key)
+			}
+			delete(node, key)
+			return node, nil
+		case []interface{}:
+			i, err := arrayIndex(key, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(node[:i], node[i+1:]...), nil
+		default:
+			return nil, fmt.Errorf("path segment %q not found", key)
+		}
+	})
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Default roles created by seedDefaults
+const (
+	adminRoleID   = "role-1"
+	defaultRoleID = "role-2"
+)
+
+// permissionGrant is one permission string held by a user, together with
+// the role or UserPermission it came from
+type permissionGrant struct {
+	Permission string `json:"permission"`
+	Source     string `json:"source"` // role, user_permission
+	SourceID   string `json:"source_id"`
+	SourceName string `json:"source_name"` // role name or catalogue permission name
+}
+
+// effectivePermissions combines the user's role permissions with the
+// catalogue permissions granted to them individually
+func effectivePermissions(user *User) ([]permissionGrant, error) {
+	var grants []permissionGrant
+	if user.RoleID != "" {
+		if role, err := store.Roles().Get(user.RoleID); err == nil {
+			for _, p := range role.Permissions {
+				grants = append(grants, permissionGrant{Permission: p, Source: "role", SourceID: role.ID, SourceName: role.Name})
+			}
+		}
+	}
+
+	userPerms, err := store.Permissions().UserGrants(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, up := range userPerms {
+		perm, err := store.Permissions().Get(up.PermissionID)
+		if err != nil {
+			// The permission was removed from the catalogue
+			continue
+		}
+		grants = append(grants, permissionGrant{
+			Permission: perm.Resource + "." + perm.Action,
+			Source:     "user_permission",
+			SourceID:   up.ID,
+			SourceName: perm.Name,
+		})
+	}
+	return grants, nil
+}
+
+// grantMatches reports whether a permission string covers action on
+// resource. Supported forms are "*", "<resource>.<action>" (either part
+// may be "*"), and an ":own" suffix restricting the grant to resources the
+// caller owns; "<action>:own" is shorthand for "*.<action>:own".
+func grantMatches(permission, resource, action string, owned bool) bool {
+	if permission == "*" {
+		return true
+	}
+
+	scope, ownOnly := strings.CutSuffix(permission, ":own")
+	if ownOnly && !owned {
+		return false
+	}
+
+	grantedResource, grantedAction, ok := strings.Cut(scope, ".")
+	if !ok {
+		if !ownOnly {
+			return false
+		}
+		grantedResource, grantedAction = "*", scope
+	}
+
+	return (grantedResource == "*" || grantedResource == resource) && actionImplies(grantedAction, action)
+}
+
+// actionImplies reports whether holding granted allows action; "manage"
+// allows every action and "write" allows create, update and delete
+func actionImplies(granted, action string) bool {
+	switch granted {
+	case "*", "manage", action:
+		return true
+	case "write":
+		return action == "create" || action == "update" || action == "delete"
+	}
+	return false
+}
+
+// checkPermission returns the first grant allowing user to perform action
+// on resource, or nil if none does. ownerID is the user owning the target
+// resource, used for ":own" grants; pass "" when there is no single owner.
+func checkPermission(user *User, resource, action, ownerID string) (*permissionGrant, error) {
+	grants, err := effectivePermissions(user)
+	if err != nil {
+		return nil, err
+	}
+
+	owned := ownerID != "" && ownerID == user.ID
+	for i := range grants {
+		if grantMatches(grants[i].Permission, resource, action, owned) {
+			return &grants[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// callerCan reports whether the authenticated caller may perform action
+// on any resource of the given type, regardless of ownership
+func callerCan(c *gin.Context, resource, action string) bool {
+	user := currentUser(c)
+	if user == nil {
+		return false
+	}
+	grant, err := checkPermission(user, resource, action, "")
+	return err == nil && grant != nil
+}
+
+// ownerResolver returns the ID of the user owning the resource a request
+// targets, or "" if it cannot be determined
+type ownerResolver func(c *gin.Context) string
+
+// requirePermission aborts with 403 unless the caller holds permission,
+// written "<resource>.<action>". If owner is given, ":own" grants are
+// honoured when the caller owns the target resource.
+func requirePermission(permission string, owner ownerResolver) gin.HandlerFunc {
+	resource, action, _ := strings.Cut(permission, ".")
+
+	return func(c *gin.Context) {
+		c.Set(contextPermissionKey, permission)
+		user := currentUser(c)
+		if user == nil {
+			respondError(c, unauthorized("Authentication required"))
+			return
+		}
+
+		ownerID := ""
+		if owner != nil {
+			ownerID = owner(c)
+		}
+
+		grant, err := checkPermission(user, resource, action, ownerID)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		if grant == nil {
+			respondError(c, &ForbiddenError{Detail: "Missing permission " + permission})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// ownerParam treats a path parameter as the owning user's ID
+func ownerParam(name string) ownerResolver {
+	return func(c *gin.Context) string {
+		return c.Param(name)
+	}
+}
+
+// ownerQuery treats a query parameter as the owning user's ID
+func ownerQuery(name string) ownerResolver {
+	return func(c *gin.Context) string {
+		return c.Query(name)
+	}
+}
+
+// ownerBodyField reads the owning user's ID from a JSON body field,
+// leaving the body intact for the handler
+func ownerBodyField(field string) ownerResolver {
+	return func(c *gin.Context) string {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			return ""
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		var fields map[string]interface{}
+		if err := json.Unmarshal(body, &fields); err != nil {
+			return ""
+		}
+		owner, _ := fields[field].(string)
+		return owner
+	}
+}
+
+// resourceOwner returns the ID of the user owning a resource, or "" if
+// the resource has no single owner. Profiles, preferences and activity
+// logs are addressed by their user's ID, sessions and invitations by token.
+func resourceOwner(resourceType, resourceID string) string {
+	switch resourceType {
+	case "users", "profiles", "preferences", "activity_logs":
+		return resourceID
+	case "teams":
+		if team, err := store.Teams().Get(resourceID); err == nil {
+			return team.OwnerID
+		}
+	case "sessions":
+		if session, err := store.Sessions().GetByToken(resourceID); err == nil {
+			return session.UserID
+		}
+	case "invitations":
+		invitation, err := store.Invitations().GetByToken(resourceID)
+		if err != nil {
+			return ""
+		}
+		if user, err := store.Users().GetByEmail(invitation.Email); err == nil {
+			return user.ID
+		}
+	}
+	return ""
+}
+
+// resourceParam resolves the owner of the resourceType named by a path
+// parameter
+func resourceParam(resourceType, name string) ownerResolver {
+	return func(c *gin.Context) string {
+		return resourceOwner(resourceType, c.Param(name))
+	}
+}
+
+// accessDecision explains the outcome of an access check
+type accessDecision struct {
+	Allowed bool             `json:"allowed"`
+	Reason  string           `json:"reason"`
+	Matched *permissionGrant `json:"matched,omitempty"`
+}
+
+// checkAccess decides whether userID may perform action on the resource
+// identified by resourceType and resourceID (which may be empty)
+func checkAccess(userID, resourceType, resourceID, action string) (*accessDecision, error) {
+	user, err := store.Users().Get(userID)
+	if err != nil {
+		return &accessDecision{Reason: "user not found"}, nil
+	}
+	if !user.IsActive {
+		return &accessDecision{Reason: "user is inactive"}, nil
+	}
+
+	ownerID := ""
+	if resourceID != "" {
+		ownerID = resourceOwner(resourceType, resourceID)
+	}
+
+	grant, err := checkPermission(user, resourceType, action, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	if grant == nil {
+		return &accessDecision{
+			Reason: fmt.Sprintf("no role permission or user grant allows %s.%s", resourceType, action),
+		}, nil
+	}
+
+	var reason string
+	if grant.Source == "role" {
+		reason = fmt.Sprintf("role %q (%s) grants %q", grant.SourceName, grant.SourceID, grant.Permission)
+	} else {
+		reason = fmt.Sprintf("user permission %s grants %q (%s)", grant.SourceID, grant.Permission, grant.SourceName)
+	}
+	if strings.HasSuffix(grant.Permission, ":own") {
+		reason += " on a resource the user owns"
+	}
+	return &accessDecision{Allowed: true, Reason: reason, Matched: grant}, nil
+}
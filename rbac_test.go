@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestOwnGrants checks that the default role's ":own" grants allow a user
+// to act on what they own and nothing else
+func TestOwnGrants(t *testing.T) {
+	router := newTestServer(t)
+	admin := loginAdmin(t, router)
+	aliceID, alice := loginNewUser(t, router, admin, "alice")
+	bobID, _ := loginNewUser(t, router, admin, "bob")
+
+	expires := time.Now().Add(time.Hour)
+	for _, owner := range []struct{ id, name string }{{aliceID, "alice"}, {bobID, "bob"}} {
+		if err := store.Teams().Create(&Team{ID: "team-" + owner.name, Name: owner.name, OwnerID: owner.id}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Sessions().Create(&Session{ID: "session-" + owner.name, UserID: owner.id, Token: "token-" + owner.name, Kind: "session", ExpiresAt: expires}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Invitations().Create(&Invitation{ID: "invitation-" + owner.name, Email: owner.name + "@example.test", RoleID: defaultRoleID, Token: "invite-" + owner.name, Status: "pending", ExpiresAt: expires}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		resourceType, resourceID, want string
+	}{
+		{"users", aliceID, aliceID},
+		{"profiles", bobID, bobID},
+		{"teams", "team-alice", aliceID},
+		{"teams", "team-bob", bobID},
+		{"teams", "team-unknown", ""},
+		{"sessions", "token-alice", aliceID},
+		{"sessions", "token-bob", bobID},
+		{"sessions", "token-unknown", ""},
+		{"invitations", "invite-alice", aliceID},
+		{"invitations", "invite-bob", bobID},
+		{"invitations", "invite-unknown", ""},
+		{"roles", defaultRoleID, ""},
+	} {
+		if got := resourceOwner(tc.resourceType, tc.resourceID); got != tc.want {
+			t.Errorf("resourceOwner(%s, %s) = %q, want %q", tc.resourceType, tc.resourceID, got, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		method, path string
+		body         gin.H
+		want         int
+	}{
+		{http.MethodGet, "/users/" + aliceID, nil, http.StatusOK},
+		{http.MethodGet, "/users/" + bobID, nil, http.StatusForbidden},
+		{http.MethodPut, "/teams/team-alice", gin.H{"name": "Renamed"}, http.StatusOK},
+		{http.MethodPut, "/teams/team-bob", gin.H{"name": "Renamed"}, http.StatusForbidden},
+		{http.MethodGet, "/sessions/user/" + aliceID, nil, http.StatusOK},
+		{http.MethodGet, "/sessions/user/" + bobID, nil, http.StatusForbidden},
+		{http.MethodDelete, "/sessions/token-bob", nil, http.StatusForbidden},
+		{http.MethodDelete, "/sessions/token-alice", nil, http.StatusOK},
+		{http.MethodDelete, "/invitations/invite-bob", nil, http.StatusForbidden},
+		{http.MethodDelete, "/invitations/invite-alice", nil, http.StatusOK},
+		// ownerBodyField reads the owner from the body and leaves it for the handler
+		{http.MethodPost, "/profiles", gin.H{"user_id": bobID}, http.StatusForbidden},
+		{http.MethodPost, "/profiles", gin.H{"user_id": aliceID, "bio": "Hello"}, http.StatusCreated},
+		{http.MethodPost, "/preferences", gin.H{"user_id": bobID}, http.StatusForbidden},
+		// Not owned by anyone, so ":own" grants never apply
+		{http.MethodGet, "/roles/" + defaultRoleID, nil, http.StatusForbidden},
+	} {
+		if w := serve(router, tc.method, tc.path, alice, tc.body); w.Code != tc.want {
+			t.Errorf("%s %s: got %d %s, want %d", tc.method, tc.path, w.Code, w.Body, tc.want)
+		}
+	}
+
+	if profile, err := store.Profiles().GetByUserID(aliceID); err != nil || profile.Bio != "Hello" {
+		t.Errorf("profile created through ownerBodyField: %+v, %v", profile, err)
+	}
+}
+
+func TestGrantMatches(t *testing.T) {
+	for _, tc := range []struct {
+		permission, resource, action string
+		owned, want                  bool
+	}{
+		{"*", "users", "delete", false, true},
+		{"read:own", "sessions", "read", true, true},
+		{"read:own", "sessions", "read", false, false},
+		{"write:own", "invitations", "delete", true, true},
+		{"write:own", "invitations", "read", true, false},
+		{"teams.update:own", "teams", "update", true, true},
+		{"teams.update:own", "teams", "update", false, false},
+		{"teams.update:own", "users", "update", true, false},
+		{"teams.manage", "teams", "delete", false, true},
+		{"update", "teams", "update", false, false},
+	} {
+		if got := grantMatches(tc.permission, tc.resource, tc.action, tc.owned); got != tc.want {
+			t.Errorf("grantMatches(%q, %s, %s, owned %v) = %v, want %v", tc.permission, tc.resource, tc.action, tc.owned, got, tc.want)
+		}
+	}
+}
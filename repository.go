@@ -2,473 +2,277 @@ package main
 
 import (
 	"errors"
-	"sync"
+	"fmt"
 	"time"
 )
 
-// In-memory storage for demonstration purposes
-var (
-	users           = make(map[string]*User)
-	roles           = make(map[string]*Role)
-	profiles        = make(map[string]*UserProfile)
-	teams           = make(map[string]*Team)
-	teamMembers     = make(map[string][]*TeamMember)
-	auditLogs       = []*AuditLog{}
-	passwordResets  = make(map[string]*PasswordReset)
-	sessions        = make(map[string]*Session)
-	preferences     = make(map[string]*UserPreferences)
-	activityLogs    = []*ActivityLog{}
-	invitations     = make(map[string]*Invitation)
-	permissions     = make(map[string]*Permission)
-	userPermissions = make(map[string][]*UserPermission)
-
-	mu sync.RWMutex
-)
-
-// Initialize with default data
-func initializeData() {
-	// Default roles
-	adminRole := &Role{
-		ID:          "role-1",
-		Name:        "Admin",
-		Description: "Full system access",
-		Permissions: []string{"*"},
-		CreatedAt:   time.Now(),
-	}
-	userRole := &Role{
-		ID:          "role-2",
-		Name:        "User",
-		Description: "Standard user access",
-		Permissions: []string{"read:own", "write:own"},
-		CreatedAt:   time.Now(),
-	}
-	roles[adminRole.ID] = adminRole
-	roles[userRole.ID] = userRole
-
-	// Default permissions
-	defaultPerms := []*Permission{
-		{ID: "perm-1", Name: "users.create", Resource: "users", Action: "create", Description: "Create new users", CreatedAt: time.Now()},
-		{ID: "perm-2", Name: "users.read", Resource: "users", Action: "read", Description: "View users", CreatedAt: time.Now()},
-		{ID: "perm-3", Name: "users.update", Resource: "users", Action: "update", Description: "Update users", CreatedAt: time.Now()},
-		{ID: "perm-4", Name: "users.delete", Resource: "users", Action: "delete", Description: "Delete users", CreatedAt: time.Now()},
-		{ID: "perm-5", Name: "teams.manage", Resource: "teams", Action: "manage", Description: "Manage teams", CreatedAt: time.Now()},
-	}
-	for _, p := range defaultPerms {
-		permissions[p.ID] = p
-	}
-}
-
-// UserRepository methods
-func createUser(user *User) error {
-	mu.Lock()
-	defer mu.Unlock()
-
-	if _, exists := users[user.ID]; exists {
-		return errors.New("user already exists")
-	}
-
-	user.CreatedAt = time.Now()
-	user.UpdatedAt = time.Now()
-	users[user.ID] = user
-	return nil
-}
-
-func getUser(id string) (*User, error) {
-	mu.RLock()
-	defer mu.RUnlock()
-
-	user, exists := users[id]
-	if !exists {
-		return nil, errors.New("user not found")
-	}
-	return user, nil
-}
-
-func getAllUsers() []*User {
-	mu.RLock()
-	defer mu.RUnlock()
-
-	userList := make([]*User, 0, len(users))
-	for _, user := range users {
-		userList = append(userList, user)
-	}
-	return userList
+// Versioned resources (users, roles, profiles, teams and preferences) carry
+// a Version that every change increments. Their Update methods fail with a
+// VersionMismatchError unless the given resource has the stored Version,
+// so that a write based on a stale read is never applied.
+//
+// Records returned by a repository belong to the caller, and a record passed
+// to a write still belongs to the caller afterwards: implementations never
+// keep or hand out references to their own state.
+
+// UserRepository persists users
+type UserRepository interface {
+	Create(user *User) error
+	Get(id string) (*User, error)
+	GetByEmail(email string) (*User, error)
+	GetByUsername(username string) (*User, error)
+	List() ([]*User, error)
+	ListPage(q listQuery) ([]*User, string, error)
+	Update(id string, user *User) error
+	// Delete removes the user together with the data that only exists for
+	// them: profile, preferences, sessions, password resets, permission
+	// grants, MFA enrollment and team memberships. Audit and activity logs
+	// are kept.
+	Delete(id string) error
+}
+
+// RoleRepository persists RBAC roles
+type RoleRepository interface {
+	Create(role *Role) error
+	Get(id string) (*Role, error)
+	List() ([]*Role, error)
+	ListPage(q listQuery) ([]*Role, string, error)
+	Update(id string, role *Role) error
+	SetRequireMFA(id string, required bool) error
+	Delete(id string) error
+}
+
+// ProfileRepository persists extended user profiles
+type ProfileRepository interface {
+	// Create fails with a ConflictError if the user already has a profile
+	Create(profile *UserProfile) error
+	GetByUserID(userID string) (*UserProfile, error)
+	Update(id string, profile *UserProfile) error
+	DeleteByUserID(userID string) error
+}
+
+// TeamRepository persists teams and their members
+type TeamRepository interface {
+	Create(team *Team) error
+	Get(id string) (*Team, error)
+	List() ([]*Team, error)
+	ListPage(q listQuery) ([]*Team, string, error)
+	Update(id string, team *Team) error
+	// Delete removes the team and its memberships, clears User.TeamID for
+	// users assigned to it and revokes its pending invitations
+	Delete(id string) error
+	// AddMember fails with a NotFoundError unless the team and user exist,
+	// and a ConflictError if the user is already a member. It sets the
+	// user's TeamID to the team.
+	AddMember(member *TeamMember) error
+	// RemoveMember also clears the user's TeamID if it points at the team
+	RemoveMember(teamID, userID string) error
+	Members(teamID string) ([]*TeamMember, error)
+}
+
+// AuditLogRepository persists the system audit trail
+type AuditLogRepository interface {
+	// Create links the entry into the hash chain, setting its CreatedAt,
+	// PrevHash and Hash
+	Create(log *AuditLog) error
+	ListPage(q listQuery) ([]*AuditLog, string, error)
+	// Walk calls fn with every entry in chain order, oldest first
+	Walk(fn func(log *AuditLog) error) error
+	// Head returns the newest entry, or nil if the log is empty
+	Head() (*AuditLog, error)
+	CreateCheckpoint(cp *AuditCheckpoint) error
+	// Checkpoints returns every checkpoint, oldest first
+	Checkpoints() ([]*AuditCheckpoint, error)
+	// ChainStart returns the seq of the first entry that was written with a
+	// hash; entries before it predate the hash chain
+	ChainStart() (int64, error)
+	// Prune drops the oldest entries that policy no longer retains, after
+	// passing them to archive if it is not nil, and returns how many it
+	// dropped. Entries that could not be archived are kept.
+	Prune(policy retentionPolicy, archive func([]*AuditLog) error) (int, error)
+}
+
+// PasswordResetRepository persists password reset tokens
+type PasswordResetRepository interface {
+	Create(reset *PasswordReset) error
+	GetByToken(token string) (*PasswordReset, error)
+	// MarkUsed marks a token used, failing with errResetTokenUsed if it
+	// already was, so that a token cannot be redeemed twice
+	MarkUsed(token string) error
+}
+
+// SessionRepository persists user sessions
+type SessionRepository interface {
+	Create(session *Session) error
+	GetByToken(token string) (*Session, error)
+	ListByUser(userID string) ([]*Session, error)
+	Touch(token string, at time.Time) error
+	// Revoke marks a session revoked, failing with errSessionRevoked if it
+	// already was, so that concurrent refresh token rotations cannot both win
+	Revoke(token string, at time.Time) error
+	RevokeFamily(familyID string, at time.Time) error
+	// RevokeUser revokes every session and refresh token of a user
+	RevokeUser(userID string, at time.Time) error
+	Delete(token string) error
+}
+
+// PreferencesRepository persists user preferences
+type PreferencesRepository interface {
+	Create(prefs *UserPreferences) error
+	GetByUserID(userID string) (*UserPreferences, error)
+	Update(userID string, prefs *UserPreferences) error
+	Delete(userID string) error
+}
+
+// ActivityLogRepository persists user activity tracking
+type ActivityLogRepository interface {
+	Create(log *ActivityLog) error
+	ListByUser(userID string, limit int) ([]*ActivityLog, error)
+	ListPage(q listQuery) ([]*ActivityLog, string, error)
+	// Prune works like AuditLogRepository.Prune
+	Prune(policy retentionPolicy, archive func([]*ActivityLog) error) (int, error)
+}
+
+// InvitationRepository persists team/system invitations
+type InvitationRepository interface {
+	Create(invitation *Invitation) error
+	GetByToken(token string) (*Invitation, error)
+	// UpdateStatus moves a pending invitation to status, failing with
+	// invitationProcessed if it is no longer pending, so that concurrent
+	// requests cannot both accept or revoke it
+	UpdateStatus(token string, status string) error
+	ListPage(q listQuery) ([]*Invitation, string, error)
+}
+
+// PermissionRepository persists the permission catalogue and user grants
+type PermissionRepository interface {
+	Create(perm *Permission) error
+	Get(id string) (*Permission, error)
+	List() ([]*Permission, error)
+	Update(id string, perm *Permission) error
+	// Delete removes the permission and every grant of it
+	Delete(id string) error
+	// Grant fails with a NotFoundError for an unknown user and with
+	// alreadyGranted if the user already holds the permission
+	Grant(userPerm *UserPermission) error
+	UserGrants(userID string) ([]*UserPermission, error)
+	Revoke(userID, permissionID string) error
+}
+
+// MFARepository persists TOTP enrollments, at most one per user
+type MFARepository interface {
+	Get(userID string) (*MFACredential, error)
+	Save(cred *MFACredential) error // creates or replaces
+	// Use saves cred after one of its codes was accepted, failing with
+	// errMFACodeUsed if another request has used the credential since it
+	// was read as read, so that a code is only ever accepted once
+	Use(cred, read *MFACredential) error
+	Delete(userID string) error
 }
 
-func updateUser(id string, updatedUser *User) error {
-	mu.Lock()
-	defer mu.Unlock()
-
-	if _, exists := users[id]; !exists {
-		return errors.New("user not found")
-	}
-
-	updatedUser.UpdatedAt = time.Now()
-	users[id] = updatedUser
-	return nil
-}
-
-// RoleRepository methods
-func getRole(id string) (*Role, error) {
-	mu.RLock()
-	defer mu.RUnlock()
+var (
+	errSessionRevoked = errors.New("session already revoked")
+	errResetTokenUsed = errors.New("reset token already used")
+	errMFACodeUsed    = errors.New("MFA code already used")
+)
 
-	role, exists := roles[id]
-	if !exists {
-		return nil, errors.New("role not found")
+// Store groups the repositories handlers depend on
+type Store interface {
+	Users() UserRepository
+	Roles() RoleRepository
+	Profiles() ProfileRepository
+	Teams() TeamRepository
+	AuditLogs() AuditLogRepository
+	PasswordResets() PasswordResetRepository
+	Sessions() SessionRepository
+	Preferences() PreferencesRepository
+	ActivityLogs() ActivityLogRepository
+	Invitations() InvitationRepository
+	Permissions() PermissionRepository
+	MFA() MFARepository
+
+	// WithinTx runs fn against a Store whose writes are committed together,
+	// or rolled back if fn returns an error. The memory store rolls back,
+	// but does not hide the writes from other requests until then.
+	WithinTx(fn func(tx Store) error) error
+	Close() error
+}
+
+// store is the backend used by all handlers; tests may replace it with a fake
+var store Store
+
+// openStore creates the storage backend selected in the configuration
+func openStore(cfg Config) (Store, error) {
+	switch cfg.StorageDriver {
+	case "", "memory":
+		return newMemoryStore(), nil
+	case "sqlite":
+		return openSQLiteStore(cfg)
+	case "postgres":
+		return openPostgresStore(cfg)
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", cfg.StorageDriver)
 	}
-	return role, nil
 }
 
-func getAllRoles() []*Role {
-	mu.RLock()
-	defer mu.RUnlock()
-
-	roleList := make([]*Role, 0, len(roles))
-	for _, role := range roles {
-		roleList = append(roleList, role)
+// seedDefaults creates the default roles, permissions and bootstrap
+// administrator if they are missing
+func seedDefaults(s Store, cfg Config) error {
+	// Default roles
+	defaultRoles := []*Role{
+		{ID: adminRoleID, Name: "Admin", Description: "Full system access", Permissions: []string{"*"}},
+		{ID: defaultRoleID, Name: "User", Description: "Standard user access", Permissions: []string{"read:own", "write:own"}},
 	}
-	return roleList
-}
-
-func createRole(role *Role) error {
-	mu.Lock()
-	defer mu.Unlock()
-
-	role.CreatedAt = time.Now()
-	roles[role.ID] = role
-	return nil
-}
-
-// ProfileRepository methods
-func createProfile(profile *UserProfile) error {
-	mu.Lock()
-	defer mu.Unlock()
-
-	profile.UpdatedAt = time.Now()
-	profiles[profile.ID] = profile
-	return nil
-}
-
-func getProfileByUserID(userID string) (*UserProfile, error) {
-	mu.RLock()
-	defer mu.RUnlock()
-
-	for _, profile := range profiles {
-		if profile.UserID == userID {
-			return profile, nil
+	for _, r := range defaultRoles {
+		if _, err := s.Roles().Get(r.ID); err == nil {
+			continue
 		}
-	}
-	return nil, errors.New("profile not found")
-}
-
-func updateProfile(id string, updatedProfile *UserProfile) error {
-	mu.Lock()
-	defer mu.Unlock()
-
-	updatedProfile.UpdatedAt = time.Now()
-	profiles[id] = updatedProfile
-	return nil
-}
-
-// TeamRepository methods
-func createTeam(team *Team) error {
-	mu.Lock()
-	defer mu.Unlock()
-
-	team.CreatedAt = time.Now()
-	team.UpdatedAt = time.Now()
-	teams[team.ID] = team
-	return nil
-}
-
-func getTeam(id string) (*Team, error) {
-	mu.RLock()
-	defer mu.RUnlock()
-
-	team, exists := teams[id]
-	if !exists {
-		return nil, errors.New("team not found")
-	}
-	return team, nil
-}
-
-func getAllTeams() []*Team {
-	mu.RLock()
-	defer mu.RUnlock()
-
-	teamList := make([]*Team, 0, len(teams))
-	for _, team := range teams {
-		teamList = append(teamList, team)
-	}
-	return teamList
-}
-
-func addTeamMember(member *TeamMember) error {
-	mu.Lock()
-	defer mu.Unlock()
-
-	member.JoinedAt = time.Now()
-	teamMembers[member.TeamID] = append(teamMembers[member.TeamID], member)
-
-	// Update team member count
-	if team, exists := teams[member.TeamID]; exists {
-		team.MemberCount++
-		team.UpdatedAt = time.Now()
-	}
-
-	return nil
-}
-
-func getTeamMembers(teamID string) []*TeamMember {
-	mu.RLock()
-	defer mu.RUnlock()
-
-	return teamMembers[teamID]
-}
-
-// AuditLogRepository methods
-func createAuditLog(log *AuditLog) error {
-	mu.Lock()
-	defer mu.Unlock()
-
-	log.CreatedAt = time.Now()
-	auditLogs = append(auditLogs, log)
-	return nil
-}
-
-func getAuditLogs(limit int) []*AuditLog {
-	mu.RLock()
-	defer mu.RUnlock()
-
-	if limit > len(auditLogs) {
-		limit = len(auditLogs)
-	}
-
-	// Return most recent logs
-	start := len(auditLogs) - limit
-	if start < 0 {
-		start = 0
-	}
-
-	return auditLogs[start:]
-}
-
-// PasswordResetRepository methods
-func createPasswordReset(reset *PasswordReset) error {
-	mu.Lock()
-	defer mu.Unlock()
-
-	reset.CreatedAt = time.Now()
-	passwordResets[reset.Token] = reset
-	return nil
-}
-
-func getPasswordResetByToken(token string) (*PasswordReset, error) {
-	mu.RLock()
-	defer mu.RUnlock()
-
-	reset, exists := passwordResets[token]
-	if !exists {
-		return nil, errors.New("reset token not found")
-	}
-	return reset, nil
-}
-
-func markPasswordResetAsUsed(token string) error {
-	mu.Lock()
-	defer mu.Unlock()
-
-	if reset, exists := passwordResets[token]; exists {
-		reset.Used = true
-		return nil
-	}
-	return errors.New("reset token not found")
-}
-
-// SessionRepository methods
-func createSession(session *Session) error {
-	mu.Lock()
-	defer mu.Unlock()
-
-	session.CreatedAt = time.Now()
-	session.LastActivity = time.Now()
-	sessions[session.Token] = session
-	return nil
-}
-
-func getSessionByToken(token string) (*Session, error) {
-	mu.RLock()
-	defer mu.RUnlock()
-
-	session, exists := sessions[token]
-	if !exists {
-		return nil, errors.New("session not found")
-	}
-	return session, nil
-}
-
-func getUserSessions(userID string) []*Session {
-	mu.RLock()
-	defer mu.RUnlock()
-
-	var userSessions []*Session
-	for _, session := range sessions {
-		if session.UserID == userID {
-			userSessions = append(userSessions, session)
+		if err := s.Roles().Create(r); err != nil {
+			return err
 		}
 	}
-	return userSessions
-}
-
-func deleteSession(token string) error {
-	mu.Lock()
-	defer mu.Unlock()
-
-	delete(sessions, token)
-	return nil
-}
-
-// PreferencesRepository methods
-func createPreferences(prefs *UserPreferences) error {
-	mu.Lock()
-	defer mu.Unlock()
-
-	prefs.UpdatedAt = time.Now()
-	preferences[prefs.UserID] = prefs
-	return nil
-}
-
-func getPreferencesByUserID(userID string) (*UserPreferences, error) {
-	mu.RLock()
-	defer mu.RUnlock()
 
-	prefs, exists := preferences[userID]
-	if !exists {
-		return nil, errors.New("preferences not found")
+	// Default permissions
+	defaultPerms := []*Permission{
+		{ID: "perm-1", Name: "users.create", Resource: "users", Action: "create", Description: "Create new users"},
+		{ID: "perm-2", Name: "users.read", Resource: "users", Action: "read", Description: "View users"},
+		{ID: "perm-3", Name: "users.update", Resource: "users", Action: "update", Description: "Update users"},
+		{ID: "perm-4", Name: "users.delete", Resource: "users", Action: "delete", Description: "Delete users"},
+		{ID: "perm-5", Name: "teams.manage", Resource: "teams", Action: "manage", Description: "Manage teams"},
+		{ID: "perm-6", Name: "roles.manage", Resource: "roles", Action: "manage", Description: "Manage roles"},
+		{ID: "perm-7", Name: "permissions.manage", Resource: "permissions", Action: "manage", Description: "Grant and revoke permissions"},
+		{ID: "perm-8", Name: "audit_logs.read", Resource: "audit_logs", Action: "read", Description: "View audit logs"},
+		{ID: "perm-9", Name: "invitations.manage", Resource: "invitations", Action: "manage", Description: "Manage invitations"},
 	}
-	return prefs, nil
-}
-
-func updatePreferences(userID string, updatedPrefs *UserPreferences) error {
-	mu.Lock()
-	defer mu.Unlock()
-
-	updatedPrefs.UpdatedAt = time.Now()
-	preferences[userID] = updatedPrefs
-	return nil
-}
-
-// ActivityLogRepository methods
-func createActivityLog(log *ActivityLog) error {
-	mu.Lock()
-	defer mu.Unlock()
-
-	log.CreatedAt = time.Now()
-	activityLogs = append(activityLogs, log)
-	return nil
-}
-
-func getUserActivityLogs(userID string, limit int) []*ActivityLog {
-	mu.RLock()
-	defer mu.RUnlock()
-
-	var userLogs []*ActivityLog
-	for i := len(activityLogs) - 1; i >= 0 && len(userLogs) < limit; i-- {
-		if activityLogs[i].UserID == userID {
-			userLogs = append(userLogs, activityLogs[i])
+	for _, p := range defaultPerms {
+		if _, err := s.Permissions().Get(p.ID); err == nil {
+			continue
+		}
+		if err := s.Permissions().Create(p); err != nil {
+			return err
 		}
 	}
-	return userLogs
-}
-
-// InvitationRepository methods
-func createInvitation(invitation *Invitation) error {
-	mu.Lock()
-	defer mu.Unlock()
-
-	invitation.CreatedAt = time.Now()
-	invitations[invitation.Token] = invitation
-	return nil
-}
-
-func getInvitationByToken(token string) (*Invitation, error) {
-	mu.RLock()
-	defer mu.RUnlock()
-
-	invitation, exists := invitations[token]
-	if !exists {
-		return nil, errors.New("invitation not found")
-	}
-	return invitation, nil
-}
 
-func updateInvitationStatus(token string, status string) error {
-	mu.Lock()
-	defer mu.Unlock()
-
-	if invitation, exists := invitations[token]; exists {
-		invitation.Status = status
-		if status == "accepted" {
-			now := time.Now()
-			invitation.AcceptedAt = &now
-		}
+	// Bootstrap administrator
+	if cfg.BootstrapAdminEmail == "" {
 		return nil
 	}
-	return errors.New("invitation not found")
-}
-
-func getPendingInvitations() []*Invitation {
-	mu.RLock()
-	defer mu.RUnlock()
-
-	var pending []*Invitation
-	for _, inv := range invitations {
-		if inv.Status == "pending" {
-			pending = append(pending, inv)
-		}
+	if _, err := s.Users().GetByEmail(cfg.BootstrapAdminEmail); err == nil {
+		return nil
 	}
-	return pending
-}
-
-// PermissionRepository methods
-func getAllPermissions() []*Permission {
-	mu.RLock()
-	defer mu.RUnlock()
-
-	permList := make([]*Permission, 0, len(permissions))
-	for _, perm := range permissions {
-		permList = append(permList, perm)
+	if err := validatePassword(cfg.BootstrapAdminPassword); err != nil {
+		return fmt.Errorf("bootstrap admin: %w", err)
 	}
-	return permList
-}
-
-func grantUserPermission(userPerm *UserPermission) error {
-	mu.Lock()
-	defer mu.Unlock()
-
-	userPerm.GrantedAt = time.Now()
-	userPermissions[userPerm.UserID] = append(userPermissions[userPerm.UserID], userPerm)
-	return nil
-}
-
-func getUserPermissions(userID string) []*UserPermission {
-	mu.RLock()
-	defer mu.RUnlock()
-
-	return userPermissions[userID]
-}
-
-func revokeUserPermission(userID, permissionID string) error {
-	mu.Lock()
-	defer mu.Unlock()
-
-	perms := userPermissions[userID]
-	for i, perm := range perms {
-		if perm.PermissionID == permissionID {
-			userPermissions[userID] = append(perms[:i], perms[i+1:]...)
-			return nil
-		}
+	hash, err := hashPassword(cfg.BootstrapAdminPassword)
+	if err != nil {
+		return err
 	}
-	return errors.New("permission not found for user")
+	return s.Users().Create(&User{
+		ID:       generateID("user"),
+		Email:    cfg.BootstrapAdminEmail,
+		Username: "admin",
+		Password: hash,
+		RoleID:   adminRoleID,
+		IsActive: true,
+	})
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// retentionPolicy bounds a log. Entries older than MaxAge or beyond the
+// newest MaxEntries are archived and dropped; a zero value disables the
+// limit.
+type retentionPolicy struct {
+	MaxEntries int
+	MaxAge     time.Duration
+}
+
+// cutoff returns the time before which entries are too old, or the zero
+// time if there is no age limit
+func (p retentionPolicy) cutoff(now time.Time) time.Time {
+	if p.MaxAge <= 0 {
+		return time.Time{}
+	}
+	return now.Add(-p.MaxAge)
+}
+
+// retentionBatchSize bounds how many entries a prune reads and archives at
+// once
+const retentionBatchSize = 1000
+
+// startLogRetention prunes the audit and activity logs now and then every
+// cfg.LogRetentionInterval; signer signs the audit log's anchors
+func startLogRetention(s Store, cfg Config, signer *checkpointSigner) {
+	if cfg.LogRetentionInterval <= 0 {
+		return
+	}
+	if cfg.LogArchiveDir == "" {
+		if cfg.AuditLogDiscard {
+			log.Printf("WARNING: LOG_ARCHIVE_DIR is not set and AUDIT_LOG_DISCARD is; audit log entries beyond the retention limits are deleted without a copy")
+		} else {
+			log.Printf("WARNING: LOG_ARCHIVE_DIR is not set, so the audit log is never pruned; set it to archive old entries, or set AUDIT_LOG_DISCARD=true to delete them")
+		}
+		log.Printf("LOG_ARCHIVE_DIR is not set; activity log entries beyond the retention limits are deleted without a copy")
+	}
+	go func() {
+		for {
+			pruneLogs(s, cfg, signer)
+			time.Sleep(cfg.LogRetentionInterval)
+		}
+	}()
+}
+
+// pruneLogs applies the retention policies once. Entries are only dropped
+// after they have been archived, so a failing archive keeps them for the
+// next run. The audit log is left alone if there is no archive, unless
+// cfg.AuditLogDiscard allows it.
+func pruneLogs(s Store, cfg Config, signer *checkpointSigner) {
+	var audit int
+	if cfg.LogArchiveDir != "" || cfg.AuditLogDiscard {
+		var err error
+		audit, err = pruneAuditLog(s.AuditLogs(), cfg, signer)
+		if err != nil {
+			log.Printf("audit log retention: %v", err)
+		}
+	}
+	activity, err := s.ActivityLogs().Prune(cfg.ActivityLogRetention, archiveTo[ActivityLog](cfg.LogArchiveDir, "activity"))
+	if err != nil {
+		log.Printf("activity log retention: %v", err)
+	}
+	if audit > 0 || activity > 0 {
+		log.Printf("log retention: dropped %d audit and %d activity entries", audit, activity)
+	}
+}
+
+// pruneAuditLog prunes the audit log, then signs the last entry it dropped
+// as the chain's new anchor. Should that fail, verification reports the
+// oldest retained entry as broken, since it no longer links to the anchor.
+func pruneAuditLog(logs AuditLogRepository, cfg Config, signer *checkpointSigner) (int, error) {
+	archive := archiveTo[AuditLog](cfg.LogArchiveDir, "audit")
+	var offered []*AuditLog // in order; the first pruned of them were dropped
+	pruned, err := logs.Prune(cfg.AuditLogRetention, func(batch []*AuditLog) error {
+		if archive != nil {
+			if err := archive(batch); err != nil {
+				return err
+			}
+		}
+		offered = append(offered, batch...)
+		return nil
+	})
+	if pruned > 0 {
+		if anchorErr := signer.anchor(logs, offered[pruned-1]); anchorErr != nil {
+			return pruned, fmt.Errorf("anchoring the chain after dropping %d entries: %w", pruned, anchorErr)
+		}
+	}
+	return pruned, err
+}
+
+// archiveTo returns a function that writes log entries to a new gzipped
+// JSONL file in dir, one entry per line, or nil if dir is empty
+func archiveTo[T any](dir, kind string) func([]*T) error {
+	if dir == "" {
+		return nil
+	}
+	return func(entries []*T) error {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return err
+		}
+		name := fmt.Sprintf("%s-%s.jsonl.gz", kind, time.Now().UTC().Format("20060102T150405.000000000Z"))
+		return writeArchive(filepath.Join(dir, name), entries)
+	}
+}
+
+// writeArchive writes entries to path through a temporary file, so that an
+// archive either exists complete or not at all
+func writeArchive[T any](path string, entries []*T) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".archive-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	gz := gzip.NewWriter(tmp)
+	enc := json.NewEncoder(gz)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
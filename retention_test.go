@@ -0,0 +1,73 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPruneLogsAuditArchive(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		archive  bool
+		discard  bool
+		retained int
+	}{
+		{"no archive", false, false, 5},
+		{"no archive, discard", false, true, 2},
+		{"archive", true, false, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newMemoryStore()
+			signer, _ := newCheckpointSigner("", nil)
+			for i := 0; i < 5; i++ {
+				s.AuditLogs().Create(&AuditLog{ID: generateID("audit"), Action: "test"})
+			}
+			cfg := Config{AuditLogRetention: retentionPolicy{MaxEntries: 2}, AuditLogDiscard: tc.discard}
+			if tc.archive {
+				cfg.LogArchiveDir = t.TempDir()
+			}
+
+			pruneLogs(s, cfg, signer)
+
+			var retained int
+			s.AuditLogs().Walk(func(*AuditLog) error { retained++; return nil })
+			if retained != tc.retained {
+				t.Errorf("got %d entries, want %d", retained, tc.retained)
+			}
+			if tc.archive {
+				if files, _ := filepath.Glob(filepath.Join(cfg.LogArchiveDir, "audit-*.jsonl.gz")); len(files) != 1 {
+					t.Errorf("got %d archives, want 1", len(files))
+				}
+			}
+		})
+	}
+}
+
+func TestPruneLogsAnchorsAuditChain(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		for i := 0; i < 5; i++ {
+			if err := s.AuditLogs().Create(&AuditLog{ID: generateID("audit"), Action: "test", Status: "success"}); err != nil {
+				t.Fatalf("create: %v", err)
+			}
+		}
+		signer, _ := newCheckpointSigner("", nil)
+		pruneLogs(s, Config{AuditLogRetention: retentionPolicy{MaxEntries: 2}, AuditLogDiscard: true}, signer)
+
+		report, err := verifyAuditChain(s.AuditLogs(), signer)
+		if err != nil || !report.Valid || report.Entries != 2 {
+			t.Fatalf("verify after pruning: got %+v, %v", report, err)
+		}
+
+		// Without the anchor, the first retained entry links to nothing known
+		report, err = verifyAuditChain(withoutCheckpoints{s.AuditLogs()}, signer)
+		if err != nil || report.Valid || report.FirstBroken == nil || report.FirstBroken.Position != 0 {
+			t.Errorf("verify without the anchor: got %+v, %v", report, err)
+		}
+	})
+}
+
+// withoutCheckpoints hides the checkpoints of an audit log, as if they had
+// been deleted
+type withoutCheckpoints struct{ AuditLogRepository }
+
+func (withoutCheckpoints) Checkpoints() ([]*AuditCheckpoint, error) { return nil, nil }
@@ -0,0 +1,682 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testAdminEmail    = "admin@example.test"
+	testAdminPassword = "admin-password"
+)
+
+var testSetup sync.Once
+
+// newTestServer points the server's globals at a fresh, seeded memory store
+// and returns the API router. Tests that use it must not run in parallel
+// with each other.
+func newTestServer(t testing.TB) *gin.Engine {
+	t.Helper()
+	testSetup.Do(func() {
+		gin.SetMode(gin.TestMode)
+		gin.DefaultWriter = io.Discard
+		if err := registerValidators(); err != nil {
+			panic(err)
+		}
+	})
+
+	cfg := loadConfig()
+	cfg.BootstrapAdminEmail = testAdminEmail
+	cfg.BootstrapAdminPassword = testAdminPassword
+	appConfig = cfg
+
+	store = newMemoryStore()
+	if err := seedDefaults(store, cfg); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	var err error
+	if tokenKeys, err = newKeyRing(time.Hour, cfg.AccessTokenTTL); err != nil {
+		t.Fatalf("signing key: %v", err)
+	}
+	if auditSigner, err = newCheckpointSigner("", nil); err != nil {
+		t.Fatalf("checkpoint signer: %v", err)
+	}
+	resetMailer = noMailer{}
+	return newRouter()
+}
+
+// serve sends a request with an optional bearer token and JSON body
+func serve(h http.Handler, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	var r io.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		r = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, r)
+	if body != nil && method == http.MethodPatch {
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+	} else if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// loginAdmin logs in as the bootstrap administrator and returns the access
+// token
+func loginAdmin(t testing.TB, h http.Handler) string {
+	t.Helper()
+	w := serve(h, http.MethodPost, "/auth/login", "", gin.H{"email": testAdminEmail, "password": testAdminPassword})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+	var tokens tokenPair
+	if err := json.Unmarshal(w.Body.Bytes(), &tokens); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	return tokens.AccessToken
+}
+
+// loginNewUser creates a user with the default role through the API, as the
+// administrator holding adminToken, and returns their ID and access token
+func loginNewUser(t testing.TB, h http.Handler, adminToken, name string) (string, string) {
+	t.Helper()
+	password := name + "-password"
+	w := serve(h, http.MethodPost, "/users", adminToken, gin.H{"email": name + "@example.test", "username": name, "password": password})
+	var user User
+	if err := json.Unmarshal(w.Body.Bytes(), &user); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("create %s: %d %s", name, w.Code, w.Body)
+	}
+	w = serve(h, http.MethodPost, "/auth/login", "", gin.H{"email": name + "@example.test", "password": password})
+	var tokens tokenPair
+	if err := json.Unmarshal(w.Body.Bytes(), &tokens); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("login %s: %d %s", name, w.Code, w.Body)
+	}
+	return user.ID, tokens.AccessToken
+}
+
+// TestConcurrentRequests sends mixed requests from many goroutines at once.
+// Run it with -race to catch unsynchronized access to shared state; the
+// audit chain must also still verify afterwards.
+func TestConcurrentRequests(t *testing.T) {
+	router := newTestServer(t)
+	token := loginAdmin(t, router)
+
+	workers, rounds := 8, 10
+	if testing.Short() {
+		rounds = 2
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				exerciseAPI(t, router, token, fmt.Sprintf("w%dr%d", w, i))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	w := serve(router, http.MethodGet, "/audit-logs/verify", token, nil)
+	var report chainReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || w.Code != http.StatusOK || !report.Valid {
+		t.Errorf("audit chain after concurrent requests: %d %s", w.Code, w.Body)
+	}
+}
+
+// exerciseAPI creates a user with related resources, reads and updates
+// them, and deletes them again
+func exerciseAPI(t *testing.T, h http.Handler, token, name string) {
+	call := func(method, path string, body interface{}, want int) map[string]interface{} {
+		w := serve(h, method, path, token, body)
+		if w.Code != want {
+			t.Errorf("%s %s: got %d, want %d: %s", method, path, w.Code, want, w.Body)
+			return nil
+		}
+		var out map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return out
+	}
+
+	user := call(http.MethodPost, "/users", gin.H{"email": name + "@example.test", "username": name}, http.StatusCreated)
+	if user == nil {
+		return
+	}
+	id, _ := user["id"].(string)
+
+	call(http.MethodGet, "/users/"+id, nil, http.StatusOK)
+	call(http.MethodPatch, "/users/"+id, gin.H{"first_name": "Test"}, http.StatusOK)
+	call(http.MethodGet, "/users?limit=5", nil, http.StatusOK)
+
+	call(http.MethodPost, "/profiles", gin.H{"user_id": id, "bio": "bio"}, http.StatusCreated)
+	call(http.MethodPatch, "/profiles/user/"+id, gin.H{"location": "here"}, http.StatusOK)
+	call(http.MethodPost, "/preferences", gin.H{"user_id": id, "theme": "dark"}, http.StatusCreated)
+	call(http.MethodGet, "/preferences/user/"+id, nil, http.StatusOK)
+
+	if team := call(http.MethodPost, "/teams", gin.H{"name": name}, http.StatusCreated); team != nil {
+		teamID, _ := team["id"].(string)
+		call(http.MethodPost, "/teams/"+teamID+"/members", gin.H{"user_id": id, "role": "member"}, http.StatusCreated)
+		call(http.MethodGet, "/teams/"+teamID+"/members", nil, http.StatusOK)
+		call(http.MethodGet, "/teams?limit=5", nil, http.StatusOK)
+		call(http.MethodDelete, "/teams/"+teamID+"/members/"+id, nil, http.StatusOK)
+		call(http.MethodDelete, "/teams/"+teamID, nil, http.StatusOK)
+	}
+
+	call(http.MethodPost, "/activity-logs", gin.H{"user_id": id, "activity_type": "view"}, http.StatusCreated)
+	call(http.MethodGet, "/activity-logs/user/"+id, nil, http.StatusOK)
+	call(http.MethodGet, "/audit-logs?limit=10", nil, http.StatusOK)
+	call(http.MethodPost, "/authz/check", gin.H{"user_id": id, "resource_type": "users", "resource_id": id, "action": "read"}, http.StatusOK)
+	call(http.MethodGet, "/users/"+id+"/permissions", nil, http.StatusOK)
+
+	call(http.MethodDelete, "/users/"+id, nil, http.StatusOK)
+	call(http.MethodGet, "/users/"+id, nil, http.StatusNotFound)
+}
+
+// TestCreateSession issues a session to another user as an administrator
+func TestCreateSession(t *testing.T) {
+	router := newTestServer(t)
+	token := loginAdmin(t, router)
+	admin, _ := store.Users().GetByEmail(testAdminEmail)
+
+	user := &User{ID: generateID("user"), Email: "session@example.test", Username: "session", IsActive: true}
+	if err := store.Users().Create(user); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(router, http.MethodPost, "/sessions", token, gin.H{"user_id": user.ID}); w.Code != http.StatusCreated {
+		t.Fatalf("active user: got %d %s", w.Code, w.Body)
+	}
+	var issued *AuditLog
+	store.AuditLogs().Walk(func(entry *AuditLog) error {
+		if entry.Action == "session.issued" {
+			issued = entry
+		}
+		return nil
+	})
+	if issued == nil || issued.UserID != admin.ID || issued.ResourceID != user.ID {
+		t.Errorf("audit entry: got %+v, want the administrator issuing a session to %s", issued, user.ID)
+	}
+
+	if w := serve(router, http.MethodPost, "/sessions", token, gin.H{"user_id": "no-such-user"}); w.Code != http.StatusNotFound {
+		t.Errorf("unknown user: got %d %s", w.Code, w.Body)
+	}
+	user.IsActive = false
+	if err := store.Users().Update(user.ID, user); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(router, http.MethodPost, "/sessions", token, gin.H{"user_id": user.ID}); w.Code != http.StatusConflict {
+		t.Errorf("inactive user: got %d %s", w.Code, w.Body)
+	}
+
+	// Issuing a session must not skip the second factor
+	enrolledID, _ := loginNewUser(t, router, token, "enrolled")
+	confirmed := time.Now()
+	if err := store.MFA().Save(&MFACredential{UserID: enrolledID, Secret: rfc6238Secret, ConfirmedAt: &confirmed}); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(router, http.MethodPost, "/sessions", token, gin.H{"user_id": enrolledID}); w.Code != http.StatusConflict {
+		t.Errorf("user with MFA: got %d %s", w.Code, w.Body)
+	}
+	requiredID, _ := loginNewUser(t, router, token, "required")
+	if err := store.Roles().SetRequireMFA(defaultRoleID, true); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(router, http.MethodPost, "/sessions", token, gin.H{"user_id": requiredID}); w.Code != http.StatusConflict {
+		t.Errorf("user whose role requires MFA: got %d %s", w.Code, w.Body)
+	}
+}
+
+// TestTeamOwnerCannotGiveAwayTeam checks that an owner updating their team
+// through a teams.update:own grant keeps it
+func TestTeamOwnerCannotGiveAwayTeam(t *testing.T) {
+	router := newTestServer(t)
+	admin := loginAdmin(t, router)
+	ownerID, owner := loginNewUser(t, router, admin, "owner")
+	otherID, _ := loginNewUser(t, router, admin, "other")
+
+	w := serve(router, http.MethodPost, "/teams", admin, gin.H{"name": "Team", "owner_id": ownerID})
+	var team Team
+	if err := json.Unmarshal(w.Body.Bytes(), &team); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("create team: %d %s", w.Code, w.Body)
+	}
+
+	if w := serve(router, http.MethodPatch, "/teams/"+team.ID, owner, gin.H{"owner_id": otherID}); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("patch owner_id: got %d %s", w.Code, w.Body)
+	}
+	if w := serve(router, http.MethodPut, "/teams/"+team.ID, owner, gin.H{"name": "Renamed", "owner_id": otherID}); w.Code != http.StatusOK {
+		t.Errorf("put: got %d %s", w.Code, w.Body)
+	}
+	if stored, _ := store.Teams().Get(team.ID); stored.OwnerID != ownerID || stored.Name != "Renamed" {
+		t.Errorf("after the owner's updates: owner %s, name %q", stored.OwnerID, stored.Name)
+	}
+
+	// Administrators may still hand a team over
+	if w := serve(router, http.MethodPatch, "/teams/"+team.ID, admin, gin.H{"owner_id": otherID}); w.Code != http.StatusOK {
+		t.Errorf("patch owner_id as administrator: got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestUserActivityLogsPage(t *testing.T) {
+	router := newTestServer(t)
+	admin := loginAdmin(t, router)
+	userID, _ := loginNewUser(t, router, admin, "active")
+	otherID, _ := loginNewUser(t, router, admin, "idle")
+
+	for _, id := range []string{userID, userID, userID, otherID} {
+		if w := serve(router, http.MethodPost, "/activity-logs", admin, gin.H{"user_id": id, "activity_type": "view"}); w.Code != http.StatusCreated {
+			t.Fatalf("create activity log: %d %s", w.Code, w.Body)
+		}
+	}
+
+	for _, limit := range []string{"-1", "0", "abc"} {
+		if w := serve(router, http.MethodGet, "/activity-logs/user/"+userID+"?limit="+limit, admin, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("limit=%s: got %d %s", limit, w.Code, w.Body)
+		}
+	}
+
+	// A user_id in the query cannot widen the list to someone else
+	var seen int
+	path := "/activity-logs/user/" + userID + "?limit=2&user_id=" + otherID
+	for path != "" {
+		w := serve(router, http.MethodGet, path, admin, nil)
+		var page struct {
+			Items      []ActivityLog `json:"items"`
+			NextCursor string        `json:"next_cursor"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("list: %d %s", w.Code, w.Body)
+		}
+		for _, log := range page.Items {
+			if log.UserID != userID {
+				t.Errorf("got activity for %s", log.UserID)
+			}
+		}
+		seen += len(page.Items)
+		path = ""
+		if page.NextCursor != "" {
+			path = "/activity-logs/user/" + userID + "?limit=2&cursor=" + page.NextCursor
+		}
+	}
+	if all, _ := store.ActivityLogs().ListByUser(userID, maxPageSize); seen != len(all) {
+		t.Errorf("got %d entries across pages, want %d", seen, len(all))
+	}
+}
+
+func TestRequiredFieldsAreValidated(t *testing.T) {
+	router := newTestServer(t)
+	admin := loginAdmin(t, router)
+
+	for _, tc := range []struct {
+		method, path string
+		body         gin.H
+	}{
+		{http.MethodPost, "/permissions", gin.H{"resource": "reports"}},
+		{http.MethodPut, "/permissions/perm-1", gin.H{"action": "read"}},
+		{http.MethodPut, "/roles/role-2/mfa", gin.H{}},
+		{http.MethodPost, "/authz/check", gin.H{"resource_type": "users", "action": "read"}},
+	} {
+		if w := serve(router, tc.method, tc.path, admin, tc.body); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s %s: got %d %s", tc.method, tc.path, w.Code, w.Body)
+		}
+	}
+}
+
+func TestProfileAndPreferenceWritesAreAudited(t *testing.T) {
+	router := newTestServer(t)
+	admin := loginAdmin(t, router)
+	userID, token := loginNewUser(t, router, admin, "audited")
+
+	for _, req := range []struct {
+		method, path string
+		body         gin.H
+	}{
+		{http.MethodPost, "/profiles", gin.H{"user_id": userID}},
+		{http.MethodPut, "/profiles/user/" + userID, gin.H{"bio": "Hello"}},
+		{http.MethodPatch, "/profiles/user/" + userID, gin.H{"bio": "Hi"}},
+		{http.MethodPost, "/preferences", gin.H{"user_id": userID}},
+		{http.MethodPut, "/preferences/user/" + userID, gin.H{"theme": "dark"}},
+		{http.MethodPatch, "/preferences/user/" + userID, gin.H{"theme": "light"}},
+	} {
+		if w := serve(router, req.method, req.path, token, req.body); w.Code >= 300 {
+			t.Fatalf("%s %s: got %d %s", req.method, req.path, w.Code, w.Body)
+		}
+	}
+
+	for action, want := range map[string]int{"profile.updated": 2, "preferences.created": 1, "preferences.updated": 2} {
+		q, _ := parseListValues(url.Values{"action": {action}, "resource_id": {userID}}, auditLogListSpec)
+		if entries, _, _ := store.AuditLogs().ListPage(q); len(entries) != want {
+			t.Errorf("%s: got %d audit entries, want %d", action, len(entries), want)
+		}
+	}
+}
+
+func TestAccessTokenVerification(t *testing.T) {
+	newTestServer(t)
+	user := &User{ID: "user-1", RoleID: defaultRoleID}
+	token, _, err := signAccessToken(user, "family-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := parseAccessToken(token)
+	if err != nil || claims.Subject != user.ID || claims.SessionID != "family-1" {
+		t.Fatalf("got %+v, %v", claims, err)
+	}
+
+	key, _ := tokenKeys.current()
+	sign := func(method jwt.SigningMethod, signingKey interface{}, claims jwt.RegisteredClaims) string {
+		token := jwt.NewWithClaims(method, accessClaims{RegisteredClaims: claims})
+		token.Header["kid"] = key.ID
+		signed, err := token.SignedString(signingKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	valid := jwt.RegisteredClaims{
+		Issuer:    appConfig.TokenIssuer,
+		Subject:   user.ID,
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}
+	expired, otherIssuer, noExpiry := valid, valid, valid
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	otherIssuer.Issuer = "someone-else"
+	noExpiry.ExpiresAt = nil
+	publicDER, _ := x509.MarshalPKIXPublicKey(&key.Private.PublicKey)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	header, payload, _ := strings.Cut(token, ".")
+
+	for name, token := range map[string]string{
+		"expired":                sign(jwt.SigningMethodRS256, key.Private, expired),
+		"other issuer":           sign(jwt.SigningMethodRS256, key.Private, otherIssuer),
+		"no expiry":              sign(jwt.SigningMethodRS256, key.Private, noExpiry),
+		"HS256 with the RSA key": sign(jwt.SigningMethodHS256, publicDER, valid),
+		"unknown key":            sign(jwt.SigningMethodRS256, otherKey, valid),
+		"tampered":               header + "." + strings.Replace(payload, "e", "f", 1),
+	} {
+		if _, err := parseAccessToken(token); err == nil {
+			t.Errorf("%s: token accepted", name)
+		}
+	}
+}
+
+func TestRetiredSigningKeys(t *testing.T) {
+	router := newTestServer(t)
+	admin := loginAdmin(t, router)
+
+	// Tokens signed by the previous key verify until it is dropped
+	if err := tokenKeys.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(router, http.MethodGet, "/auth/me", admin, nil); w.Code != http.StatusOK {
+		t.Errorf("token of the retired key: got %d %s", w.Code, w.Body)
+	}
+	if keys := tokenKeys.JWKS(); len(keys) != 2 {
+		t.Errorf("got %d published keys, want the current and the retired one", len(keys))
+	}
+
+	tokenKeys.retain = 0
+	if err := tokenKeys.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(router, http.MethodGet, "/auth/me", admin, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("token of a dropped key: got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	router := newTestServer(t)
+	login := func() tokenPair {
+		w := serve(router, http.MethodPost, "/auth/login", "", gin.H{"email": testAdminEmail, "password": testAdminPassword})
+		var tokens tokenPair
+		if err := json.Unmarshal(w.Body.Bytes(), &tokens); err != nil || w.Code != http.StatusCreated {
+			t.Fatalf("login: %d %s", w.Code, w.Body)
+		}
+		return tokens
+	}
+	refresh := func(token string) (*tokenPair, int) {
+		w := serve(router, http.MethodPost, "/auth/refresh", "", gin.H{"refresh_token": token})
+		var tokens tokenPair
+		json.Unmarshal(w.Body.Bytes(), &tokens)
+		return &tokens, w.Code
+	}
+
+	first := login()
+	other := login()
+	second, code := refresh(first.RefreshToken)
+	if code != http.StatusOK || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("refresh: got %d", code)
+	}
+	third, code := refresh(second.RefreshToken)
+	if code != http.StatusOK {
+		t.Fatalf("refresh of the rotated token: got %d", code)
+	}
+
+	// Replaying a rotated token revokes its whole family
+	if _, code := refresh(first.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("reused refresh token: got %d", code)
+	}
+	if _, code := refresh(third.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("latest token of the reused family: got %d", code)
+	}
+	session, err := store.Sessions().GetByToken(hashRefreshToken(third.RefreshToken))
+	if err != nil || session.RevokedAt == nil {
+		t.Errorf("latest session of the reused family: %+v, %v", session, err)
+	}
+
+	// Other logins are a family of their own
+	if _, code := refresh(other.RefreshToken); code != http.StatusOK {
+		t.Errorf("refresh of another login: got %d", code)
+	}
+}
+
+// TestConcurrentMFAVerify checks that two logins racing to redeem the same
+// TOTP code on different challenges cannot both succeed
+func TestConcurrentMFAVerify(t *testing.T) {
+	router := newTestServer(t)
+	admin := loginAdmin(t, router)
+	userID, _ := loginNewUser(t, router, admin, "mfa")
+	confirmed := time.Now()
+	if err := store.MFA().Save(&MFACredential{UserID: userID, Secret: rfc6238Secret, ConfirmedAt: &confirmed}); err != nil {
+		t.Fatal(err)
+	}
+
+	var challenges [2]string
+	for i := range challenges {
+		w := serve(router, http.MethodPost, "/auth/login", "", gin.H{"email": "mfa@example.test", "password": "mfa-password"})
+		var body struct {
+			MFAToken string `json:"mfa_token"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusAccepted {
+			t.Fatalf("login: %d %s", w.Code, w.Body)
+		}
+		challenges[i] = body.MFAToken
+	}
+
+	// Both requests read the credential before either records the code
+	read := &sync.WaitGroup{}
+	read.Add(len(challenges))
+	store = barrierMFAStore{Store: store, read: read}
+
+	code, _ := totpCode(rfc6238Secret, time.Now().Unix()/int64(totpPeriod.Seconds()))
+	var codes [2]int
+	var wg sync.WaitGroup
+	for i, challenge := range challenges {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = serve(router, http.MethodPost, "/auth/mfa/verify", "", gin.H{"mfa_token": challenge, "code": code}).Code
+		}()
+	}
+	wg.Wait()
+
+	if accepted := (codes[0] == http.StatusCreated) != (codes[1] == http.StatusCreated); !accepted {
+		t.Errorf("got %v, want exactly one login to succeed", codes)
+	}
+}
+
+// barrierMFAStore holds each MFA credential read until read is done
+type barrierMFAStore struct {
+	Store
+	read *sync.WaitGroup
+}
+
+func (s barrierMFAStore) MFA() MFARepository {
+	return barrierMFARepo{s.Store.MFA(), s.read}
+}
+
+type barrierMFARepo struct {
+	MFARepository
+	read *sync.WaitGroup
+}
+
+func (r barrierMFARepo) Get(userID string) (*MFACredential, error) {
+	cred, err := r.MFARepository.Get(userID)
+	r.read.Done()
+	r.read.Wait()
+	return cred, err
+}
+
+func TestPatchEndpoints(t *testing.T) {
+	router := newTestServer(t)
+	admin := loginAdmin(t, router)
+	userID, _ := loginNewUser(t, router, admin, "patched")
+	w := serve(router, http.MethodPost, "/teams", admin, gin.H{"name": "Team", "owner_id": userID})
+	var team Team
+	if err := json.Unmarshal(w.Body.Bytes(), &team); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("create team: %d %s", w.Code, w.Body)
+	}
+	for _, path := range []string{"/profiles", "/preferences"} {
+		if w := serve(router, http.MethodPost, path, admin, gin.H{"user_id": userID}); w.Code != http.StatusCreated {
+			t.Fatalf("create %s: %d %s", path, w.Code, w.Body)
+		}
+	}
+
+	patch := func(path, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Authorization", "Bearer "+admin)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, resource := range []struct {
+		path, field string
+	}{
+		{"/users/" + userID, "first_name"},
+		{"/teams/" + team.ID, "description"},
+		{"/profiles/user/" + userID, "bio"},
+		{"/preferences/user/" + userID, "language"},
+	} {
+		for _, tc := range []struct {
+			name, contentType, body string
+			want                    int
+			value                   string // of field afterwards, if the patch applies
+		}{
+			{"merge patch", mergePatchType, `{"` + resource.field + `": "merged"}`, http.StatusOK, "merged"},
+			{"merge patch removing the field", mergePatchType, `{"` + resource.field + `": null}`, http.StatusOK, ""},
+			{"JSON patch", jsonPatchType, `[{"op": "add", "path": "/` + resource.field + `", "value": "added"},
+				{"op": "test", "path": "/` + resource.field + `", "value": "added"}]`, http.StatusOK, "added"},
+			{"read-only field", mergePatchType, `{"id": "other"}`, http.StatusUnprocessableEntity, ""},
+			{"read-only field by JSON patch", jsonPatchType, `[{"op": "replace", "path": "/version", "value": 99}]`, http.StatusUnprocessableEntity, ""},
+			{"failing test", jsonPatchType, `[{"op": "test", "path": "/` + resource.field + `", "value": "other"},
+				{"op": "replace", "path": "/` + resource.field + `", "value": "replaced"}]`, http.StatusConflict, ""},
+			{"test without a value", jsonPatchType, `[{"op": "test", "path": "/` + resource.field + `"}]`, http.StatusUnprocessableEntity, ""},
+			{"test of a missing path", jsonPatchType, `[{"op": "test", "path": "/no_such_field", "value": 1}]`, http.StatusUnprocessableEntity, ""},
+			{"malformed JSON patch", jsonPatchType, `{"op": "test"}`, http.StatusBadRequest, ""},
+			{"plain JSON", "application/json", `{"` + resource.field + `": "x"}`, http.StatusUnsupportedMediaType, ""},
+		} {
+			w := patch(resource.path, tc.contentType, tc.body)
+			if w.Code != tc.want {
+				t.Errorf("%s %s: got %d %s, want %d", resource.path, tc.name, w.Code, w.Body, tc.want)
+				continue
+			}
+			if w.Code != http.StatusOK {
+				continue
+			}
+			var body map[string]interface{}
+			json.Unmarshal(w.Body.Bytes(), &body)
+			if value, _ := body[resource.field].(string); value != tc.value {
+				t.Errorf("%s %s: %s is %q, want %q", resource.path, tc.name, resource.field, value, tc.value)
+			}
+		}
+	}
+}
+
+func TestInvitationIsProcessedOnce(t *testing.T) {
+	router := newTestServer(t)
+	admin := loginAdmin(t, router)
+
+	invite := func(email string, expiresAt time.Time) string {
+		token := generateID("invite")
+		if err := store.Invitations().Create(&Invitation{ID: generateID("invitation"), Email: email, Token: token, Status: "pending", ExpiresAt: expiresAt}); err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	token := invite("guest@example.test", time.Now().Add(time.Hour))
+	if w := serve(router, http.MethodPost, "/invitations/"+token+"/accept", admin, nil); w.Code != http.StatusOK {
+		t.Errorf("accept: got %d %s", w.Code, w.Body)
+	}
+	if w := serve(router, http.MethodDelete, "/invitations/"+token, admin, nil); w.Code != http.StatusConflict {
+		t.Errorf("revoke after accepting: got %d %s", w.Code, w.Body)
+	}
+	if w := serve(router, http.MethodPost, "/invitations/"+token+"/accept", admin, nil); w.Code != http.StatusConflict {
+		t.Errorf("accept again: got %d %s", w.Code, w.Body)
+	}
+
+	expired := invite("late@example.test", time.Now().Add(-time.Minute))
+	if w := serve(router, http.MethodPost, "/invitations/"+expired+"/accept", admin, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("accept an expired invitation: got %d %s", w.Code, w.Body)
+	}
+	if invitation, _ := store.Invitations().GetByToken(expired); invitation.Status != "expired" {
+		t.Errorf("expired invitation has status %q", invitation.Status)
+	}
+	if w := serve(router, http.MethodPost, "/invitations/"+expired+"/accept", admin, nil); w.Code != http.StatusConflict {
+		t.Errorf("accept an invitation marked expired: got %d %s", w.Code, w.Body)
+	}
+}
+
+// TestAuditEntriesNameTheCaller checks that entries are attributed to the
+// administrator making a change, not to the user or team it is about
+func TestAuditEntriesNameTheCaller(t *testing.T) {
+	router := newTestServer(t)
+	admin := loginAdmin(t, router)
+	caller, _ := store.Users().GetByEmail(testAdminEmail)
+	userID, _ := loginNewUser(t, router, admin, "subject")
+	if w := serve(router, http.MethodPost, "/teams", admin, gin.H{"name": "Team", "owner_id": userID}); w.Code != http.StatusCreated {
+		t.Fatalf("create team: %d %s", w.Code, w.Body)
+	}
+	if w := serve(router, http.MethodPatch, "/users/"+userID, admin, gin.H{"first_name": "Sub"}); w.Code != http.StatusOK {
+		t.Fatalf("patch user: %d %s", w.Code, w.Body)
+	}
+
+	for _, action := range []string{"user.created", "user.updated", "team.created"} {
+		q, _ := parseListValues(url.Values{"action": {action}}, auditLogListSpec)
+		entries, _, _ := store.AuditLogs().ListPage(q)
+		if len(entries) != 1 || entries[0].UserID != caller.ID {
+			t.Errorf("%s: got %d entries, want one by %s", action, len(entries), caller.ID)
+		}
+	}
+}
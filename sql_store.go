@@ -0,0 +1,1325 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sqlDialect names a supported SQL database; it is also the directory
+// holding that database's migrations
+type sqlDialect string
+
+const (
+	dialectSQLite   sqlDialect = "sqlite"
+	dialectPostgres sqlDialect = "postgres"
+)
+
+// rebind rewrites ? placeholders into the dialect's native form
+func (d sqlDialect) rebind(query string) string {
+	if d != dialectPostgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// sqlStore implements Store on top of database/sql
+type sqlStore struct {
+	db      *sql.DB
+	q       querier // db, or the transaction when inside WithinTx
+	dialect sqlDialect
+	commit  []func() // run by WithinTx after the transaction commits
+}
+
+func newSQLStore(db *sql.DB, dialect sqlDialect) *sqlStore {
+	return &sqlStore{db: db, q: db, dialect: dialect}
+}
+
+// openSQLStore wraps an open database, first migrating it to the latest
+// schema version if autoMigrate is set
+func openSQLStore(db *sql.DB, dialect sqlDialect, autoMigrate bool) (Store, error) {
+	if autoMigrate {
+		migrator, err := newMigrator(db, dialect)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		if err := migrator.Up(); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return newSQLStore(db, dialect), nil
+}
+
+func (s *sqlStore) Users() UserRepository                   { return sqlUserRepo{s} }
+func (s *sqlStore) Roles() RoleRepository                   { return sqlRoleRepo{s} }
+func (s *sqlStore) Profiles() ProfileRepository             { return sqlProfileRepo{s} }
+func (s *sqlStore) Teams() TeamRepository                   { return sqlTeamRepo{s} }
+func (s *sqlStore) AuditLogs() AuditLogRepository           { return sqlAuditLogRepo{s} }
+func (s *sqlStore) PasswordResets() PasswordResetRepository { return sqlPasswordResetRepo{s} }
+func (s *sqlStore) Sessions() SessionRepository             { return sqlSessionRepo{s} }
+func (s *sqlStore) Preferences() PreferencesRepository      { return sqlPreferencesRepo{s} }
+func (s *sqlStore) ActivityLogs() ActivityLogRepository     { return sqlActivityLogRepo{s} }
+func (s *sqlStore) Invitations() InvitationRepository       { return sqlInvitationRepo{s} }
+func (s *sqlStore) Permissions() PermissionRepository       { return sqlPermissionRepo{s} }
+func (s *sqlStore) MFA() MFARepository                      { return sqlMFARepo{s} }
+
+func (s *sqlStore) WithinTx(fn func(tx Store) error) error {
+	if _, nested := s.q.(*sql.Tx); nested {
+		return fn(s)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	txStore := &sqlStore{db: s.db, q: tx, dialect: s.dialect}
+	if err := fn(txStore); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, f := range txStore.commit {
+		f()
+	}
+	return nil
+}
+
+// afterCommit runs f once the store's transaction has committed, or right
+// away outside a transaction
+func (s *sqlStore) afterCommit(f func()) {
+	if _, inTx := s.q.(*sql.Tx); inTx {
+		s.commit = append(s.commit, f)
+		return
+	}
+	f()
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.q.Exec(s.dialect.rebind(query), utcArgs(args)...)
+}
+
+func (s *sqlStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.q.Query(s.dialect.rebind(query), utcArgs(args)...)
+}
+
+func (s *sqlStore) queryRow(query string, args ...interface{}) *sql.Row {
+	return s.q.QueryRow(s.dialect.rebind(query), utcArgs(args)...)
+}
+
+// utcArgs converts the times among args to UTC. SQLite stores times as text
+// in the offset they are given in and compares them as text, which orders
+// them correctly only if they all have the same offset.
+func utcArgs(args []interface{}) []interface{} {
+	var converted []interface{} // a copy of args, once one is converted
+	for i, arg := range args {
+		var utc interface{}
+		switch v := arg.(type) {
+		case time.Time:
+			utc = v.UTC()
+		case *time.Time:
+			if v == nil {
+				continue
+			}
+			t := v.UTC()
+			utc = &t
+		default:
+			continue
+		}
+		if converted == nil {
+			converted = append([]interface{}(nil), args...)
+		}
+		converted[i] = utc
+	}
+	if converted == nil {
+		return args
+	}
+	return converted
+}
+
+// execOne runs a write that must affect exactly one row, returning
+// notFound otherwise
+func (s *sqlStore) execOne(notFound error, query string, args ...interface{}) error {
+	res, err := s.exec(query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return notFound
+	}
+	return nil
+}
+
+// execVersioned runs an UPDATE of a versioned resource guarded by its
+// version; when no row changes it tells a missing row from a stale version
+func (s *sqlStore) execVersioned(resource, table, key string, id interface{}, query string, args ...interface{}) error {
+	res, err := s.exec(query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	var version int64
+	err = s.queryRow(`SELECT version FROM `+table+` WHERE `+key+` = ?`, id).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFound(resource)
+	}
+	if err != nil {
+		return err
+	}
+	return &VersionMismatchError{Resource: resource}
+}
+
+// scanAll collects every row of a query using scan
+func scanAll[T any](rows *sql.Rows, err error, scan func(rowScanner) (*T, error)) ([]*T, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []*T
+	for rows.Next() {
+		item, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// sqlPage runs a paginated list query against table
+func sqlPage[T any](s *sqlStore, table, columns string, spec listSpec[*T], q listQuery,
+	scan func(rowScanner) (*T, error)) ([]*T, string, error) {
+	clauses, args := spec.sqlClauses(q, s.dialect)
+	rows, err := s.query(`SELECT `+columns+` FROM `+table+clauses, args...)
+	items, err := scanAll(rows, err, scan)
+	if err != nil {
+		return nil, "", err
+	}
+	items, next := spec.finish(q, items)
+	return items, next, nil
+}
+
+// toJSON encodes map and slice columns; nil values are stored as NULL
+func toJSON(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if string(data) == "null" {
+		return nil, nil
+	}
+	return string(data), nil
+}
+
+func fromJSON(data sql.NullString, v interface{}) error {
+	if !data.Valid || data.String == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(data.String), v)
+}
+
+// UserRepository methods
+type sqlUserRepo struct{ *sqlStore }
+
+const userColumns = `id, email, username, password, first_name, last_name, role_id, team_id, is_active, version, created_at, updated_at`
+
+func scanUser(row rowScanner) (*User, error) {
+	var u User
+	err := row.Scan(&u.ID, &u.Email, &u.Username, &u.Password, &u.FirstName, &u.LastName,
+		&u.RoleID, &u.TeamID, &u.IsActive, &u.Version, &u.CreatedAt, &u.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (r sqlUserRepo) Create(user *User) error {
+	if _, err := r.Get(user.ID); err == nil {
+		return &ConflictError{Detail: "user already exists"}
+	}
+
+	normalizeUser(user)
+	user.Version = 1
+	user.CreatedAt = time.Now()
+	user.UpdatedAt = time.Now()
+	_, err := r.exec(`INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		user.ID, user.Email, user.Username, user.Password, user.FirstName, user.LastName,
+		user.RoleID, user.TeamID, user.IsActive, user.Version, user.CreatedAt, user.UpdatedAt)
+	return uniqueUserError(err)
+}
+
+// uniqueUserError turns a violation of the unique email or username index
+// into a ConflictError naming the field. SQLite names the column (users.email), Postgres
+// the index (users_email_key).
+func uniqueUserError(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, field := range []string{"email", "username"} {
+		if strings.Contains(err.Error(), "users."+field) || strings.Contains(err.Error(), "users_"+field+"_key") {
+			return &ConflictError{Detail: field + " already in use", Field: field}
+		}
+	}
+	return err
+}
+
+func (r sqlUserRepo) Get(id string) (*User, error) {
+	user, err := scanUser(r.queryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFound("user")
+	}
+	return user, err
+}
+
+func (r sqlUserRepo) GetByEmail(email string) (*User, error) {
+	user, err := scanUser(r.queryRow(`SELECT `+userColumns+` FROM users WHERE email = ?`, normalizeIdentifier(email)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFound("user")
+	}
+	return user, err
+}
+
+func (r sqlUserRepo) GetByUsername(username string) (*User, error) {
+	user, err := scanUser(r.queryRow(`SELECT `+userColumns+` FROM users WHERE username = ?`, normalizeIdentifier(username)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFound("user")
+	}
+	return user, err
+}
+
+func (r sqlUserRepo) List() ([]*User, error) {
+	rows, err := r.query(`SELECT ` + userColumns + ` FROM users`)
+	return scanAll(rows, err, scanUser)
+}
+
+func (r sqlUserRepo) ListPage(q listQuery) ([]*User, string, error) {
+	return sqlPage(r.sqlStore, "users", userColumns, userListSpec, q, scanUser)
+}
+
+func (r sqlUserRepo) Update(id string, updatedUser *User) error {
+	normalizeUser(updatedUser)
+	updatedUser.UpdatedAt = time.Now()
+	err := uniqueUserError(r.execVersioned("user", "users", "id", id,
+		`UPDATE users SET email = ?, username = ?, password = ?, first_name = ?, last_name = ?,
+			role_id = ?, team_id = ?, is_active = ?, version = version + 1, created_at = ?, updated_at = ?
+		WHERE id = ? AND version = ?`,
+		updatedUser.Email, updatedUser.Username, updatedUser.Password, updatedUser.FirstName, updatedUser.LastName,
+		updatedUser.RoleID, updatedUser.TeamID, updatedUser.IsActive, updatedUser.CreatedAt, updatedUser.UpdatedAt,
+		id, updatedUser.Version))
+	if err == nil {
+		updatedUser.Version++
+	}
+	return err
+}
+
+func (r sqlUserRepo) Delete(id string) error {
+	return r.WithinTx(func(tx Store) error {
+		s := tx.(*sqlStore)
+
+		if err := s.execOne(notFound("user"), `DELETE FROM users WHERE id = ?`, id); err != nil {
+			return err
+		}
+		if err := s.removeMemberships("", id); err != nil {
+			return err
+		}
+		for _, table := range []string{"user_profiles", "user_preferences", "sessions", "password_resets",
+			"user_permissions", "mfa_credentials"} {
+			if _, err := s.exec(`DELETE FROM `+table+` WHERE user_id = ?`, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RoleRepository methods
+type sqlRoleRepo struct{ *sqlStore }
+
+const roleColumns = `id, name, description, permissions, require_mfa, version, created_at`
+
+func scanRole(row rowScanner) (*Role, error) {
+	var role Role
+	var perms sql.NullString
+	if err := row.Scan(&role.ID, &role.Name, &role.Description, &perms, &role.RequireMFA, &role.Version, &role.CreatedAt); err != nil {
+		return nil, err
+	}
+	if err := fromJSON(perms, &role.Permissions); err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+func (r sqlRoleRepo) Get(id string) (*Role, error) {
+	role, err := scanRole(r.queryRow(`SELECT `+roleColumns+` FROM roles WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFound("role")
+	}
+	return role, err
+}
+
+func (r sqlRoleRepo) List() ([]*Role, error) {
+	rows, err := r.query(`SELECT ` + roleColumns + ` FROM roles`)
+	return scanAll(rows, err, scanRole)
+}
+
+func (r sqlRoleRepo) ListPage(q listQuery) ([]*Role, string, error) {
+	return sqlPage(r.sqlStore, "roles", roleColumns, roleListSpec, q, scanRole)
+}
+
+func (r sqlRoleRepo) Create(role *Role) error {
+	perms, err := toJSON(role.Permissions)
+	if err != nil {
+		return err
+	}
+	if perms == nil {
+		perms = "[]"
+	}
+
+	role.Version = 1
+	role.CreatedAt = time.Now()
+	_, err = r.exec(`INSERT INTO roles (`+roleColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		role.ID, role.Name, role.Description, perms, role.RequireMFA, role.Version, role.CreatedAt)
+	return err
+}
+
+func (r sqlRoleRepo) Update(id string, updatedRole *Role) error {
+	perms, err := toJSON(updatedRole.Permissions)
+	if err != nil {
+		return err
+	}
+	if perms == nil {
+		perms = "[]"
+	}
+
+	err = r.execVersioned("role", "roles", "id", id,
+		`UPDATE roles SET name = ?, description = ?, permissions = ?, require_mfa = ?, version = version + 1
+		WHERE id = ? AND version = ?`,
+		updatedRole.Name, updatedRole.Description, perms, updatedRole.RequireMFA, id, updatedRole.Version)
+	if err == nil {
+		updatedRole.Version++
+	}
+	return err
+}
+
+func (r sqlRoleRepo) Delete(id string) error {
+	return r.execOne(notFound("role"), `DELETE FROM roles WHERE id = ?`, id)
+}
+
+func (r sqlRoleRepo) SetRequireMFA(id string, required bool) error {
+	return r.execOne(notFound("role"), `UPDATE roles SET require_mfa = ?, version = version + 1 WHERE id = ?`,
+		required, id)
+}
+
+// ProfileRepository methods
+type sqlProfileRepo struct{ *sqlStore }
+
+const profileColumns = `id, user_id, avatar, bio, phone_number, location, company, website, version, updated_at`
+
+func scanProfile(row rowScanner) (*UserProfile, error) {
+	var p UserProfile
+	err := row.Scan(&p.ID, &p.UserID, &p.Avatar, &p.Bio, &p.PhoneNumber, &p.Location,
+		&p.Company, &p.Website, &p.Version, &p.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (r sqlProfileRepo) Create(profile *UserProfile) error {
+	profile.Version = 1
+	profile.UpdatedAt = time.Now()
+	_, err := r.exec(`INSERT INTO user_profiles (`+profileColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		profile.ID, profile.UserID, profile.Avatar, profile.Bio, profile.PhoneNumber, profile.Location,
+		profile.Company, profile.Website, profile.Version, profile.UpdatedAt)
+	if err != nil && (strings.Contains(err.Error(), "user_profiles.user_id") || strings.Contains(err.Error(), "idx_user_profiles_user_id")) {
+		return profileExists()
+	}
+	return err
+}
+
+func (r sqlProfileRepo) GetByUserID(userID string) (*UserProfile, error) {
+	profile, err := scanProfile(r.queryRow(`SELECT `+profileColumns+` FROM user_profiles WHERE user_id = ?`, userID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFound("profile")
+	}
+	return profile, err
+}
+
+func (r sqlProfileRepo) Update(id string, updatedProfile *UserProfile) error {
+	updatedProfile.UpdatedAt = time.Now()
+	err := r.execVersioned("profile", "user_profiles", "id", id,
+		`UPDATE user_profiles SET user_id = ?, avatar = ?, bio = ?, phone_number = ?, location = ?,
+			company = ?, website = ?, version = version + 1, updated_at = ? WHERE id = ? AND version = ?`,
+		updatedProfile.UserID, updatedProfile.Avatar, updatedProfile.Bio, updatedProfile.PhoneNumber, updatedProfile.Location,
+		updatedProfile.Company, updatedProfile.Website, updatedProfile.UpdatedAt, id, updatedProfile.Version)
+	if err == nil {
+		updatedProfile.Version++
+	}
+	return err
+}
+
+func (r sqlProfileRepo) DeleteByUserID(userID string) error {
+	return r.execOne(notFound("profile"), `DELETE FROM user_profiles WHERE user_id = ?`, userID)
+}
+
+// TeamRepository methods
+type sqlTeamRepo struct{ *sqlStore }
+
+const teamColumns = `id, name, description, owner_id, member_count, version, created_at, updated_at`
+
+func scanTeam(row rowScanner) (*Team, error) {
+	var t Team
+	err := row.Scan(&t.ID, &t.Name, &t.Description, &t.OwnerID, &t.MemberCount, &t.Version, &t.CreatedAt, &t.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+const teamMemberColumns = `id, team_id, user_id, role, joined_at`
+
+func scanTeamMember(row rowScanner) (*TeamMember, error) {
+	var m TeamMember
+	if err := row.Scan(&m.ID, &m.TeamID, &m.UserID, &m.Role, &m.JoinedAt); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (r sqlTeamRepo) Create(team *Team) error {
+	team.Version = 1
+	team.CreatedAt = time.Now()
+	team.UpdatedAt = time.Now()
+	_, err := r.exec(`INSERT INTO teams (`+teamColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		team.ID, team.Name, team.Description, team.OwnerID, team.MemberCount, team.Version, team.CreatedAt, team.UpdatedAt)
+	return err
+}
+
+func (r sqlTeamRepo) Get(id string) (*Team, error) {
+	team, err := scanTeam(r.queryRow(`SELECT `+teamColumns+` FROM teams WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFound("team")
+	}
+	return team, err
+}
+
+func (r sqlTeamRepo) List() ([]*Team, error) {
+	rows, err := r.query(`SELECT ` + teamColumns + ` FROM teams`)
+	return scanAll(rows, err, scanTeam)
+}
+
+func (r sqlTeamRepo) ListPage(q listQuery) ([]*Team, string, error) {
+	return sqlPage(r.sqlStore, "teams", teamColumns, teamListSpec, q, scanTeam)
+}
+
+func (r sqlTeamRepo) Update(id string, updatedTeam *Team) error {
+	updatedTeam.UpdatedAt = time.Now()
+	err := r.execVersioned("team", "teams", "id", id,
+		`UPDATE teams SET name = ?, description = ?, owner_id = ?, member_count = ?, version = version + 1,
+			created_at = ?, updated_at = ? WHERE id = ? AND version = ?`,
+		updatedTeam.Name, updatedTeam.Description, updatedTeam.OwnerID, updatedTeam.MemberCount,
+		updatedTeam.CreatedAt, updatedTeam.UpdatedAt, id, updatedTeam.Version)
+	if err == nil {
+		updatedTeam.Version++
+	}
+	return err
+}
+
+func (r sqlTeamRepo) Delete(id string) error {
+	return r.WithinTx(func(tx Store) error {
+		s := tx.(*sqlStore)
+
+		if err := s.execOne(notFound("team"), `DELETE FROM teams WHERE id = ?`, id); err != nil {
+			return err
+		}
+		if _, err := s.exec(`DELETE FROM team_members WHERE team_id = ?`, id); err != nil {
+			return err
+		}
+		if _, err := s.exec(`UPDATE users SET team_id = '', version = version + 1, updated_at = ? WHERE team_id = ?`, time.Now(), id); err != nil {
+			return err
+		}
+		_, err := s.exec(`UPDATE invitations SET status = 'revoked' WHERE team_id = ? AND status = 'pending'`, id)
+		return err
+	})
+}
+
+func (r sqlTeamRepo) AddMember(member *TeamMember) error {
+	return r.WithinTx(func(tx Store) error {
+		s := tx.(*sqlStore)
+
+		if _, err := s.Teams().Get(member.TeamID); err != nil {
+			return err
+		}
+		if _, err := s.Users().Get(member.UserID); err != nil {
+			return err
+		}
+
+		member.JoinedAt = time.Now()
+		if _, err := s.exec(`INSERT INTO team_members (`+teamMemberColumns+`) VALUES (?, ?, ?, ?, ?)`,
+			member.ID, member.TeamID, member.UserID, member.Role, member.JoinedAt); err != nil {
+			return uniqueMemberError(err)
+		}
+
+		now := time.Now()
+		if _, err := s.exec(`UPDATE teams SET member_count = member_count + 1, version = version + 1, updated_at = ?
+			WHERE id = ?`,
+			now, member.TeamID); err != nil {
+			return err
+		}
+		_, err := s.exec(`UPDATE users SET team_id = ?, version = version + 1, updated_at = ? WHERE id = ?`,
+			member.TeamID, now, member.UserID)
+		return err
+	})
+}
+
+// uniqueMemberError turns a violation of the unique team and user index of
+// team_members into a ConflictError. SQLite names the columns, Postgres
+// the index.
+func uniqueMemberError(err error) error {
+	if strings.Contains(err.Error(), "team_members.team_id") || strings.Contains(err.Error(), "idx_team_members_team_user") {
+		return alreadyTeamMember()
+	}
+	return err
+}
+
+func (r sqlTeamRepo) RemoveMember(teamID, userID string) error {
+	return r.WithinTx(func(tx Store) error {
+		s := tx.(*sqlStore)
+
+		var count int
+		if err := s.queryRow(`SELECT COUNT(*) FROM team_members WHERE team_id = ? AND user_id = ?`,
+			teamID, userID).Scan(&count); err != nil {
+			return err
+		}
+		if count == 0 {
+			return notFound("team member")
+		}
+		return s.removeMemberships(teamID, userID)
+	})
+}
+
+// removeMemberships deletes userID's memberships of teamID, or of every
+// team if teamID is "", keeping member_count and users.team_id in step
+func (s *sqlStore) removeMemberships(teamID, userID string) error {
+	filter, args := `user_id = ?`, []interface{}{userID}
+	if teamID != "" {
+		filter, args = filter+` AND team_id = ?`, append(args, teamID)
+	}
+
+	now := time.Now()
+	countArgs := append(append([]interface{}{}, args...), now)
+	if _, err := s.exec(`UPDATE teams SET member_count = member_count -
+			(SELECT COUNT(*) FROM team_members WHERE team_members.team_id = teams.id AND `+filter+`),
+			version = version + 1, updated_at = ?
+		WHERE id IN (SELECT team_id FROM team_members WHERE `+filter+`)`,
+		append(countArgs, args...)...); err != nil {
+		return err
+	}
+	userArgs := append([]interface{}{now, userID}, args...)
+	if _, err := s.exec(`UPDATE users SET team_id = '', version = version + 1, updated_at = ?
+		WHERE id = ? AND team_id IN (SELECT team_id FROM team_members WHERE `+filter+`)`,
+		userArgs...); err != nil {
+		return err
+	}
+	_, err := s.exec(`DELETE FROM team_members WHERE `+filter, args...)
+	return err
+}
+
+func (r sqlTeamRepo) Members(teamID string) ([]*TeamMember, error) {
+	rows, err := r.query(`SELECT `+teamMemberColumns+` FROM team_members WHERE team_id = ? ORDER BY joined_at`, teamID)
+	return scanAll(rows, err, scanTeamMember)
+}
+
+// AuditLogRepository methods
+type sqlAuditLogRepo struct{ *sqlStore }
+
+const auditLogColumns = `id, user_id, action, resource_id, resource_type, ip_address, user_agent, status, details, created_at, prev_hash, hash`
+
+// auditLogReadColumns adds the seq the database assigns on insert
+const auditLogReadColumns = `seq, ` + auditLogColumns
+
+func scanAuditLog(row rowScanner) (*AuditLog, error) {
+	var l AuditLog
+	var details, prevHash, hash sql.NullString
+	err := row.Scan(&l.Seq, &l.ID, &l.UserID, &l.Action, &l.ResourceID, &l.ResourceType, &l.IPAddress,
+		&l.UserAgent, &l.Status, &details, &l.CreatedAt, &prevHash, &hash)
+	if err != nil {
+		return nil, err
+	}
+	l.PrevHash, l.Hash = prevHash.String, hash.String
+	if err := fromJSON(details, &l.Details); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func (r sqlAuditLogRepo) Create(log *AuditLog) error {
+	details, err := toJSON(log.Details)
+	if err != nil {
+		return err
+	}
+
+	// Appends are serialized until their transaction ends, so that each
+	// links to the head committed before it: PostgreSQL through an advisory
+	// lock, SQLite by allowing a single writer. The unique prev_hash index
+	// rejects a fork should that ever fail.
+	return r.WithinTx(func(tx Store) error {
+		s := tx.(*sqlStore)
+		if s.dialect == dialectPostgres {
+			if _, err := s.exec(`SELECT pg_advisory_xact_lock(?)`, auditChainLockID); err != nil {
+				return err
+			}
+		}
+		var prevHash sql.NullString
+		err := s.queryRow(`SELECT hash FROM audit_logs ORDER BY seq DESC LIMIT 1`).Scan(&prevHash)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		log.link(prevHash.String)
+		err = s.queryRow(`INSERT INTO audit_logs (`+auditLogColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING seq`,
+			log.ID, log.UserID, log.Action, log.ResourceID, log.ResourceType, log.IPAddress,
+			log.UserAgent, log.Status, details, log.CreatedAt, log.PrevHash, log.Hash).Scan(&log.Seq)
+		if err != nil {
+			return err
+		}
+		s.afterCommit(auditLogSignal.notify)
+		return nil
+	})
+}
+
+// auditChainLockID identifies the PostgreSQL advisory lock held while
+// appending to the audit log
+const auditChainLockID = 0x61756469 // "audi"
+
+func (r sqlAuditLogRepo) Walk(fn func(log *AuditLog) error) error {
+	rows, err := r.query(`SELECT ` + auditLogReadColumns + ` FROM audit_logs ORDER BY seq`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		log, err := scanAuditLog(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(log); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (r sqlAuditLogRepo) Head() (*AuditLog, error) {
+	log, err := scanAuditLog(r.queryRow(`SELECT ` + auditLogReadColumns + ` FROM audit_logs ORDER BY seq DESC LIMIT 1`))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return log, err
+}
+
+const auditCheckpointColumns = `id, kind, entry_id, entry_hash, key_id, signature, created_at`
+
+func (r sqlAuditLogRepo) CreateCheckpoint(cp *AuditCheckpoint) error {
+	_, err := r.exec(`INSERT INTO audit_checkpoints (`+auditCheckpointColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		cp.ID, cp.Kind, cp.EntryID, cp.EntryHash, cp.KeyID, cp.Signature, cp.CreatedAt)
+	return err
+}
+
+func (r sqlAuditLogRepo) Checkpoints() ([]*AuditCheckpoint, error) {
+	rows, err := r.query(`SELECT ` + auditCheckpointColumns + ` FROM audit_checkpoints ORDER BY seq`)
+	return scanAll(rows, err, func(row rowScanner) (*AuditCheckpoint, error) {
+		var cp AuditCheckpoint
+		err := row.Scan(&cp.ID, &cp.Kind, &cp.EntryID, &cp.EntryHash, &cp.KeyID, &cp.Signature, &cp.CreatedAt)
+		return &cp, err
+	})
+}
+
+func (r sqlAuditLogRepo) ChainStart() (int64, error) {
+	var start int64
+	err := r.queryRow(`SELECT chain_start FROM audit_chain`).Scan(&start)
+	return start, err
+}
+
+func (r sqlAuditLogRepo) ListPage(q listQuery) ([]*AuditLog, string, error) {
+	return sqlPage(r.sqlStore, "audit_logs", auditLogReadColumns, auditLogListSpec, q, scanAuditLog)
+}
+
+func (r sqlAuditLogRepo) Prune(policy retentionPolicy, archive func([]*AuditLog) error) (int, error) {
+	return pruneTable(r.sqlStore, "audit_logs", auditLogReadColumns, scanAuditLog,
+		func(l *AuditLog) string { return l.ID }, policy, archive)
+}
+
+// pruneTable archives and deletes, oldest first and in batches, the rows
+// of a log table that policy no longer retains
+func pruneTable[T any](s *sqlStore, table, columns string, scan func(rowScanner) (*T, error),
+	id func(*T) string, policy retentionPolicy, archive func([]*T) error) (int, error) {
+	// Rows up to lastSeq are beyond the newest MaxEntries
+	var lastSeq int64
+	if policy.MaxEntries > 0 {
+		err := s.queryRow(`SELECT seq FROM `+table+` ORDER BY seq DESC LIMIT 1 OFFSET ?`, policy.MaxEntries).Scan(&lastSeq)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return 0, err
+		}
+	}
+	cutoff := policy.cutoff(time.Now())
+
+	pruned := 0
+	for {
+		rows, err := s.query(`SELECT `+columns+` FROM `+table+` WHERE seq <= ? OR created_at < ? ORDER BY seq LIMIT ?`,
+			lastSeq, cutoff, retentionBatchSize)
+		batch, err := scanAll(rows, err, scan)
+		if err != nil || len(batch) == 0 {
+			return pruned, err
+		}
+		if archive != nil {
+			if err := archive(batch); err != nil {
+				return pruned, err
+			}
+		}
+
+		ids := make([]interface{}, len(batch))
+		for i, entry := range batch {
+			ids[i] = id(entry)
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+		if _, err := s.exec(`DELETE FROM `+table+` WHERE id IN (`+placeholders+`)`, ids...); err != nil {
+			return pruned, err
+		}
+		pruned += len(batch)
+		if len(batch) < retentionBatchSize {
+			return pruned, nil
+		}
+	}
+}
+
+// PasswordResetRepository methods
+type sqlPasswordResetRepo struct{ *sqlStore }
+
+const passwordResetColumns = `id, user_id, token, expires_at, used, created_at`
+
+func (r sqlPasswordResetRepo) Create(reset *PasswordReset) error {
+	reset.CreatedAt = time.Now()
+	_, err := r.exec(`INSERT INTO password_resets (`+passwordResetColumns+`) VALUES (?, ?, ?, ?, ?, ?)`,
+		reset.ID, reset.UserID, reset.Token, reset.ExpiresAt, reset.Used, reset.CreatedAt)
+	return err
+}
+
+func (r sqlPasswordResetRepo) GetByToken(token string) (*PasswordReset, error) {
+	var reset PasswordReset
+	err := r.queryRow(`SELECT `+passwordResetColumns+` FROM password_resets WHERE token = ?`, token).
+		Scan(&reset.ID, &reset.UserID, &reset.Token, &reset.ExpiresAt, &reset.Used, &reset.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFound("reset token")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &reset, nil
+}
+
+func (r sqlPasswordResetRepo) MarkUsed(token string) error {
+	res, err := r.exec(`UPDATE password_resets SET used = ? WHERE token = ? AND used = ?`, true, token, false)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	if _, err := r.GetByToken(token); err != nil {
+		return err
+	}
+	return errResetTokenUsed
+}
+
+// SessionRepository methods
+type sqlSessionRepo struct{ *sqlStore }
+
+const sessionColumns = `id, user_id, token, kind, family_id, ip_address, user_agent, expires_at, last_activity, revoked_at, created_at`
+
+func scanSession(row rowScanner) (*Session, error) {
+	var s Session
+	var revokedAt sql.NullTime
+	err := row.Scan(&s.ID, &s.UserID, &s.Token, &s.Kind, &s.FamilyID, &s.IPAddress, &s.UserAgent,
+		&s.ExpiresAt, &s.LastActivity, &revokedAt, &s.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if revokedAt.Valid {
+		s.RevokedAt = &revokedAt.Time
+	}
+	return &s, nil
+}
+
+func (r sqlSessionRepo) Create(session *Session) error {
+	session.CreatedAt = time.Now()
+	session.LastActivity = time.Now()
+	_, err := r.exec(`INSERT INTO sessions (`+sessionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		session.ID, session.UserID, session.Token, session.Kind, session.FamilyID, session.IPAddress, session.UserAgent,
+		session.ExpiresAt, session.LastActivity, session.RevokedAt, session.CreatedAt)
+	return err
+}
+
+func (r sqlSessionRepo) GetByToken(token string) (*Session, error) {
+	session, err := scanSession(r.queryRow(`SELECT `+sessionColumns+` FROM sessions WHERE token = ?`, token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFound("session")
+	}
+	return session, err
+}
+
+func (r sqlSessionRepo) ListByUser(userID string) ([]*Session, error) {
+	rows, err := r.query(`SELECT `+sessionColumns+` FROM sessions WHERE user_id = ?`, userID)
+	return scanAll(rows, err, scanSession)
+}
+
+func (r sqlSessionRepo) Touch(token string, at time.Time) error {
+	return r.execOne(notFound("session"),
+		`UPDATE sessions SET last_activity = ? WHERE token = ?`, at, token)
+}
+
+func (r sqlSessionRepo) Revoke(token string, at time.Time) error {
+	res, err := r.exec(`UPDATE sessions SET revoked_at = ? WHERE token = ? AND revoked_at IS NULL`, at, token)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	if _, err := r.GetByToken(token); err != nil {
+		return err
+	}
+	return errSessionRevoked
+}
+
+func (r sqlSessionRepo) RevokeFamily(familyID string, at time.Time) error {
+	_, err := r.exec(`UPDATE sessions SET revoked_at = ? WHERE family_id = ? AND revoked_at IS NULL`, at, familyID)
+	return err
+}
+
+func (r sqlSessionRepo) RevokeUser(userID string, at time.Time) error {
+	_, err := r.exec(`UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL`, at, userID)
+	return err
+}
+
+func (r sqlSessionRepo) Delete(token string) error {
+	return r.execOne(notFound("session"), `DELETE FROM sessions WHERE token = ?`, token)
+}
+
+// PreferencesRepository methods
+type sqlPreferencesRepo struct{ *sqlStore }
+
+const preferencesColumns = `id, user_id, theme, language, timezone, notifications, settings, version, updated_at`
+
+func (r sqlPreferencesRepo) Create(prefs *UserPreferences) error {
+	notifications, err := toJSON(prefs.Notifications)
+	if err != nil {
+		return err
+	}
+	settings, err := toJSON(prefs.Settings)
+	if err != nil {
+		return err
+	}
+
+	// Creating preferences for a user who has them replaces them
+	prefs.UpdatedAt = time.Now()
+	return r.queryRow(`INSERT INTO user_preferences (`+preferencesColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, 1, ?)
+		ON CONFLICT (user_id) DO UPDATE SET id = excluded.id, theme = excluded.theme, language = excluded.language,
+			timezone = excluded.timezone, notifications = excluded.notifications, settings = excluded.settings,
+			version = user_preferences.version + 1, updated_at = excluded.updated_at
+		RETURNING version`,
+		prefs.ID, prefs.UserID, prefs.Theme, prefs.Language, prefs.Timezone, notifications, settings, prefs.UpdatedAt).
+		Scan(&prefs.Version)
+}
+
+func (r sqlPreferencesRepo) GetByUserID(userID string) (*UserPreferences, error) {
+	var prefs UserPreferences
+	var notifications, settings sql.NullString
+	err := r.queryRow(`SELECT `+preferencesColumns+` FROM user_preferences WHERE user_id = ?`, userID).
+		Scan(&prefs.ID, &prefs.UserID, &prefs.Theme, &prefs.Language, &prefs.Timezone, &notifications, &settings, &prefs.Version, &prefs.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFound("preferences")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := fromJSON(notifications, &prefs.Notifications); err != nil {
+		return nil, err
+	}
+	if err := fromJSON(settings, &prefs.Settings); err != nil {
+		return nil, err
+	}
+	return &prefs, nil
+}
+
+func (r sqlPreferencesRepo) Update(userID string, updatedPrefs *UserPreferences) error {
+	notifications, err := toJSON(updatedPrefs.Notifications)
+	if err != nil {
+		return err
+	}
+	settings, err := toJSON(updatedPrefs.Settings)
+	if err != nil {
+		return err
+	}
+
+	updatedPrefs.UpdatedAt = time.Now()
+	err = r.execVersioned("preferences", "user_preferences", "user_id", userID,
+		`UPDATE user_preferences SET theme = ?, language = ?, timezone = ?, notifications = ?, settings = ?,
+			version = version + 1, updated_at = ? WHERE user_id = ? AND version = ?`,
+		updatedPrefs.Theme, updatedPrefs.Language, updatedPrefs.Timezone, notifications, settings,
+		updatedPrefs.UpdatedAt, userID, updatedPrefs.Version)
+	if err == nil {
+		updatedPrefs.Version++
+	}
+	return err
+}
+
+func (r sqlPreferencesRepo) Delete(userID string) error {
+	return r.execOne(notFound("preferences"), `DELETE FROM user_preferences WHERE user_id = ?`, userID)
+}
+
+// ActivityLogRepository methods
+type sqlActivityLogRepo struct{ *sqlStore }
+
+const activityLogColumns = `id, user_id, activity_type, description, metadata, ip_address, created_at`
+
+// activityLogReadColumns adds the seq the database assigns on insert
+const activityLogReadColumns = `seq, ` + activityLogColumns
+
+func scanActivityLog(row rowScanner) (*ActivityLog, error) {
+	var l ActivityLog
+	var metadata sql.NullString
+	err := row.Scan(&l.Seq, &l.ID, &l.UserID, &l.ActivityType, &l.Description, &metadata, &l.IPAddress, &l.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := fromJSON(metadata, &l.Metadata); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func (r sqlActivityLogRepo) Create(log *ActivityLog) error {
+	metadata, err := toJSON(log.Metadata)
+	if err != nil {
+		return err
+	}
+
+	// Streams follow seq, so entries must become visible in seq order:
+	// PostgreSQL assigns seq at insert, not commit, so appends are
+	// serialized until their transaction ends through an advisory lock;
+	// SQLite allows a single writer anyway
+	return r.WithinTx(func(tx Store) error {
+		s := tx.(*sqlStore)
+		if s.dialect == dialectPostgres {
+			if _, err := s.exec(`SELECT pg_advisory_xact_lock(?)`, activityLogLockID); err != nil {
+				return err
+			}
+		}
+		log.CreatedAt = time.Now()
+		err := s.queryRow(`INSERT INTO activity_logs (`+activityLogColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING seq`,
+			log.ID, log.UserID, log.ActivityType, log.Description, metadata, log.IPAddress, log.CreatedAt).Scan(&log.Seq)
+		if err != nil {
+			return err
+		}
+		s.afterCommit(activityLogSignal.notify)
+		return nil
+	})
+}
+
+// activityLogLockID identifies the PostgreSQL advisory lock held while
+// appending to the activity log
+const activityLogLockID = 0x61637469 // "acti"
+
+func (r sqlActivityLogRepo) ListPage(q listQuery) ([]*ActivityLog, string, error) {
+	return sqlPage(r.sqlStore, "activity_logs", activityLogReadColumns, activityLogListSpec, q, scanActivityLog)
+}
+
+func (r sqlActivityLogRepo) ListByUser(userID string, limit int) ([]*ActivityLog, error) {
+	rows, err := r.query(`SELECT `+activityLogReadColumns+` FROM activity_logs WHERE user_id = ? ORDER BY seq DESC LIMIT ?`,
+		userID, limit)
+	return scanAll(rows, err, scanActivityLog)
+}
+
+func (r sqlActivityLogRepo) Prune(policy retentionPolicy, archive func([]*ActivityLog) error) (int, error) {
+	return pruneTable(r.sqlStore, "activity_logs", activityLogReadColumns, scanActivityLog,
+		func(l *ActivityLog) string { return l.ID }, policy, archive)
+}
+
+// InvitationRepository methods
+type sqlInvitationRepo struct{ *sqlStore }
+
+const invitationColumns = `id, email, team_id, role_id, invited_by, token, status, expires_at, accepted_at, created_at`
+
+func scanInvitation(row rowScanner) (*Invitation, error) {
+	var inv Invitation
+	var acceptedAt sql.NullTime
+	err := row.Scan(&inv.ID, &inv.Email, &inv.TeamID, &inv.RoleID, &inv.InvitedBy, &inv.Token,
+		&inv.Status, &inv.ExpiresAt, &acceptedAt, &inv.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if acceptedAt.Valid {
+		inv.AcceptedAt = &acceptedAt.Time
+	}
+	return &inv, nil
+}
+
+func (r sqlInvitationRepo) Create(invitation *Invitation) error {
+	invitation.CreatedAt = time.Now()
+	_, err := r.exec(`INSERT INTO invitations (`+invitationColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		invitation.ID, invitation.Email, invitation.TeamID, invitation.RoleID, invitation.InvitedBy, invitation.Token,
+		invitation.Status, invitation.ExpiresAt, invitation.AcceptedAt, invitation.CreatedAt)
+	return err
+}
+
+func (r sqlInvitationRepo) GetByToken(token string) (*Invitation, error) {
+	invitation, err := scanInvitation(r.queryRow(`SELECT `+invitationColumns+` FROM invitations WHERE token = ?`, token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFound("invitation")
+	}
+	return invitation, err
+}
+
+func (r sqlInvitationRepo) UpdateStatus(token string, status string) error {
+	var acceptedAt *time.Time
+	if status == "accepted" {
+		now := time.Now()
+		acceptedAt = &now
+	}
+	res, err := r.exec(`UPDATE invitations SET status = ?, accepted_at = COALESCE(?, accepted_at) WHERE token = ? AND status = ?`,
+		status, acceptedAt, token, "pending")
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	if _, err := r.GetByToken(token); err != nil {
+		return err
+	}
+	return invitationProcessed()
+}
+
+func (r sqlInvitationRepo) ListPage(q listQuery) ([]*Invitation, string, error) {
+	return sqlPage(r.sqlStore, "invitations", invitationColumns, invitationListSpec, q, scanInvitation)
+}
+
+// PermissionRepository methods
+type sqlPermissionRepo struct{ *sqlStore }
+
+const permissionColumns = `id, name, resource, action, description, created_at`
+
+func scanPermission(row rowScanner) (*Permission, error) {
+	var p Permission
+	if err := row.Scan(&p.ID, &p.Name, &p.Resource, &p.Action, &p.Description, &p.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+const userPermissionColumns = `id, user_id, permission_id, granted_by, granted_at`
+
+func scanUserPermission(row rowScanner) (*UserPermission, error) {
+	var up UserPermission
+	if err := row.Scan(&up.ID, &up.UserID, &up.PermissionID, &up.GrantedBy, &up.GrantedAt); err != nil {
+		return nil, err
+	}
+	return &up, nil
+}
+
+func (r sqlPermissionRepo) Create(perm *Permission) error {
+	perm.CreatedAt = time.Now()
+	_, err := r.exec(`INSERT INTO permissions (`+permissionColumns+`) VALUES (?, ?, ?, ?, ?, ?)`,
+		perm.ID, perm.Name, perm.Resource, perm.Action, perm.Description, perm.CreatedAt)
+	return err
+}
+
+func (r sqlPermissionRepo) Get(id string) (*Permission, error) {
+	perm, err := scanPermission(r.queryRow(`SELECT `+permissionColumns+` FROM permissions WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFound("permission")
+	}
+	return perm, err
+}
+
+func (r sqlPermissionRepo) List() ([]*Permission, error) {
+	rows, err := r.query(`SELECT ` + permissionColumns + ` FROM permissions`)
+	return scanAll(rows, err, scanPermission)
+}
+
+func (r sqlPermissionRepo) Update(id string, updatedPerm *Permission) error {
+	return r.execOne(notFound("permission"),
+		`UPDATE permissions SET name = ?, resource = ?, action = ?, description = ? WHERE id = ?`,
+		updatedPerm.Name, updatedPerm.Resource, updatedPerm.Action, updatedPerm.Description, id)
+}
+
+func (r sqlPermissionRepo) Delete(id string) error {
+	return r.WithinTx(func(tx Store) error {
+		s := tx.(*sqlStore)
+
+		if err := s.execOne(notFound("permission"), `DELETE FROM permissions WHERE id = ?`, id); err != nil {
+			return err
+		}
+		_, err := s.exec(`DELETE FROM user_permissions WHERE permission_id = ?`, id)
+		return err
+	})
+}
+
+func (r sqlPermissionRepo) Grant(userPerm *UserPermission) error {
+	return r.WithinTx(func(tx Store) error {
+		s := tx.(*sqlStore)
+
+		if _, err := s.Users().Get(userPerm.UserID); err != nil {
+			return err
+		}
+		userPerm.GrantedAt = time.Now()
+		if _, err := s.exec(`INSERT INTO user_permissions (`+userPermissionColumns+`) VALUES (?, ?, ?, ?, ?)`,
+			userPerm.ID, userPerm.UserID, userPerm.PermissionID, userPerm.GrantedBy, userPerm.GrantedAt); err != nil {
+			return uniqueGrantError(err)
+		}
+		return nil
+	})
+}
+
+// uniqueGrantError turns a violation of the unique user and permission
+// index of user_permissions into a ConflictError. SQLite names the
+// columns, Postgres the index.
+func uniqueGrantError(err error) error {
+	if strings.Contains(err.Error(), "user_permissions.user_id") || strings.Contains(err.Error(), "idx_user_permissions_user_permission") {
+		return alreadyGranted()
+	}
+	return err
+}
+
+func (r sqlPermissionRepo) UserGrants(userID string) ([]*UserPermission, error) {
+	rows, err := r.query(`SELECT `+userPermissionColumns+` FROM user_permissions WHERE user_id = ? ORDER BY granted_at`, userID)
+	return scanAll(rows, err, scanUserPermission)
+}
+
+func (r sqlPermissionRepo) Revoke(userID, permissionID string) error {
+	// Revoke a single grant, matching the in-memory store
+	return r.execOne(notFound("permission grant"),
+		`DELETE FROM user_permissions WHERE id IN (
+			SELECT id FROM user_permissions WHERE user_id = ? AND permission_id = ? ORDER BY granted_at LIMIT 1
+		)`, userID, permissionID)
+}
+
+// MFARepository methods
+type sqlMFARepo struct{ *sqlStore }
+
+const mfaColumns = `user_id, secret, recovery_codes, last_used_step, confirmed_at, created_at`
+
+func (r sqlMFARepo) Get(userID string) (*MFACredential, error) {
+	var cred MFACredential
+	var codes sql.NullString
+	var confirmedAt sql.NullTime
+	err := r.queryRow(`SELECT `+mfaColumns+` FROM mfa_credentials WHERE user_id = ?`, userID).
+		Scan(&cred.UserID, &cred.Secret, &codes, &cred.LastUsedStep, &confirmedAt, &cred.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFound("mfa credential")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := fromJSON(codes, &cred.RecoveryCodes); err != nil {
+		return nil, err
+	}
+	if confirmedAt.Valid {
+		cred.ConfirmedAt = &confirmedAt.Time
+	}
+	return &cred, nil
+}
+
+func (r sqlMFARepo) Save(cred *MFACredential) error {
+	codes, err := toJSON(cred.RecoveryCodes)
+	if err != nil {
+		return err
+	}
+	if codes == nil {
+		codes = "[]"
+	}
+
+	if cred.CreatedAt.IsZero() {
+		cred.CreatedAt = time.Now()
+	}
+	_, err = r.exec(`INSERT INTO mfa_credentials (`+mfaColumns+`) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET secret = excluded.secret, recovery_codes = excluded.recovery_codes,
+			last_used_step = excluded.last_used_step, confirmed_at = excluded.confirmed_at,
+			created_at = excluded.created_at`,
+		cred.UserID, cred.Secret, codes, cred.LastUsedStep, cred.ConfirmedAt, cred.CreatedAt)
+	return err
+}
+
+func (r sqlMFARepo) Use(cred, read *MFACredential) error {
+	codes, err := toJSON(cred.RecoveryCodes)
+	if err != nil {
+		return err
+	}
+	readCodes, err := toJSON(read.RecoveryCodes)
+	if err != nil {
+		return err
+	}
+	if codes == nil {
+		codes = "[]"
+	}
+	if readCodes == nil {
+		readCodes = "[]"
+	}
+
+	return r.execOne(errMFACodeUsed, `UPDATE mfa_credentials
+		SET secret = ?, recovery_codes = ?, last_used_step = ?, confirmed_at = ?
+		WHERE user_id = ? AND secret = ? AND last_used_step = ? AND recovery_codes = ?`,
+		cred.Secret, codes, cred.LastUsedStep, cred.ConfirmedAt,
+		cred.UserID, read.Secret, read.LastUsedStep, readCodes)
+}
+
+func (r sqlMFARepo) Delete(userID string) error {
+	return r.execOne(notFound("mfa credential"), `DELETE FROM mfa_credentials WHERE user_id = ?`, userID)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const defaultSQLiteDSN = "users.db"
+
+// openSQLiteDB opens an embedded SQLite database file
+func openSQLiteDB(dsn string) (*sql.DB, error) {
+	if dsn == "" {
+		dsn = defaultSQLiteDSN
+	}
+	// Wait on locks instead of failing, let readers run alongside the writer
+	// and have transactions take the write lock when they begin, so that a
+	// transaction's reads are still current when it writes
+	if !strings.Contains(dsn, "?") {
+		dsn += "?_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate"
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// openSQLiteStore opens the database and, if enabled, migrates it to the
+// latest schema version
+func openSQLiteStore(cfg Config) (Store, error) {
+	db, err := openSQLiteDB(cfg.StorageDSN)
+	if err != nil {
+		return nil, err
+	}
+
+	return openSQLStore(db, dialectSQLite, cfg.AutoMigrate)
+}
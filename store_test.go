@@ -0,0 +1,531 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The store conformance tests run every backend through the same checks of
+// the repository contracts in repository.go. The Postgres backend is only
+// tested when TEST_POSTGRES_DSN names a database the tests may write to;
+// they create records with fresh IDs and do not clean up.
+
+// forEachStore runs test against a fresh store of each backend
+func forEachStore(t *testing.T, test func(t *testing.T, s Store)) {
+	backends := []struct {
+		name string
+		open func(t *testing.T) (Store, error)
+	}{
+		{"memory", func(t *testing.T) (Store, error) {
+			return newMemoryStore(), nil
+		}},
+		{"sqlite", func(t *testing.T) (Store, error) {
+			return openSQLiteStore(Config{StorageDSN: filepath.Join(t.TempDir(), "test.db"), AutoMigrate: true})
+		}},
+		{"postgres", func(t *testing.T) (Store, error) {
+			dsn := os.Getenv("TEST_POSTGRES_DSN")
+			if dsn == "" {
+				t.Skip("TEST_POSTGRES_DSN is not set")
+			}
+			return openPostgresStore(Config{StorageDSN: dsn, AutoMigrate: true})
+		}},
+	}
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			s, err := backend.open(t)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			t.Cleanup(func() { s.Close() })
+			test(t, s)
+		})
+	}
+}
+
+// createTestUser stores a user with a fresh ID, email and username
+func createTestUser(t *testing.T, s Store) *User {
+	t.Helper()
+	id := generateID("user")
+	user := &User{ID: id, Email: id + "@example.test", Username: id, IsActive: true}
+	if err := s.Users().Create(user); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	return user
+}
+
+func TestStoreUsers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		user := createTestUser(t, s)
+
+		for name, get := range map[string]func() (*User, error){
+			"Get":           func() (*User, error) { return s.Users().Get(user.ID) },
+			"GetByEmail":    func() (*User, error) { return s.Users().GetByEmail(user.Email) },
+			"GetByUsername": func() (*User, error) { return s.Users().GetByUsername(user.Username) },
+		} {
+			got, err := get()
+			if err != nil || got.ID != user.ID {
+				t.Errorf("%s: got %v, %v", name, got, err)
+			}
+		}
+
+		var conflict *ConflictError
+		if err := s.Users().Create(&User{ID: generateID("user"), Email: user.Email, Username: generateID("user")}); !errors.As(err, &conflict) {
+			t.Errorf("create with a taken email: got %v, want a ConflictError", err)
+		}
+		if err := s.Users().Create(&User{ID: generateID("user"), Email: generateID("user") + "@example.test", Username: user.Username}); !errors.As(err, &conflict) {
+			t.Errorf("create with a taken username: got %v, want a ConflictError", err)
+		}
+
+		stored, _ := s.Users().Get(user.ID)
+		stored.FirstName = "Ada"
+		if err := s.Users().Update(user.ID, stored); err != nil {
+			t.Fatalf("update: %v", err)
+		}
+		updated, _ := s.Users().Get(user.ID)
+		if updated.FirstName != "Ada" || updated.Version != user.Version+1 {
+			t.Errorf("after update: first name %q, version %d, want %q, %d", updated.FirstName, updated.Version, "Ada", user.Version+1)
+		}
+
+		var mismatch *VersionMismatchError
+		stale := *updated
+		stale.Version--
+		if err := s.Users().Update(user.ID, &stale); !errors.As(err, &mismatch) {
+			t.Errorf("stale update: got %v, want a VersionMismatchError", err)
+		}
+	})
+}
+
+func TestStoreUserDeleteCascades(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		user := createTestUser(t, s)
+		if err := s.Profiles().Create(&UserProfile{ID: generateID("profile"), UserID: user.ID}); err != nil {
+			t.Fatalf("create profile: %v", err)
+		}
+		if err := s.Sessions().Create(&Session{ID: generateID("session"), Token: generateID("token"), UserID: user.ID, Kind: "session", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatalf("create session: %v", err)
+		}
+
+		if err := s.Users().Delete(user.ID); err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+
+		var missing *NotFoundError
+		if _, err := s.Users().Get(user.ID); !errors.As(err, &missing) {
+			t.Errorf("get deleted user: got %v, want a NotFoundError", err)
+		}
+		if _, err := s.Users().GetByEmail(user.Email); !errors.As(err, &missing) {
+			t.Errorf("get deleted user by email: got %v, want a NotFoundError", err)
+		}
+		if _, err := s.Profiles().GetByUserID(user.ID); !errors.As(err, &missing) {
+			t.Errorf("get deleted user's profile: got %v, want a NotFoundError", err)
+		}
+		if sessions, err := s.Sessions().ListByUser(user.ID); err != nil || len(sessions) != 0 {
+			t.Errorf("deleted user's sessions: got %d, %v", len(sessions), err)
+		}
+		if err := s.Users().Delete(user.ID); !errors.As(err, &missing) {
+			t.Errorf("delete again: got %v, want a NotFoundError", err)
+		}
+	})
+}
+
+func TestStoreSessions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		user := createTestUser(t, s)
+		var tokens []string
+		for i := 0; i < 3; i++ {
+			session := &Session{ID: generateID("session"), Token: generateID("token"), UserID: user.ID, Kind: "refresh", ExpiresAt: time.Now().Add(time.Hour)}
+			if err := s.Sessions().Create(session); err != nil {
+				t.Fatalf("create: %v", err)
+			}
+			tokens = append(tokens, session.Token)
+		}
+
+		if err := s.Sessions().Revoke(tokens[0], time.Now()); err != nil {
+			t.Fatalf("revoke: %v", err)
+		}
+		if err := s.Sessions().Revoke(tokens[0], time.Now()); !errors.Is(err, errSessionRevoked) {
+			t.Errorf("revoke again: got %v, want errSessionRevoked", err)
+		}
+
+		if err := s.Sessions().RevokeUser(user.ID, time.Now()); err != nil {
+			t.Fatalf("revoke user: %v", err)
+		}
+		sessions, err := s.Sessions().ListByUser(user.ID)
+		if err != nil || len(sessions) != 3 {
+			t.Fatalf("list: got %d, %v", len(sessions), err)
+		}
+		for _, session := range sessions {
+			if session.RevokedAt == nil {
+				t.Errorf("session %s was not revoked", session.ID)
+			}
+		}
+	})
+}
+
+func TestStorePasswordResets(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		user := createTestUser(t, s)
+		token := generateID("reset")
+		if err := s.PasswordResets().Create(&PasswordReset{ID: generateID("reset"), UserID: user.ID, Token: token, ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+
+		if err := s.PasswordResets().MarkUsed(token); err != nil {
+			t.Fatalf("mark used: %v", err)
+		}
+		if err := s.PasswordResets().MarkUsed(token); !errors.Is(err, errResetTokenUsed) {
+			t.Errorf("mark used again: got %v, want errResetTokenUsed", err)
+		}
+		var missing *NotFoundError
+		if err := s.PasswordResets().MarkUsed("no-such-token"); !errors.As(err, &missing) {
+			t.Errorf("mark unknown token used: got %v, want a NotFoundError", err)
+		}
+	})
+}
+
+func TestStorePermissionGrants(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		user := createTestUser(t, s)
+		grant := func(userID string) error {
+			return s.Permissions().Grant(&UserPermission{ID: generateID("userperm"), UserID: userID, PermissionID: "perm-1"})
+		}
+
+		if err := grant(user.ID); err != nil {
+			t.Fatalf("grant: %v", err)
+		}
+		var conflict *ConflictError
+		if err := grant(user.ID); !errors.As(err, &conflict) {
+			t.Errorf("grant again: got %v, want a ConflictError", err)
+		}
+		var missing *NotFoundError
+		if err := grant("no-such-user"); !errors.As(err, &missing) {
+			t.Errorf("grant to an unknown user: got %v, want a NotFoundError", err)
+		}
+		if grants, err := s.Permissions().UserGrants(user.ID); err != nil || len(grants) != 1 {
+			t.Errorf("got %d grants, %v", len(grants), err)
+		}
+	})
+}
+
+func TestStoreInvitationStatus(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		token := generateID("invite")
+		if err := s.Invitations().Create(&Invitation{ID: generateID("invitation"), Email: token + "@example.test", Token: token, Status: "pending", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+
+		if err := s.Invitations().UpdateStatus(token, "accepted"); err != nil {
+			t.Fatalf("accept: %v", err)
+		}
+		var conflict *ConflictError
+		if err := s.Invitations().UpdateStatus(token, "revoked"); !errors.As(err, &conflict) {
+			t.Errorf("revoke an accepted invitation: got %v, want a ConflictError", err)
+		}
+		if invitation, err := s.Invitations().GetByToken(token); err != nil || invitation.Status != "accepted" || invitation.AcceptedAt == nil {
+			t.Errorf("got %+v, %v", invitation, err)
+		}
+		var missing *NotFoundError
+		if err := s.Invitations().UpdateStatus("no-such-token", "accepted"); !errors.As(err, &missing) {
+			t.Errorf("accept an unknown invitation: got %v, want a NotFoundError", err)
+		}
+	})
+}
+
+func TestStoreMFAUse(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		user := createTestUser(t, s)
+		if err := s.MFA().Save(&MFACredential{UserID: user.ID, Secret: "SECRET", RecoveryCodes: []string{"a", "b"}}); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+
+		read, err := s.MFA().Get(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Two requests accept a code against the same read; only one wins
+		first, second := read.clone(), read.clone()
+		first.LastUsedStep = 10
+		second.RecoveryCodes = []string{"b"}
+		if err := s.MFA().Use(first, read); err != nil {
+			t.Fatalf("use: %v", err)
+		}
+		if err := s.MFA().Use(second, read); !errors.Is(err, errMFACodeUsed) {
+			t.Errorf("use with a stale read: got %v, want errMFACodeUsed", err)
+		}
+
+		stored, err := s.MFA().Get(user.ID)
+		if err != nil || stored.LastUsedStep != 10 || len(stored.RecoveryCodes) != 2 {
+			t.Errorf("got %+v, %v", stored, err)
+		}
+		stored.RecoveryCodes = []string{"b"}
+		if err := s.MFA().Use(stored, first); err != nil {
+			t.Errorf("use after re-reading: %v", err)
+		}
+	})
+}
+
+func TestStoreProfiles(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		user := createTestUser(t, s)
+		if err := s.Profiles().Create(&UserProfile{ID: generateID("profile"), UserID: user.ID}); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		var conflict *ConflictError
+		if err := s.Profiles().Create(&UserProfile{ID: generateID("profile"), UserID: user.ID}); !errors.As(err, &conflict) {
+			t.Errorf("create a second profile: got %v, want a ConflictError", err)
+		}
+	})
+}
+
+func TestStoreTeamMembers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		owner, member := createTestUser(t, s), createTestUser(t, s)
+		team := &Team{ID: generateID("team"), Name: "Team", OwnerID: owner.ID}
+		if err := s.Teams().Create(team); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		if err := s.Teams().AddMember(&TeamMember{ID: generateID("member"), TeamID: team.ID, UserID: member.ID, Role: "member"}); err != nil {
+			t.Fatalf("add member: %v", err)
+		}
+
+		members, err := s.Teams().Members(team.ID)
+		if err != nil || len(members) != 1 || members[0].UserID != member.ID {
+			t.Errorf("members: got %v, %v", members, err)
+		}
+		if user, _ := s.Users().Get(member.ID); user.TeamID != team.ID {
+			t.Errorf("member's team: got %q, want %q", user.TeamID, team.ID)
+		}
+
+		var conflict *ConflictError
+		if err := s.Teams().AddMember(&TeamMember{ID: generateID("member"), TeamID: team.ID, UserID: member.ID}); !errors.As(err, &conflict) {
+			t.Errorf("add a member twice: got %v, want a ConflictError", err)
+		}
+		var missing *NotFoundError
+		if err := s.Teams().AddMember(&TeamMember{ID: generateID("member"), TeamID: "no-such-team", UserID: member.ID}); !errors.As(err, &missing) {
+			t.Errorf("add a member to an unknown team: got %v, want a NotFoundError", err)
+		}
+		if err := s.Teams().AddMember(&TeamMember{ID: generateID("member"), TeamID: team.ID, UserID: "no-such-user"}); !errors.As(err, &missing) {
+			t.Errorf("add an unknown user: got %v, want a NotFoundError", err)
+		}
+		if stored, _ := s.Teams().Get(team.ID); stored.MemberCount != 1 {
+			t.Errorf("member count: got %d, want 1", stored.MemberCount)
+		}
+
+		if err := s.Teams().RemoveMember(team.ID, member.ID); err != nil {
+			t.Fatalf("remove member: %v", err)
+		}
+		if members, _ := s.Teams().Members(team.ID); len(members) != 0 {
+			t.Errorf("members after removal: got %d", len(members))
+		}
+
+		if err := s.Teams().Delete(team.ID); err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+		if _, err := s.Teams().Get(team.ID); !errors.As(err, &missing) {
+			t.Errorf("get deleted team: got %v, want a NotFoundError", err)
+		}
+	})
+}
+
+func TestStoreAuditChain(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		for i := 0; i < 3; i++ {
+			if err := s.AuditLogs().Create(&AuditLog{ID: generateID("audit"), Action: "test", Status: "success"}); err != nil {
+				t.Fatalf("create: %v", err)
+			}
+		}
+
+		var prev *AuditLog
+		err := s.AuditLogs().Walk(func(entry *AuditLog) error {
+			if prev != nil && entry.PrevHash != prev.Hash {
+				t.Errorf("entry %s: prev hash %q, want %q", entry.ID, entry.PrevHash, prev.Hash)
+			}
+			prev = entry
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("walk: %v", err)
+		}
+
+		head, err := s.AuditLogs().Head()
+		if err != nil || head == nil || head.ID != prev.ID {
+			t.Errorf("head: got %v, %v, want %s", head, err, prev.ID)
+		}
+
+		signer, _ := newCheckpointSigner("", nil)
+		report, err := verifyAuditChain(s.AuditLogs(), signer)
+		if err != nil || !report.Valid {
+			t.Errorf("verify: got %+v, %v", report, err)
+		}
+	})
+}
+
+func TestStoreAuditLogSearch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		action := generateID("search")
+		for _, details := range []map[string]interface{}{
+			{
+				"reason":   "Bad Password",
+				"attempts": 37,
+				"locked":   true,
+				"tags":     []string{"alpha", "beta"},
+				"changes":  map[string]interface{}{"email": map[string]interface{}{"from": "a@example.test", "to": "b@example.test"}},
+			},
+			{"reason": "other"},
+			nil,
+		} {
+			if err := s.AuditLogs().Create(&AuditLog{ID: generateID("audit"), Action: action, Details: details}); err != nil {
+				t.Fatalf("create: %v", err)
+			}
+		}
+
+		// Only values are searched, so a search reads the same on every
+		// backend whatever its rendering of JSON
+		for search, want := range map[string]int{
+			"bad pass":       1,
+			"b@example.test": 1,
+			"37":             1,
+			"true":           1,
+			"beta":           1,
+			"other":          1,
+			"reason":         0,
+			`"reason":"bad`:  0,
+			`"reason": "bad`: 0,
+		} {
+			q, err := parseListValues(url.Values{"action": {action}, "q": {search}}, auditLogListSpec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if logs, _, err := s.AuditLogs().ListPage(q); err != nil || len(logs) != want {
+				t.Errorf("q=%s: got %d entries, %v, want %d", search, len(logs), err, want)
+			}
+		}
+	})
+}
+
+func TestStoreActivityLogs(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		user := createTestUser(t, s)
+		var ids []string
+		for i := 0; i < 5; i++ {
+			log := &ActivityLog{ID: generateID("activity"), UserID: user.ID, ActivityType: "view"}
+			if err := s.ActivityLogs().Create(log); err != nil {
+				t.Fatalf("create: %v", err)
+			}
+			ids = append(ids, log.ID)
+			time.Sleep(time.Millisecond)
+		}
+
+		// Most recent first, up to the limit
+		logs, err := s.ActivityLogs().ListByUser(user.ID, 3)
+		if err != nil || len(logs) != 3 {
+			t.Fatalf("list: got %d, %v", len(logs), err)
+		}
+		for i, log := range logs {
+			if want := ids[len(ids)-1-i]; log.ID != want {
+				t.Errorf("entry %d: got %s, want %s", i, log.ID, want)
+			}
+		}
+	})
+}
+
+func TestStoreWithinTxCommits(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		var user *User
+		err := s.WithinTx(func(tx Store) error {
+			id := generateID("user")
+			user = &User{ID: id, Email: id + "@example.test", Username: id}
+			return tx.Users().Create(user)
+		})
+		if err != nil {
+			t.Fatalf("tx: %v", err)
+		}
+		if _, err := s.Users().Get(user.ID); err != nil {
+			t.Errorf("get user created in a committed tx: %v", err)
+		}
+	})
+}
+
+func TestStoreWithinTxRollsBack(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		user := createTestUser(t, s)
+		var auditEntries int
+		s.AuditLogs().Walk(func(*AuditLog) error { auditEntries++; return nil })
+
+		var created *User
+		failure := errors.New("fail")
+		err := s.WithinTx(func(tx Store) error {
+			id := generateID("user")
+			created = &User{ID: id, Email: id + "@example.test", Username: id}
+			if err := tx.Users().Create(created); err != nil {
+				return err
+			}
+			changed, _ := tx.Users().Get(user.ID)
+			changed.FirstName = "Ada"
+			if err := tx.Users().Update(user.ID, changed); err != nil {
+				return err
+			}
+			if err := tx.Sessions().Create(&Session{ID: generateID("session"), Token: generateID("token"), UserID: user.ID, Kind: "session", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+				return err
+			}
+			if err := tx.AuditLogs().Create(&AuditLog{ID: generateID("audit"), Action: "test", Status: "success"}); err != nil {
+				return err
+			}
+			return failure
+		})
+		if !errors.Is(err, failure) {
+			t.Fatalf("tx: got %v, want fn's error", err)
+		}
+
+		var missing *NotFoundError
+		if _, err := s.Users().Get(created.ID); !errors.As(err, &missing) {
+			t.Errorf("get user created in a rolled back tx: got %v, want a NotFoundError", err)
+		}
+		if _, err := s.Users().GetByEmail(created.Email); !errors.As(err, &missing) {
+			t.Errorf("get user created in a rolled back tx by email: got %v, want a NotFoundError", err)
+		}
+		if stored, _ := s.Users().Get(user.ID); stored.FirstName != "" || stored.Version != user.Version {
+			t.Errorf("user updated in a rolled back tx: first name %q, version %d", stored.FirstName, stored.Version)
+		}
+		if sessions, _ := s.Sessions().ListByUser(user.ID); len(sessions) != 0 {
+			t.Errorf("sessions created in a rolled back tx: got %d", len(sessions))
+		}
+		var after int
+		s.AuditLogs().Walk(func(*AuditLog) error { after++; return nil })
+		if after != auditEntries {
+			t.Errorf("audit entries: got %d, want %d", after, auditEntries)
+		}
+	})
+}
+
+// TestStoreTimesAcrossOffsets writes on a host whose local time is ahead of
+// UTC and filters by a time given in UTC
+func TestStoreTimesAcrossOffsets(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("UTC+5", 5*60*60)
+	t.Cleanup(func() { time.Local = local })
+
+	forEachStore(t, func(t *testing.T, s Store) {
+		user := createTestUser(t, s)
+		if err := s.ActivityLogs().Create(&ActivityLog{ID: generateID("activity"), UserID: user.ID, ActivityType: "view"}); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+
+		now := time.Now().UTC()
+		q, err := parseListValues(url.Values{
+			"user_id":        {user.ID},
+			"created_after":  {now.Add(-time.Minute).Format(time.RFC3339)},
+			"created_before": {now.Add(time.Minute).Format(time.RFC3339)},
+		}, activityLogListSpec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if logs, _, err := s.ActivityLogs().ListPage(q); err != nil || len(logs) != 1 {
+			t.Errorf("entries created within a minute: got %d, %v", len(logs), err)
+		}
+	})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The audit and activity logs can be followed as streams of server-sent
+// events. A stream does not buffer entries for its client: it reads them
+// from the store after its cursor, a page at a time, whenever the log
+// signals new entries. A slow client therefore only falls behind, and one
+// that stops reading is disconnected after streamWriteTimeout. The ID of
+// each event is the cursor after its entry, so a client reconnecting with
+// Last-Event-ID resumes where it left off.
+//
+// Streams follow the seq of the entries, which every store makes visible
+// in increasing order, rather than created_at: an entry whose transaction
+// commits after a later entry's would otherwise be skipped by a stream
+// that had already passed its creation time.
+//
+// Signals are in-process; entries written by other instances sharing the
+// database are picked up every streamPollInterval.
+
+const (
+	streamPageSize     = 100
+	streamPollInterval = 5 * time.Second
+	streamHeartbeat    = 15 * time.Second
+	streamWriteTimeout = 10 * time.Second
+	maxStreams         = 100
+)
+
+// logSignal wakes up the streams waiting for new entries of a log
+type logSignal struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+var auditLogSignal, activityLogSignal logSignal
+
+// wait returns a channel that is closed at the next notify
+func (s *logSignal) wait() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ch == nil {
+		s.ch = make(chan struct{})
+	}
+	return s.ch
+}
+
+func (s *logSignal) notify() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ch != nil {
+		close(s.ch)
+		s.ch = nil
+	}
+}
+
+// streamSlots bounds the number of open streams
+var streamSlots = make(chan struct{}, maxStreams)
+
+// streamAuditLogsHandler streams new audit log entries that match the
+// audit log filters
+func streamAuditLogsHandler(c *gin.Context) {
+	streamLog(c, "audit", auditLogListSpec, &auditLogSignal, store.AuditLogs().ListPage)
+}
+
+// streamActivityLogsHandler streams new activity log entries that match
+// the user_id, activity_type, ip_address and q filters
+func streamActivityLogsHandler(c *gin.Context) {
+	streamLog(c, "activity", activityLogListSpec, &activityLogSignal, store.ActivityLogs().ListPage)
+}
+
+// streamLog sends the entries of a log that the request selects as events
+// of type event, in the order they were written. It starts after the
+// Last-Event-ID header or ?cursor, or else with the entries written from
+// now on.
+func streamLog[T any](c *gin.Context, event string, spec listSpec[*T], signal *logSignal,
+	list func(listQuery) ([]*T, string, error)) {
+	params := c.Request.URL.Query()
+	if params.Has("sort") {
+		respondError(c, badRequest("streams are ordered as the entries were written and cannot be sorted"))
+		return
+	}
+	resume := params.Get("cursor")
+	if id := c.GetHeader("Last-Event-ID"); id != "" {
+		resume = id
+	}
+	params.Del("cursor")
+	q, err := parseListValues(params, spec)
+	if err != nil {
+		respondError(c, badRequest(err.Error()))
+		return
+	}
+	q.sort = "seq"
+
+	if resume != "" {
+		cursor, err := decodeCursor(resume)
+		if err == nil && cursor.Sort != q.sortKey() {
+			err = errors.New("cursor of another sort")
+		}
+		if err == nil {
+			_, err = parseFieldValue(kindInt, cursor.Value)
+		}
+		if err != nil {
+			respondError(c, badRequest("invalid cursor or Last-Event-ID"))
+			return
+		}
+		q.cursor = cursor
+	} else {
+		// Start after the newest entry, whether or not it matches
+		newest, _, err := list(listQuery{sort: "seq", desc: true, limit: 1})
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		q.cursor = &pageCursor{Sort: q.sortKey(), Value: "0"}
+		if len(newest) > 0 {
+			q.cursor = spec.cursorAfter(q, newest[0])
+		}
+	}
+	q.limit = streamPageSize
+
+	select {
+	case streamSlots <- struct{}{}:
+		defer func() { <-streamSlots }()
+	default:
+		respondError(c, &statusError{Status: http.StatusServiceUnavailable, Detail: "Too many open streams"})
+		return
+	}
+
+	header := c.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	// A client that does not take what is written within the deadline is
+	// disconnected rather than buffered for
+	rc := http.NewResponseController(c.Writer)
+	write := func(format string, args ...interface{}) bool {
+		rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		_, err := fmt.Fprintf(c.Writer, format, args...)
+		return err == nil
+	}
+	if !write("retry: %d\n\n", streamPollInterval.Milliseconds()) || rc.Flush() != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	poll := time.NewTimer(streamPollInterval)
+	defer poll.Stop()
+
+	for {
+		// Taken before reading, so that entries written meanwhile are not missed
+		wake := signal.wait()
+
+		entries, next, err := list(q)
+		if err != nil {
+			log.Printf("request %s: %s stream: %v", c.GetString(contextRequestIDKey), event, err)
+			return
+		}
+		for _, entry := range entries {
+			data, err := json.Marshal(entry)
+			if err != nil {
+				log.Printf("request %s: %s stream: %v", c.GetString(contextRequestIDKey), event, err)
+				return
+			}
+			q.cursor = spec.cursorAfter(q, entry)
+			if !write("id: %s\nevent: %s\ndata: %s\n\n", q.cursor.encode(), event, data) {
+				return
+			}
+		}
+		if len(entries) > 0 && rc.Flush() != nil {
+			return
+		}
+		if next != "" {
+			continue
+		}
+
+		poll.Reset(streamPollInterval)
+		select {
+		case <-wake:
+		case <-poll.C:
+		case <-heartbeat.C:
+			if !write(": keep-alive\n\n") || rc.Flush() != nil {
+				return
+			}
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors,
+// "12345678901234567890", in base32
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeRFC6238Vectors(t *testing.T) {
+	// The RFC lists 8-digit codes; 6-digit codes are their last 6 digits
+	for unix, want := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	} {
+		step := unix / int64(totpPeriod.Seconds())
+		if got, err := totpCode(rfc6238Secret, step); err != nil || got != want {
+			t.Errorf("T=%d: got %q, %v, want %q", unix, got, err, want)
+		}
+		if _, ok := verifyTOTP(strings.ToLower(rfc6238Secret), want, time.Unix(unix, 0), 0); !ok {
+			t.Errorf("T=%d: code rejected", unix)
+		}
+	}
+}
+
+func TestVerifyTOTPRejectsReplay(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / int64(totpPeriod.Seconds())
+	code, _ := totpCode(rfc6238Secret, current)
+	previous, _ := totpCode(rfc6238Secret, current-1)
+
+	step, ok := verifyTOTP(rfc6238Secret, code, now, 0)
+	if !ok || step != current {
+		t.Fatalf("got step %d, %v, want %d", step, ok, current)
+	}
+	if _, ok := verifyTOTP(rfc6238Secret, code, now, step); ok {
+		t.Error("code accepted again in the same step")
+	}
+	// The previous step is within the clock skew allowance, but not once a
+	// later code was used
+	if _, ok := verifyTOTP(rfc6238Secret, previous, now, 0); !ok {
+		t.Error("code of the previous step rejected before any was used")
+	}
+	if _, ok := verifyTOTP(rfc6238Secret, previous, now, step); ok {
+		t.Error("code of the previous step accepted after a later one was used")
+	}
+	if _, ok := verifyTOTP(rfc6238Secret, code, now.Add(2*totpPeriod), 0); ok {
+		t.Error("code accepted outside the clock skew allowance")
+	}
+}
+
+func TestRecoveryCodesAreSingleUse(t *testing.T) {
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil || len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d codes, %v", len(codes), err)
+	}
+	cred := &MFACredential{RecoveryCodes: hashes}
+
+	// Codes may be typed without the dash and in any case
+	typed := strings.ToUpper(strings.ReplaceAll(codes[3], "-", ""))
+	if !consumeRecoveryCode(cred, typed) {
+		t.Fatal("recovery code rejected")
+	}
+	if consumeRecoveryCode(cred, codes[3]) {
+		t.Error("recovery code accepted twice")
+	}
+	if len(cred.RecoveryCodes) != recoveryCodeCount-1 {
+		t.Errorf("got %d codes left", len(cred.RecoveryCodes))
+	}
+	if !consumeRecoveryCode(cred, codes[4]) {
+		t.Error("another recovery code rejected")
+	}
+}
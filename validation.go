@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"net/mail"
+	"reflect"
+	"regexp"
+	"strings"
+	_ "time/tzdata" // the timezone rule must not depend on the host's zoneinfo
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// Request payloads declare their rules in `binding` struct tags, checked by
+// gin's validator when a handler binds the body with bindJSON. Besides the
+// validator's built-in rules (required, oneof, url, e164, timezone, ...)
+// these are available:
+//
+//	email     an address, after normalization, without display name
+//	username  3-32 of a-z, 0-9, '.', '_' and '-' after normalization,
+//	          starting with a letter or digit
+var usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{2,31}$`)
+
+// ruleMessages describe failing rules to API clients
+var ruleMessages = map[string]string{
+	"required": "is required",
+	"email":    "must be a valid email address",
+	"username": "must be 3-32 characters of letters, digits, '.', '_' or '-', starting with a letter or digit",
+	"oneof":    "must be one of: ",
+	"url":      "must be an absolute URL",
+	"e164":     "must be a phone number in E.164 format, such as +14155552671",
+	"timezone": "must be an IANA time zone name, such as Europe/Paris",
+	"readonly": "cannot be changed",
+}
+
+// registerValidators adds the custom rules to gin's validator and makes it
+// report fields by their JSON names
+func registerValidators() error {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return errors.New("unexpected validator engine")
+	}
+
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+
+	// Both identifiers are validated in the form they will be stored in
+	if err := v.RegisterValidation("email", func(fl validator.FieldLevel) bool {
+		email := normalizeIdentifier(fl.Field().String())
+		addr, err := mail.ParseAddress(email)
+		return err == nil && addr.Address == email
+	}); err != nil {
+		return err
+	}
+	return v.RegisterValidation("username", func(fl validator.FieldLevel) bool {
+		return usernamePattern.MatchString(normalizeIdentifier(fl.Field().String()))
+	})
+}
+
+// fieldError describes one failing rule in a 422 response
+type fieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Param   string `json:"param,omitempty"`
+	Message string `json:"message"`
+}
+
+// bindJSON decodes the request body into obj and checks its rules. It
+// fails the request with 400 if the body cannot be decoded, or with a
+// ValidationError listing every failing field, and reports whether the
+// handler should go on.
+func bindJSON(c *gin.Context, obj interface{}) bool {
+	err := c.ShouldBindJSON(obj)
+	if err == nil {
+		return true
+	}
+
+	var invalid validator.ValidationErrors
+	if !errors.As(err, &invalid) {
+		respondError(c, badRequest("Invalid request"))
+		return false
+	}
+	respondError(c, validationFailure(invalid))
+	return false
+}
+
+// validationFailure converts the validator's errors into a ValidationError
+func validationFailure(invalid validator.ValidationErrors) error {
+	fields := make([]fieldError, 0, len(invalid))
+	for _, fe := range invalid {
+		message, ok := ruleMessages[fe.Tag()]
+		if !ok {
+			message = "fails the " + fe.Tag() + " rule"
+		}
+		if fe.Tag() == "oneof" {
+			message += strings.ReplaceAll(fe.Param(), " ", ", ")
+		}
+		fields = append(fields, fieldError{
+			Field:   fe.Field(),
+			Rule:    fe.Tag(),
+			Param:   fe.Param(),
+			Message: message,
+		})
+	}
+	return &ValidationError{Fields: fields}
+}